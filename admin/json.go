@@ -0,0 +1,57 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// JSONFunc returns the value to be serialized in the response to r
+type JSONFunc func(r *http.Request) (interface{}, error)
+
+// Error can be returned from a JSONFunc to respond with a specific status code
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// NotFound ...
+func NotFound(message string) error {
+	return &Error{Status: http.StatusNotFound, Message: message}
+}
+
+// BadRequest ...
+func BadRequest(message string) error {
+	return &Error{Status: http.StatusBadRequest, Message: message}
+}
+
+// JSON returns a handler that responds to GET requests with the JSON encoding of the value returned by fn
+func JSON(fn JSONFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		res, err := fn(r)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if e, ok := err.(*Error); ok {
+				status = e.Status
+			}
+			writeJSON(w, status, map[string]string{"error": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, res)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
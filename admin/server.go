@@ -0,0 +1,36 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Server serves the HTTP admin endpoints, e.g. /metrics
+type Server struct {
+	bind string
+	mux  *http.ServeMux
+	log  *logrus.Entry
+}
+
+// NewServer instantiates a new admin server that listens on the address passed in "bind"
+func NewServer(bind string, logger *logrus.Entry) *Server {
+	return &Server{
+		bind: bind,
+		mux:  http.NewServeMux(),
+		log:  logger.WithField("bind", bind),
+	}
+}
+
+// Handle registers the handler for the given pattern
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Run ...
+func (s *Server) Run() {
+	s.log.Info("listening")
+	if err := http.ListenAndServe(s.bind, s.mux); err != nil {
+		s.log.Error(err)
+	}
+}
@@ -1,31 +1,239 @@
 package config
 
 import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"sync"
 	"time"
-
-	"github.com/caarlos0/env"
 )
 
-// Params defines all possible config params
+// Params defines all possible config params. Every param can be set via its environment variable
+// or via its key in the config file. Params tagged with reload:"true" are applied on Reload.
 type Params struct {
-	Environment           string        `env:"SPIRE_ENV"  envDefault:"prod"`
-	DevicesBind           string        `env:"SPIRE_DEVICES_BIND"  envDefault:":1883"`
-	ControlBind           string        `env:"SPIRE_CONTROL_BIND"  envDefault:":1884"`
-	BugsnagKey            string        `env:"SPIRE_BUGSNAG_KEY"`
-	LiberatorBaseURL      string        `env:"SPIRE_LIBERATOR_BASE_URL"  envDefault:"https://api.superscale.io"`
-	LiberatorJWTToken     string        `env:"SPIRE_LIBERATOR_JWT_TOKEN,required"`
-	IdleConnectionTimeout time.Duration `env:"SPIRE_IDLE_CONNECTION_TIMEOUT"  envDefault:"30s"`
-	SentryDynamoDBTable   string        `env:"SPIRE_SENTRY_DYNAMODB_TABLE,required"`
-	SlashPrefixTopics     bool          `env:"SPIRE_SLASH_PREFIX_TOPICS"  envDefault:"true"`
-}
-
-// Config is the global handle for accessing runtime configuration
+	Environment               string        `env:"SPIRE_ENV"  envDefault:"prod"  yaml:"environment"`
+	DevicesBind               string        `env:"SPIRE_DEVICES_BIND"  envDefault:":1883"  yaml:"devices_bind"`
+	ControlBind               string        `env:"SPIRE_CONTROL_BIND"  envDefault:":1884"  yaml:"control_bind"`
+	AdminBind                 string        `env:"SPIRE_ADMIN_BIND"  envDefault:":8080"  yaml:"admin_bind"`
+	BugsnagKey                string        `env:"SPIRE_BUGSNAG_KEY"  yaml:"bugsnag_key"`
+	DeviceRegistry            string        `env:"SPIRE_DEVICE_REGISTRY"  envDefault:"liberator"  yaml:"device_registry"` // "liberator", "file" or "memory"
+	DeviceRegistryFile        string        `env:"SPIRE_DEVICE_REGISTRY_FILE"  yaml:"device_registry_file"`               // JSON or YAML file for the "file" registry, optional seed of the "memory" registry
+	LiberatorBaseURL          string        `env:"SPIRE_LIBERATOR_BASE_URL"  envDefault:"https://api.superscale.io"  yaml:"liberator_base_url"`
+	LiberatorJWTToken         string        `env:"SPIRE_LIBERATOR_JWT_TOKEN"  yaml:"liberator_jwt_token"` // required for the "liberator" registry
+	LiberatorTimeout          time.Duration `env:"SPIRE_LIBERATOR_TIMEOUT"  envDefault:"5s"  yaml:"liberator_timeout"`
+	LiberatorRetries          int           `env:"SPIRE_LIBERATOR_RETRIES"  envDefault:"2"  yaml:"liberator_retries"`
+	LiberatorRetryBackoff     time.Duration `env:"SPIRE_LIBERATOR_RETRY_BACKOFF"  envDefault:"200ms"  yaml:"liberator_retry_backoff"`
+	LiberatorBreakerThreshold int           `env:"SPIRE_LIBERATOR_BREAKER_THRESHOLD"  envDefault:"5"  yaml:"liberator_breaker_threshold"`
+	LiberatorBreakerCooldown  time.Duration `env:"SPIRE_LIBERATOR_BREAKER_COOLDOWN"  envDefault:"30s"  yaml:"liberator_breaker_cooldown"`
+	DeviceInfoCacheSize       int           `env:"SPIRE_DEVICE_INFO_CACHE_SIZE"  envDefault:"10000"  yaml:"device_info_cache_size"`
+	DeviceInfoCacheTTL        time.Duration `env:"SPIRE_DEVICE_INFO_CACHE_TTL"  envDefault:"10m"  yaml:"device_info_cache_ttl"`
+	IdleConnectionTimeout     time.Duration `env:"SPIRE_IDLE_CONNECTION_TIMEOUT"  envDefault:"30s"  yaml:"idle_connection_timeout"  reload:"true"`
+	Handlers                  string        `env:"SPIRE_HANDLERS"  yaml:"enabled_handlers"`           // comma-separated. all handlers are enabled if empty
+	DisabledHandlers          string        `env:"SPIRE_DISABLED_HANDLERS"  yaml:"disabled_handlers"` // comma-separated
+	SlashPrefixTopics         bool          `env:"SPIRE_SLASH_PREFIX_TOPICS"  envDefault:"true"  yaml:"slash_prefix_topics"`
+	DeadLetterCapacity        int           `env:"SPIRE_DEADLETTER_CAPACITY"  envDefault:"100"  yaml:"deadletter_capacity"`
+	LogFormat                 string        `env:"SPIRE_LOG_FORMAT"  envDefault:"json"  yaml:"log_format"  reload:"true"` // "json" or "logfmt"
+	LogLevel                  string        `env:"SPIRE_LOG_LEVEL"  envDefault:"info"  yaml:"log_level"  reload:"true"`
+	LogLevels                 string        `env:"SPIRE_LOG_LEVELS"  yaml:"log_levels"  reload:"true"` // per subsystem, e.g. "stations=debug,mqtt=warn"
+	StatePath                 string        `env:"SPIRE_STATE_PATH"  yaml:"state_path"`                // BoltDB file for persisting formation state. state is not persisted if empty
+	StateSnapshotInterval     time.Duration `env:"SPIRE_STATE_SNAPSHOT_INTERVAL"  envDefault:"5m"  yaml:"state_snapshot_interval"`
+	StateRetention            time.Duration `env:"SPIRE_STATE_RETENTION"  envDefault:"168h"  yaml:"state_retention"  reload:"true"` // state of disconnected devices is evicted after this
+	StateGCInterval           time.Duration `env:"SPIRE_STATE_GC_INTERVAL"  envDefault:"10m"  yaml:"state_gc_interval"`
+	OTLPEndpoint              string        `env:"SPIRE_OTLP_ENDPOINT"  yaml:"otlp_endpoint"` // e.g. "http://localhost:4318". tracing is disabled if empty
+}
+
+// FileEnv is the environment variable holding the path of the optional YAML config file
+const FileEnv = "SPIRE_CONFIG_FILE"
+
+// Config is the global handle for accessing runtime configuration as it was at startup.
+// Use Current for params that can be reloaded.
 var Config = &Params{}
 
-// Parse environment variables into Config
-func Parse() {
-	err := env.Parse(Config)
+var (
+	l          sync.Mutex
+	current    *Params
+	sections   map[string]map[string]interface{} // handler name -> values from the config file
+	validators []func(*Params) error
+)
+
+// Parse reads the config file (if any) and environment variables into Config.
+// Environment variables take precedence over the config file. All problems are reported at once.
+func Parse() error {
+	params, secs, err := load()
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	*Config = *params
+	current = params
+	sections = secs
+	return nil
+}
+
+// Current returns the params in effect, including reloaded ones. The returned params must not be modified.
+func Current() *Params {
+	l.Lock()
+	defer l.Unlock()
+
+	if current == nil {
+		return Config
+	}
+	return current
+}
+
+// Reload reads config file and environment variables again and applies the params tagged
+// with reload:"true". It returns the new current params and the environment variable names
+// of changed params that require a restart. Nothing is applied if the new config is invalid.
+func Reload() (*Params, []string, error) {
+	fresh, secs, err := load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	next := *Config
+	if current != nil {
+		next = *current
+	}
+
+	ignored := apply(&next, fresh)
+	current = &next
+	sections = secs
+	return current, ignored, nil
+}
+
+// AddValidator registers a function that validates params in Parse and Reload,
+// e.g. for settings that are interpreted by other packages.
+func AddValidator(fn func(*Params) error) {
+	l.Lock()
+	defer l.Unlock()
+
+	validators = append(validators, fn)
+}
+
+// ParseSection populates section from the environment and the config section of the given handler,
+// which is read from the "handlers" map of the config file. section must be a pointer to a struct
+// with "env" and "yaml" tags. Handlers use this for their own config params.
+func ParseSection(handler string, section interface{}) error {
+	l.Lock()
+	values := sections[handler]
+	l.Unlock()
+
+	if errs := populate(section, values); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func load() (*Params, map[string]map[string]interface{}, error) {
+	values := make(map[string]interface{})
+
+	if path := os.Getenv(FileEnv); len(path) > 0 {
+		var err error
+		if values, err = readFile(path); err != nil {
+			return nil, nil, Errors{err}
+		}
+	}
+
+	secs, errs := splitSections(values)
+	params := new(Params)
+	errs = append(errs, populate(params, values)...)
+	errs = append(errs, validate(params)...)
+
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+	return params, secs, nil
+}
+
+func validate(params *Params) Errors {
+	var errs Errors
+
+	if params.LogFormat != "json" && params.LogFormat != "logfmt" {
+		errs = append(errs, fmt.Errorf("SPIRE_LOG_FORMAT: must be \"json\" or \"logfmt\", got %q", params.LogFormat))
+	}
+
+	if params.IdleConnectionTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("SPIRE_IDLE_CONNECTION_TIMEOUT: must be positive, got %v", params.IdleConnectionTimeout))
+	}
+
+	if params.DeadLetterCapacity <= 0 {
+		errs = append(errs, fmt.Errorf("SPIRE_DEADLETTER_CAPACITY: must be positive, got %d", params.DeadLetterCapacity))
+	}
+
+	switch params.DeviceRegistry {
+	case "liberator":
+		if len(params.LiberatorJWTToken) == 0 {
+			errs = append(errs, fmt.Errorf("SPIRE_LIBERATOR_JWT_TOKEN: required for the liberator device registry"))
+		}
+	case "file":
+		if len(params.DeviceRegistryFile) == 0 {
+			errs = append(errs, fmt.Errorf("SPIRE_DEVICE_REGISTRY_FILE: required for the file device registry"))
+		}
+	case "memory":
+	default:
+		errs = append(errs, fmt.Errorf("SPIRE_DEVICE_REGISTRY: must be \"liberator\", \"file\" or \"memory\", got %q", params.DeviceRegistry))
+	}
+
+	if _, err := url.Parse(params.LiberatorBaseURL); err != nil {
+		errs = append(errs, fmt.Errorf("SPIRE_LIBERATOR_BASE_URL: %v", err))
+	}
+
+	if len(params.StatePath) > 0 && params.StateSnapshotInterval <= 0 {
+		errs = append(errs, fmt.Errorf("SPIRE_STATE_SNAPSHOT_INTERVAL: must be positive, got %v", params.StateSnapshotInterval))
+	}
+
+	if params.StateRetention <= 0 {
+		errs = append(errs, fmt.Errorf("SPIRE_STATE_RETENTION: must be positive, got %v", params.StateRetention))
+	}
+
+	if params.StateGCInterval <= 0 {
+		errs = append(errs, fmt.Errorf("SPIRE_STATE_GC_INTERVAL: must be positive, got %v", params.StateGCInterval))
+	}
+
+	if params.LiberatorTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("SPIRE_LIBERATOR_TIMEOUT: must be positive, got %v", params.LiberatorTimeout))
+	}
+
+	if params.LiberatorRetries < 0 {
+		errs = append(errs, fmt.Errorf("SPIRE_LIBERATOR_RETRIES: must not be negative, got %d", params.LiberatorRetries))
+	}
+
+	l.Lock()
+	fns := validators
+	l.Unlock()
+
+	for _, fn := range fns {
+		if err := fn(params); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// apply copies the reloadable params from src to dst and returns the
+// environment variable names of all other params that differ
+func apply(dst, src *Params) []string {
+	var ignored []string
+
+	d := reflect.ValueOf(dst).Elem()
+	s := reflect.ValueOf(src).Elem()
+
+	for i := 0; i < d.NumField(); i++ {
+		field := d.Type().Field(i)
+
+		if field.Tag.Get("reload") == "true" {
+			d.Field(i).Set(s.Field(i))
+		} else if !reflect.DeepEqual(d.Field(i).Interface(), s.Field(i).Interface()) {
+			name, _ := parseEnvTag(field.Tag.Get("env"))
+			ignored = append(ignored, name)
+		}
 	}
+	return ignored
 }
@@ -0,0 +1,186 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/config"
+)
+
+type section struct {
+	Threshold time.Duration `env:"SPIRE_TEST_THRESHOLD"  envDefault:"1m"  yaml:"threshold"`
+	Name      string        `env:"SPIRE_TEST_NAME"  yaml:"name"`
+}
+
+var _ = Describe("Config", func() {
+
+	var file *os.File
+	var env map[string]string
+	var err error
+
+	writeFile := func(content string) {
+		Expect(file.Truncate(0)).NotTo(HaveOccurred())
+		_, err := file.WriteAt([]byte(content), 0)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		file, err = ioutil.TempFile("", "spire-config")
+		Expect(err).NotTo(HaveOccurred())
+
+		env = map[string]string{
+			config.FileEnv:              file.Name(),
+			"SPIRE_LIBERATOR_JWT_TOKEN": "token",
+		}
+	})
+	JustBeforeEach(func() {
+		for k, v := range env {
+			os.Setenv(k, v)
+		}
+		err = config.Parse()
+	})
+	AfterEach(func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+		os.Remove(file.Name())
+	})
+	Context("without a config file", func() {
+		BeforeEach(func() {
+			delete(env, config.FileEnv)
+		})
+		It("uses defaults and environment variables", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Config.DevicesBind).To(Equal(":1883"))
+			Expect(config.Config.LiberatorJWTToken).To(Equal("token"))
+			Expect(config.Config.IdleConnectionTimeout).To(Equal(30 * time.Second))
+			Expect(config.Config.SlashPrefixTopics).To(BeTrue())
+		})
+	})
+	Context("with a config file", func() {
+		BeforeEach(func() {
+			writeFile(`
+devices_bind: ":2883"
+log_level: debug
+idle_connection_timeout: 1m
+slash_prefix_topics: false
+enabled_handlers: [ping, up]
+handlers:
+  test:
+    threshold: 5s
+    name: from-file
+`)
+			env["SPIRE_LOG_LEVEL"] = "warn"
+		})
+		It("uses values from the file", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Config.DevicesBind).To(Equal(":2883"))
+			Expect(config.Config.IdleConnectionTimeout).To(Equal(time.Minute))
+			Expect(config.Config.SlashPrefixTopics).To(BeFalse())
+			Expect(config.Config.Handlers).To(Equal("ping,up"))
+		})
+		It("lets environment variables override the file", func() {
+			Expect(config.Config.LogLevel).To(Equal("warn"))
+		})
+		It("uses defaults for params not in the file", func() {
+			Expect(config.Config.ControlBind).To(Equal(":1884"))
+		})
+		It("provides handler config sections", func() {
+			s := new(section)
+			Expect(config.ParseSection("test", s)).NotTo(HaveOccurred())
+			Expect(s.Threshold).To(Equal(5 * time.Second))
+			Expect(s.Name).To(Equal("from-file"))
+		})
+		It("uses defaults for handlers without a section", func() {
+			s := new(section)
+			Expect(config.ParseSection("other", s)).NotTo(HaveOccurred())
+			Expect(s.Threshold).To(Equal(time.Minute))
+		})
+	})
+	Context("with invalid settings", func() {
+		BeforeEach(func() {
+			writeFile(`
+idle_connection_timeout: soon
+log_format: xml
+log_evel: debug
+`)
+			delete(env, "SPIRE_LIBERATOR_JWT_TOKEN")
+			env["SPIRE_DEADLETTER_CAPACITY"] = "-1"
+		})
+		It("reports all problems at once", func() {
+			Expect(err).To(HaveOccurred())
+
+			errs, ok := err.(config.Errors)
+			Expect(ok).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("SPIRE_IDLE_CONNECTION_TIMEOUT"))
+			Expect(err.Error()).To(ContainSubstring("SPIRE_LIBERATOR_JWT_TOKEN: required for the liberator device registry"))
+			Expect(err.Error()).To(ContainSubstring("SPIRE_LOG_FORMAT"))
+			Expect(err.Error()).To(ContainSubstring("SPIRE_DEADLETTER_CAPACITY"))
+			Expect(err.Error()).To(ContainSubstring(`unknown key "log_evel"`))
+			Expect(len(errs)).To(BeNumerically(">=", 5))
+		})
+	})
+	Context("with a validator", func() {
+		BeforeEach(func() {
+			writeFile("environment: staging\n")
+		})
+		It("reports its error", func() {
+			config.AddValidator(func(p *config.Params) error {
+				if p.Environment == "staging" {
+					return os.ErrInvalid
+				}
+				return nil
+			})
+
+			Expect(config.Parse()).To(MatchError(os.ErrInvalid.Error()))
+		})
+	})
+	Describe("reloading", func() {
+		var params *config.Params
+		var ignored []string
+
+		BeforeEach(func() {
+			writeFile(`
+log_level: info
+devices_bind: ":1883"
+idle_connection_timeout: 30s
+`)
+		})
+		JustBeforeEach(func() {
+			Expect(err).NotTo(HaveOccurred())
+			writeFile(`
+log_level: debug
+devices_bind: ":2883"
+idle_connection_timeout: 10s
+`)
+			params, ignored, err = config.Reload()
+		})
+		It("applies reloadable settings", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(params.LogLevel).To(Equal("debug"))
+			Expect(params.IdleConnectionTimeout).To(Equal(10 * time.Second))
+			Expect(config.Current()).To(Equal(params))
+		})
+		It("ignores settings that require a restart", func() {
+			Expect(params.DevicesBind).To(Equal(":1883"))
+			Expect(ignored).To(ConsistOf("SPIRE_DEVICES_BIND"))
+		})
+		It("leaves the startup config untouched", func() {
+			Expect(config.Config.LogLevel).To(Equal("info"))
+		})
+	})
+	Describe("reloading an invalid config", func() {
+		JustBeforeEach(func() {
+			Expect(err).NotTo(HaveOccurred())
+			writeFile("idle_connection_timeout: -1s\n")
+			_, _, err = config.Reload()
+		})
+		It("keeps the current settings", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(config.Current().IdleConnectionTimeout).To(Equal(30 * time.Second))
+		})
+	})
+})
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// sectionsKey is the key of the config file map that holds the config sections of message handlers
+const sectionsKey = "handlers"
+
+// Errors collects all problems found while loading the config
+type Errors []error
+
+func (e Errors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d config errors:\n\t%s", len(e), strings.Join(msgs, "\n\t"))
+}
+
+func readFile(path string) (map[string]interface{}, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config file: %v", err)
+	}
+
+	values := make(map[string]interface{})
+	if err := yaml.Unmarshal(buf, &values); err != nil {
+		return nil, fmt.Errorf("cannot parse config file %s: %v", path, err)
+	}
+	return values, nil
+}
+
+// splitSections removes the handler config sections from values and returns them by handler name
+func splitSections(values map[string]interface{}) (map[string]map[string]interface{}, Errors) {
+	secs := make(map[string]map[string]interface{})
+
+	raw, exists := values[sectionsKey]
+	if !exists {
+		return secs, nil
+	}
+	delete(values, sectionsKey)
+
+	handlers, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return secs, Errors{fmt.Errorf("config file: %s must be a map of handler names to config sections", sectionsKey)}
+	}
+
+	var errs Errors
+	for name, section := range handlers {
+		m, ok := section.(map[interface{}]interface{})
+		if !ok {
+			errs = append(errs, fmt.Errorf("config file: %s.%v must be a map", sectionsKey, name))
+			continue
+		}
+
+		secs[fmt.Sprint(name)] = make(map[string]interface{})
+		for k, v := range m {
+			secs[fmt.Sprint(name)][fmt.Sprint(k)] = v
+		}
+	}
+	return secs, errs
+}
+
+// populate sets the fields of the struct dst points to. For every field with an "env" tag, the value is
+// taken from the environment variable, the config file key given by the "yaml" tag or "envDefault", in this order.
+func populate(dst interface{}, values map[string]interface{}) Errors {
+	var errs Errors
+	known := make(map[string]bool)
+
+	v := reflect.ValueOf(dst).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+
+		name, required := parseEnvTag(field.Tag.Get("env"))
+		if len(name) == 0 {
+			continue
+		}
+
+		key := field.Tag.Get("yaml")
+		known[key] = true
+
+		raw, err := lookup(field, name, key, values)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			continue
+		}
+
+		if raw == nil {
+			if required {
+				errs = append(errs, fmt.Errorf("%s: required but not set", name))
+			}
+			continue
+		}
+
+		if err := setField(v.Field(i), *raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+
+	var unknown []string
+	for key := range values {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+
+	for _, key := range unknown {
+		errs = append(errs, fmt.Errorf("config file: unknown key %q", key))
+	}
+	return errs
+}
+
+// lookup returns the raw value for field or nil if it is not set
+func lookup(field reflect.StructField, name, key string, values map[string]interface{}) (*string, error) {
+	if s := os.Getenv(name); len(s) > 0 {
+		return &s, nil
+	}
+
+	if v, exists := values[key]; exists && len(key) > 0 {
+		s, err := fileValue(v)
+		if err != nil {
+			return nil, err
+		}
+		return &s, nil
+	}
+
+	if s, exists := field.Tag.Lookup("envDefault"); exists {
+		return &s, nil
+	}
+	return nil, nil
+}
+
+// fileValue converts a value from the config file to the string representation used in environment variables
+func fileValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := fileValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[interface{}]interface{}:
+		return "", fmt.Errorf("expected a scalar or a list, got a map")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+func setField(v reflect.Value, raw string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(raw, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// parseEnvTag returns the variable name and whether the "required" option is set
+func parseEnvTag(tag string) (string, bool) {
+	parts := strings.Split(tag, ",")
+	for _, opt := range parts[1:] {
+		if opt == "required" {
+			return parts[0], true
+		}
+	}
+	return parts[0], false
+}
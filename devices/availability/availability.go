@@ -0,0 +1,298 @@
+package availability
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/handlers"
+	"github.com/superscale/spire/mqtt"
+)
+
+const availabilityTopicPath = "availability"
+
+// windows over which availability is computed
+const (
+	day   = 24 * time.Hour
+	week  = 7 * day
+	month = 30 * day
+)
+
+// Interval is a downtime of a device
+type Interval struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// State holds the downtimes of a device within the last 30 days. Stored states are never modified.
+type State struct {
+	Since     time.Time  `json:"since"`      // first connect of the device
+	DownSince time.Time  `json:"down_since"` // start of the current downtime. zero while the device is connected
+	Downtime  []Interval `json:"downtime"`   // completed downtimes, oldest first
+}
+
+// Windows holds availability percentages over the last 24 hours, 7 days and 30 days.
+// Devices that are known for a shorter time are measured since their first connect.
+type Windows struct {
+	Day   float64 `json:"24h"`
+	Week  float64 `json:"7d"`
+	Month float64 `json:"30d"`
+}
+
+// Report is published on matriarch/<device>/availability
+type Report struct {
+	DeviceName   string  `json:"device_name"`
+	Up           bool    `json:"up"`
+	Availability Windows `json:"availability"`
+}
+
+// FormationReport is published on matriarch/formation/<formationID>/availability
+type FormationReport struct {
+	FormationID string   `json:"formation_id"`
+	Mean        Windows  `json:"mean"`
+	Worst       Windows  `json:"worst"`
+	Devices     []Report `json:"devices"`
+}
+
+// StateSlot holds the downtimes of a device
+var StateSlot = devices.NewDeviceSlot[*State]("availability", "availability").Persist(func() *State { return new(State) })
+
+// Handler ...
+type Handler struct {
+	broker     *mqtt.Broker
+	formations *devices.FormationMap
+	log        *logrus.Entry
+	router     *devices.Router
+}
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name:     "availability",
+		Register: handlers.Wrap(Register),
+	})
+}
+
+// Register ...
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, logger *logrus.Entry) interface{} {
+	h := &Handler{broker: broker, formations: formations, log: logger, router: devices.NewRouter("availability")}
+	h.restore()
+
+	devices.Route(h.router, devices.ConnectTopic.String(), h.onConnect)
+	devices.Route(h.router, devices.DisconnectTopic.String(), h.onDisconnect)
+	devices.Route(h.router, mqtt.SubscribeEventTopic, h.onSubscribeEvent)
+	h.router.Subscribe(broker, h)
+	return h
+}
+
+// HandleMessage implements mqtt.Subscriber
+func (h *Handler) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	return h.router.HandleMessage(ctx, topic, message)
+}
+
+// restore starts the downtime of devices that were connected when spire was stopped and have not
+// reconnected yet at the time their state was restored (see FormationMap.DisconnectAll), so that the
+// time spire was not running does not count as downtime.
+func (h *Handler) restore() {
+	for _, formationID := range h.formations.FormationIDs() {
+		h.formations.Update(formationID, func(tx *devices.Tx) error {
+			for _, deviceName := range tx.Devices() {
+				s, ok := StateSlot.Get(tx, deviceName)
+				lc, lok := devices.LifecycleSlot.Get(tx, deviceName)
+				if !ok || !lok || lc.Connected() || !s.DownSince.IsZero() {
+					continue
+				}
+
+				StateSlot.Put(tx, formationID, deviceName, &State{Since: s.Since, DownSince: lc.DisconnectedAt, Downtime: s.Downtime})
+			}
+			return nil
+		})
+	}
+}
+
+func (h *Handler) onConnect(ctx context.Context, _ devices.Topic, cm devices.ConnectMessage) error {
+	h.update(ctx, cm.FormationID, cm.DeviceName, func(s *State, now time.Time) *State {
+		if s == nil {
+			return &State{Since: now}
+		}
+
+		downtime := s.Downtime
+		if !s.DownSince.IsZero() {
+			downtime = append(downtime[:len(downtime):len(downtime)], Interval{From: s.DownSince, To: now})
+		}
+		return &State{Since: s.Since, Downtime: prune(downtime, now)}
+	})
+	return nil
+}
+
+func (h *Handler) onDisconnect(ctx context.Context, _ devices.Topic, dm devices.DisconnectMessage) error {
+	h.update(ctx, dm.FormationID, dm.DeviceName, func(s *State, now time.Time) *State {
+		if s == nil {
+			return &State{Since: now, DownSince: now}
+		}
+		if !s.DownSince.IsZero() {
+			return s
+		}
+		return &State{Since: s.Since, DownSince: now, Downtime: prune(s.Downtime, now)}
+	})
+	return nil
+}
+
+func (h *Handler) onSubscribeEvent(ctx context.Context, _ devices.Topic, sm mqtt.SubscribeMessage) error {
+	for _, topic := range sm.Topics {
+		t := devices.ParseTopic(topic)
+		if t.Prefix != "matriarch" || t.DeviceName == "+" {
+			continue
+		}
+
+		if t.DeviceName == "formation" {
+			formationID, path, _ := strings.Cut(t.Path, "/")
+			if formationID != "+" && formationID != "#" && len(formationID) > 0 && (path == availabilityTopicPath || path == "#") {
+				h.broker.Publish(ctx, formationTopic(formationID), FormationAvailability(h.formations, formationID, time.Now().UTC()))
+			}
+		} else if t.Path == availabilityTopicPath || t.Path == "#" {
+			if r, ok := DeviceAvailability(h.formations, t.DeviceName, time.Now().UTC()); ok {
+				h.broker.Publish(ctx, deviceTopic(t.DeviceName), r)
+			}
+		}
+	}
+	return nil
+}
+
+// update stores the state returned by fn and publishes the availability of the device and its formation
+func (h *Handler) update(ctx context.Context, formationID, deviceName string, fn func(s *State, now time.Time) *State) {
+	now := time.Now().UTC()
+
+	var r *Report
+	h.formations.Update(formationID, func(tx *devices.Tx) error {
+		s, _ := StateSlot.Get(tx, deviceName)
+		s = fn(s, now)
+		StateSlot.Put(tx, formationID, deviceName, s)
+
+		r = report(deviceName, s, now)
+		return nil
+	})
+
+	h.broker.Publish(ctx, deviceTopic(deviceName), r)
+	h.broker.Publish(ctx, formationTopic(formationID), FormationAvailability(h.formations, formationID, now))
+}
+
+// DeviceAvailability returns the availability of deviceName at now. ok is false if there is no state for the device.
+func DeviceAvailability(formations *devices.FormationMap, deviceName string, now time.Time) (r *Report, ok bool) {
+	formations.ViewDevice(deviceName, func(tx *devices.Tx) error {
+		var s *State
+		if s, ok = StateSlot.Get(tx, deviceName); ok {
+			r = report(deviceName, s, now)
+		}
+		return nil
+	})
+	return
+}
+
+// FormationAvailability returns the mean and worst availability of the devices of formationID at now
+func FormationAvailability(formations *devices.FormationMap, formationID string, now time.Time) *FormationReport {
+	fr := &FormationReport{FormationID: formationID, Devices: []Report{}}
+
+	formations.View(formationID, func(tx *devices.Tx) error {
+		for _, deviceName := range tx.Devices() {
+			if s, ok := StateSlot.Get(tx, deviceName); ok {
+				fr.Devices = append(fr.Devices, *report(deviceName, s, now))
+			}
+		}
+		return nil
+	})
+
+	if len(fr.Devices) == 0 {
+		return fr
+	}
+
+	fr.Worst = Windows{100, 100, 100}
+	for _, r := range fr.Devices {
+		a := r.Availability
+		fr.Mean.Day += a.Day / float64(len(fr.Devices))
+		fr.Mean.Week += a.Week / float64(len(fr.Devices))
+		fr.Mean.Month += a.Month / float64(len(fr.Devices))
+
+		fr.Worst = Windows{min(fr.Worst.Day, a.Day), min(fr.Worst.Week, a.Week), min(fr.Worst.Month, a.Month)}
+	}
+
+	fr.Mean = Windows{devices.Round(fr.Mean.Day, 3), devices.Round(fr.Mean.Week, 3), devices.Round(fr.Mean.Month, 3)}
+	return fr
+}
+
+func report(deviceName string, s *State, now time.Time) *Report {
+	return &Report{
+		DeviceName: deviceName,
+		Up:         s.DownSince.IsZero(),
+		Availability: Windows{
+			Day:   s.availability(day, now),
+			Week:  s.availability(week, now),
+			Month: s.availability(month, now),
+		},
+	}
+}
+
+// availability returns the percentage of time within window before now that the device was connected
+func (s *State) availability(window time.Duration, now time.Time) float64 {
+	start := now.Add(-window)
+	if s.Since.After(start) {
+		start = s.Since
+	}
+
+	total := now.Sub(start)
+	if total <= 0 {
+		return 100
+	}
+
+	var down time.Duration
+	for _, i := range s.Downtime {
+		down += overlap(i.From, i.To, start, now)
+	}
+	if !s.DownSince.IsZero() {
+		down += overlap(s.DownSince, now, start, now)
+	}
+
+	return devices.Round(100*(1-float64(down)/float64(total)), 3)
+}
+
+// overlap returns the duration of [from, to] that lies within [start, end]
+func overlap(from, to, start, end time.Time) time.Duration {
+	if from.Before(start) {
+		from = start
+	}
+	if to.After(end) {
+		to = end
+	}
+	if to.Before(from) {
+		return 0
+	}
+	return to.Sub(from)
+}
+
+// prune returns the downtimes that end within the last 30 days before now
+func prune(downtime []Interval, now time.Time) []Interval {
+	start := now.Add(-month)
+	for i, d := range downtime {
+		if d.To.After(start) {
+			return downtime[i:]
+		}
+	}
+	return nil
+}
+
+func min(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func deviceTopic(deviceName string) string {
+	return fmt.Sprintf("matriarch/%s/%s", deviceName, availabilityTopicPath)
+}
+
+func formationTopic(formationID string) string {
+	return fmt.Sprintf("matriarch/formation/%s/%s", formationID, availabilityTopicPath)
+}
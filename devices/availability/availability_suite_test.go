@@ -0,0 +1,14 @@
+package availability_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// TestAvailability ...
+func TestAvailability(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Spire Availability Suite")
+}
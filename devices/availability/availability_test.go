@@ -0,0 +1,141 @@
+package availability_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/availability"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("Availability", func() {
+
+	var broker *mqtt.Broker
+	var formations *devices.FormationMap
+
+	var formationID = "00000000-0000-0000-0000-000000000001"
+	var deviceName = "1.marsara"
+	var now = time.Date(2018, 3, 31, 12, 0, 0, 0, time.UTC)
+
+	putState := func(deviceName string, s *availability.State) {
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			availability.StateSlot.Put(tx, formationID, deviceName, s)
+			return nil
+		})
+	}
+
+	BeforeEach(func() {
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
+		formations = devices.NewFormationMap()
+	})
+	Describe("computation", func() {
+		It("measures devices since their first connect", func() {
+			putState(deviceName, &availability.State{
+				Since:    now.Add(-48 * time.Hour),
+				Downtime: []availability.Interval{{From: now.Add(-30 * time.Hour), To: now.Add(-18 * time.Hour)}},
+			})
+
+			r, ok := availability.DeviceAvailability(formations, deviceName, now)
+			Expect(ok).To(BeTrue())
+			Expect(r.Up).To(BeTrue())
+			Expect(r.Availability).To(Equal(availability.Windows{Day: 75, Week: 75, Month: 75}))
+		})
+		It("counts the current downtime", func() {
+			putState(deviceName, &availability.State{
+				Since:     now.Add(-40 * 24 * time.Hour),
+				DownSince: now.Add(-6 * time.Hour),
+			})
+
+			r, _ := availability.DeviceAvailability(formations, deviceName, now)
+			Expect(r.Up).To(BeFalse())
+			Expect(r.Availability.Day).To(Equal(75.0))
+			Expect(r.Availability.Month).To(BeNumerically("~", 99.167, 0.001))
+		})
+		It("computes the mean and worst case of a formation", func() {
+			putState(deviceName, &availability.State{Since: now.Add(-24 * time.Hour)})
+			putState("2.marsara", &availability.State{Since: now.Add(-24 * time.Hour), DownSince: now.Add(-12 * time.Hour)})
+
+			fr := availability.FormationAvailability(formations, formationID, now)
+			Expect(fr.Devices).To(HaveLen(2))
+			Expect(fr.Mean.Day).To(Equal(75.0))
+			Expect(fr.Worst.Day).To(Equal(50.0))
+		})
+		It("does not report unknown devices", func() {
+			_, ok := availability.DeviceAvailability(formations, deviceName, now)
+			Expect(ok).To(BeFalse())
+		})
+	})
+	Describe("handler", func() {
+		var recorder, formationRecorder *testutils.PubSubRecorder
+
+		getState := func() *availability.State {
+			var s *availability.State
+			formations.View(formationID, func(tx *devices.Tx) error {
+				s, _ = availability.StateSlot.Get(tx, deviceName)
+				return nil
+			})
+			return s
+		}
+
+		BeforeEach(func() {
+			recorder = testutils.NewPubSubRecorder()
+			formationRecorder = testutils.NewPubSubRecorder()
+			broker.Subscribe("matriarch/"+deviceName+"/availability", recorder)
+			broker.Subscribe("matriarch/formation/"+formationID+"/availability", formationRecorder)
+		})
+		JustBeforeEach(func() {
+			availability.Register(broker, formations, logging.New("test"))
+		})
+		It("records downtimes from disconnect to connect", func() {
+			broker.Publish(context.Background(), devices.ConnectTopic.String(), devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName})
+			broker.Publish(context.Background(), devices.DisconnectTopic.String(), devices.DisconnectMessage{FormationID: formationID, DeviceName: deviceName})
+			Expect(getState().DownSince).NotTo(BeZero())
+
+			broker.Publish(context.Background(), devices.ConnectTopic.String(), devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName})
+			s := getState()
+			Expect(s.DownSince).To(BeZero())
+			Expect(s.Downtime).To(HaveLen(1))
+		})
+		It("publishes the availability of the device and formation", func() {
+			broker.Publish(context.Background(), devices.ConnectTopic.String(), devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName})
+
+			Expect(recorder.Count()).To(Equal(1))
+			_, raw := recorder.First()
+			Expect(raw.(*availability.Report).Up).To(BeTrue())
+
+			Expect(formationRecorder.Count()).To(Equal(1))
+			_, raw = formationRecorder.First()
+			Expect(raw.(*availability.FormationReport).Devices).To(HaveLen(1))
+		})
+		It("publishes the availability on subscribe", func() {
+			putState(deviceName, &availability.State{Since: now})
+			broker.Publish(context.Background(), mqtt.SubscribeEventTopic, mqtt.SubscribeMessage{Topics: []string{
+				"matriarch/" + deviceName + "/#",
+				"matriarch/formation/" + formationID + "/availability",
+			}})
+
+			Expect(recorder.Count()).To(Equal(1))
+			Expect(formationRecorder.Count()).To(Equal(1))
+		})
+		Describe("after a restart", func() {
+			var restartedAt = now.Add(-time.Hour)
+
+			BeforeEach(func() {
+				putState(deviceName, &availability.State{Since: now.Add(-24 * time.Hour)})
+				formations.Update(formationID, func(tx *devices.Tx) error {
+					devices.LifecycleSlot.Put(tx, formationID, deviceName, &devices.Lifecycle{ConnectedAt: now.Add(-24 * time.Hour)})
+					return nil
+				})
+				formations.DisconnectAll(restartedAt)
+			})
+			It("starts the downtime of devices that have not reconnected at the restart", func() {
+				Expect(getState().DownSince).To(Equal(restartedAt))
+			})
+		})
+	})
+})
@@ -0,0 +1,105 @@
+package broadcast
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/deviceInfo"
+	"github.com/superscale/spire/devices/handlers"
+	"github.com/superscale/spire/mqtt"
+)
+
+// Message is published by control clients on armada/formation/<formationID>/<path>. Payload is
+// published on armada/<device>/<path> for every connected device of the formation that matches Filter.
+type Message struct {
+	Payload json.RawMessage   `json:"payload"`
+	Filter  map[string]string `json:"filter,omitempty"` // device info fields, e.g. {"device_os": "2.1.0"}
+}
+
+// Result is published on matriarch/formation/<formationID>/broadcast/<path> after a broadcast
+type Result struct {
+	Path      string   `json:"path"`
+	Delivered []string `json:"delivered"`
+	Offline   []string `json:"offline"`
+	Filtered  []string `json:"filtered"` // connected devices that do not match the filter
+}
+
+// Handler ...
+type Handler struct {
+	broker     *mqtt.Broker
+	formations *devices.FormationMap
+	log        *logrus.Entry
+	router     *devices.Router
+}
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name:      "broadcast",
+		Register:  handlers.Wrap(Register),
+		DependsOn: []string{"deviceInfo"},
+	})
+}
+
+// Register ...
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, logger *logrus.Entry) interface{} {
+	h := &Handler{broker: broker, formations: formations, log: logger, router: devices.NewRouter("broadcast")}
+
+	devices.Route(h.router, "armada/formation/#", h.onBroadcast)
+	h.router.Subscribe(broker, h)
+	return h
+}
+
+// HandleMessage implements mqtt.Subscriber
+func (h *Handler) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	return h.router.HandleMessage(ctx, topic, message)
+}
+
+func (h *Handler) onBroadcast(ctx context.Context, t devices.Topic, msg *Message) error {
+	// t.DeviceName is "formation" and t.Path is "<formationID>/<path>"
+	formationID, path, ok := strings.Cut(t.Path, "/")
+	if !ok || len(formationID) == 0 || len(path) == 0 {
+		return fmt.Errorf("[broadcast] invalid topic %s", t)
+	}
+
+	res := &Result{Path: path, Delivered: []string{}, Offline: []string{}, Filtered: []string{}}
+
+	h.formations.View(formationID, func(tx *devices.Tx) error {
+		for _, deviceName := range tx.Devices() {
+			if lc, ok := devices.LifecycleSlot.Get(tx, deviceName); !ok || !lc.Connected() {
+				res.Offline = append(res.Offline, deviceName)
+				continue
+			}
+
+			info, _ := deviceInfo.Slot.Get(tx, deviceName)
+			if !matches(info, msg.Filter) {
+				res.Filtered = append(res.Filtered, deviceName)
+				continue
+			}
+
+			res.Delivered = append(res.Delivered, deviceName)
+		}
+		return nil
+	})
+
+	for _, deviceName := range res.Delivered {
+		h.broker.Publish(ctx, fmt.Sprintf("armada/%s/%s", deviceName, path), []byte(msg.Payload))
+	}
+
+	h.broker.Publish(ctx, fmt.Sprintf("matriarch/formation/%s/broadcast/%s", formationID, path), res)
+	return nil
+}
+
+// matches returns true if all filter fields equal the device info fields
+func matches(info map[string]interface{}, filter map[string]string) bool {
+	for k, v := range filter {
+		value, exists := info[k]
+		if !exists || fmt.Sprint(value) != v {
+			return false
+		}
+	}
+	return true
+}
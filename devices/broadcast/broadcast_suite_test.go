@@ -0,0 +1,14 @@
+package broadcast_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// TestBroadcast ...
+func TestBroadcast(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Spire Broadcast Suite")
+}
@@ -0,0 +1,96 @@
+package broadcast_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/broadcast"
+	"github.com/superscale/spire/devices/deviceInfo"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("Broadcast Handler", func() {
+
+	var broker *mqtt.Broker
+	var formations *devices.FormationMap
+	var deviceRecorder, resultRecorder *testutils.PubSubRecorder
+
+	var formationID = "00000000-0000-0000-0000-000000000001"
+	var broadcastTopic = "armada/formation/" + formationID + "/ota/cancel"
+
+	addDevice := func(formationID, deviceName, os string, connected bool) {
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			lc := &devices.Lifecycle{ConnectedAt: time.Now()}
+			if !connected {
+				lc.DisconnectedAt = time.Now()
+			}
+			devices.LifecycleSlot.Put(tx, formationID, deviceName, lc)
+			deviceInfo.Slot.Put(tx, formationID, deviceName, map[string]interface{}{"device_os": os})
+			return nil
+		})
+	}
+	result := func() *broadcast.Result {
+		Expect(resultRecorder.Count()).To(Equal(1))
+		_, raw := resultRecorder.First()
+		return raw.(*broadcast.Result)
+	}
+
+	BeforeEach(func() {
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
+		formations = devices.NewFormationMap()
+		deviceRecorder = testutils.NewPubSubRecorder()
+		resultRecorder = testutils.NewPubSubRecorder()
+
+		broker.Subscribe("armada/+/ota/cancel", deviceRecorder)
+		broker.Subscribe("matriarch/formation/"+formationID+"/broadcast/ota/cancel", resultRecorder)
+		broadcast.Register(broker, formations, logging.New("test"))
+
+		addDevice(formationID, "1.marsara", "2.1.0", true)
+		addDevice(formationID, "2.marsara", "2.0.0", true)
+		addDevice(formationID, "3.marsara", "2.1.0", false)
+		addDevice("00000000-0000-0000-0000-000000000002", "4.marsara", "2.1.0", true)
+	})
+	It("publishes the payload for all connected devices of the formation", func() {
+		broker.Publish(context.Background(), broadcastTopic, []byte(`{"payload": {"reason": "maintenance"}}`))
+
+		Expect(deviceRecorder.Count()).To(Equal(2))
+		topic, raw := deviceRecorder.First()
+		Expect(topic).To(Equal("armada/1.marsara/ota/cancel"))
+		Expect(raw).To(MatchJSON(`{"reason": "maintenance"}`))
+
+		res := result()
+		Expect(res.Path).To(Equal("ota/cancel"))
+		Expect(res.Delivered).To(Equal([]string{"1.marsara", "2.marsara"}))
+		Expect(res.Offline).To(Equal([]string{"3.marsara"}))
+		Expect(res.Filtered).To(BeEmpty())
+	})
+	It("filters devices by device info", func() {
+		broker.Publish(context.Background(), broadcastTopic, []byte(`{"payload": {}, "filter": {"device_os": "2.1.0"}}`))
+
+		Expect(deviceRecorder.Count()).To(Equal(1))
+		res := result()
+		Expect(res.Delivered).To(Equal([]string{"1.marsara"}))
+		Expect(res.Filtered).To(Equal([]string{"2.marsara"}))
+	})
+	It("does not publish results on the formation topics of other handlers", func() {
+		summaryRecorder := testutils.NewPubSubRecorder()
+		broker.Subscribe("matriarch/formation/"+formationID+"/summary", summaryRecorder)
+
+		broker.Publish(context.Background(), "armada/formation/"+formationID+"/summary", []byte(`{"payload": {}}`))
+		Expect(summaryRecorder.Count()).To(Equal(0))
+	})
+	It("publishes an empty result for unknown formations", func() {
+		resultRecorder = testutils.NewPubSubRecorder()
+		broker.Subscribe("matriarch/formation/unknown/broadcast/ota/cancel", resultRecorder)
+
+		broker.Publish(context.Background(), "armada/formation/unknown/ota/cancel", []byte(`{"payload": {}}`))
+
+		Expect(deviceRecorder.Count()).To(Equal(0))
+		Expect(result().Delivered).To(BeEmpty())
+	})
+})
@@ -0,0 +1,262 @@
+package commands
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/handlers"
+	"github.com/superscale/spire/mqtt"
+)
+
+// DefaultTTL is used by handlers for commands whose sender did not specify a TTL
+const DefaultTTL = 24 * time.Hour
+
+// statusTopicPath is the path of status messages, i.e. matriarch/<device>/commands
+const statusTopicPath = "commands"
+
+// command statuses
+const (
+	Queued    = "queued"
+	Delivered = "delivered"
+	Expired   = "expired"
+	Cancelled = "cancelled"
+	// Dropped means that the command was removed from a full queue to make room for a newer one
+	Dropped = "dropped"
+)
+
+// Config ...
+type Config struct {
+	MaxQueued int `env:"SPIRE_COMMANDS_MAX_QUEUED"  envDefault:"16"  yaml:"max_queued"` // per device
+}
+
+// DefaultConfig ...
+func DefaultConfig() *Config {
+	return &Config{MaxQueued: 16}
+}
+
+// Command is a message for a device that is queued while the device is offline
+type Command struct {
+	ID        string      `json:"id"`
+	Topic     string      `json:"topic"`
+	Payload   interface{} `json:"-"`
+	QueuedAt  time.Time   `json:"queued_at"`
+	ExpiresAt time.Time   `json:"expires_at"`
+
+	timer *time.Timer // expires the command. stopped when it leaves the queue
+}
+
+// StatusMessage is published on matriarch/<device>/commands when a command is queued, delivered, expired or cancelled
+type StatusMessage struct {
+	ID        string    `json:"id"`
+	Topic     string    `json:"topic"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Slot holds the queued commands of a device, oldest first. Stored queues are never modified.
+// Queues are not persisted, since payloads may not be JSON encodable, and are limited to Config.MaxQueued commands.
+var Slot = devices.NewDeviceSlot[[]*Command]("commands", "commands")
+
+// Handler delivers queued commands when devices connect
+type Handler struct {
+	broker     *mqtt.Broker
+	formations *devices.FormationMap
+	log        *logrus.Entry
+	router     *devices.Router
+
+	l         sync.Mutex
+	maxQueued int // guarded by l
+}
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name: "commands",
+		Register: func(deps handlers.Deps) (interface{}, error) {
+			h := Register(deps.Broker, deps.Formations, deps.Logger).(*Handler)
+			return h, h.Reconfigure(deps.Config)
+		},
+		Config: func() interface{} { return new(Config) },
+	})
+}
+
+// Register ...
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, logger *logrus.Entry) interface{} {
+	h := &Handler{
+		broker:     broker,
+		formations: formations,
+		log:        logger,
+		router:     devices.NewRouter("commands"),
+		maxQueued:  DefaultConfig().MaxQueued,
+	}
+
+	devices.Route(h.router, devices.ConnectTopic.String(), h.onConnect)
+	h.router.Subscribe(broker, h)
+	return h
+}
+
+// Reconfigure applies a new queue limit. It implements handlers.Reconfigurer.
+// Queues that are longer are not truncated until the next command is queued.
+func (h *Handler) Reconfigure(section interface{}) error {
+	cfg, ok := section.(*Config)
+	if !ok {
+		return fmt.Errorf("expected *commands.Config, got %T", section)
+	}
+
+	if cfg.MaxQueued <= 0 {
+		return fmt.Errorf("max_queued must be positive")
+	}
+
+	h.l.Lock()
+	h.maxQueued = cfg.MaxQueued
+	h.l.Unlock()
+	return nil
+}
+
+// HandleMessage implements mqtt.Subscriber
+func (h *Handler) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	return h.router.HandleMessage(ctx, topic, message)
+}
+
+func (h *Handler) onConnect(ctx context.Context, _ devices.Topic, cm devices.ConnectMessage) error {
+	var queue []*Command
+	h.formations.Update(cm.FormationID, func(tx *devices.Tx) error {
+		queue, _ = Slot.Get(tx, cm.DeviceName)
+		if len(queue) > 0 {
+			Slot.Delete(tx, cm.FormationID, cm.DeviceName)
+		}
+		return nil
+	})
+
+	now := time.Now()
+	for _, c := range queue {
+		c.timer.Stop()
+
+		if now.After(c.ExpiresAt) {
+			publishStatus(ctx, h.broker, cm.DeviceName, c, Expired)
+			continue
+		}
+
+		h.broker.Publish(ctx, c.Topic, c.Payload)
+		publishStatus(ctx, h.broker, cm.DeviceName, c, Delivered)
+	}
+	return nil
+}
+
+// Send publishes payload on topic if deviceName is connected. Otherwise the command is queued until the
+// device connects, or until ttl has passed. The oldest commands are dropped from full queues.
+// It returns an error for unknown devices.
+func (h *Handler) Send(ctx context.Context, deviceName, topic string, payload interface{}, ttl time.Duration) (delivered bool, err error) {
+	now := time.Now()
+	c := &Command{ID: newID(), Topic: topic, Payload: payload, QueuedAt: now, ExpiresAt: now.Add(ttl)}
+
+	h.l.Lock()
+	limit := h.maxQueued
+	h.l.Unlock()
+
+	var dropped []*Command
+	err = h.formations.UpdateDevice(deviceName, func(tx *devices.Tx) error {
+		if len(tx.Formation()) == 0 {
+			return fmt.Errorf("[commands] cannot send %s to unknown device %s", topic, deviceName)
+		}
+
+		if lc, ok := devices.LifecycleSlot.Get(tx, deviceName); ok && lc.Connected() {
+			delivered = true
+			return nil
+		}
+
+		queue, _ := Slot.Get(tx, deviceName)
+		if n := len(queue) + 1 - limit; n > 0 {
+			dropped, queue = queue[:n], queue[n:]
+		}
+		Slot.Put(tx, tx.Formation(), deviceName, append(queue[:len(queue):len(queue)], c))
+
+		// expire waits for this transaction
+		c.timer = time.AfterFunc(ttl, func() { h.expire(deviceName, c.ID) })
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if delivered {
+		h.broker.Publish(ctx, topic, payload)
+		publishStatus(ctx, h.broker, deviceName, c, Delivered)
+		return true, nil
+	}
+
+	for _, d := range dropped {
+		d.timer.Stop()
+		publishStatus(ctx, h.broker, deviceName, d, Dropped)
+	}
+	publishStatus(ctx, h.broker, deviceName, c, Queued)
+	return false, nil
+}
+
+// Cancel removes the queued commands for topic. It returns the number of removed commands.
+func (h *Handler) Cancel(ctx context.Context, deviceName, topic string) int {
+	removed := h.remove(deviceName, func(c *Command) bool { return c.Topic == topic })
+
+	for _, c := range removed {
+		c.timer.Stop()
+		publishStatus(ctx, h.broker, deviceName, c, Cancelled)
+	}
+	return len(removed)
+}
+
+// expire removes a command whose TTL has passed, unless it was delivered already
+func (h *Handler) expire(deviceName, id string) {
+	removed := h.remove(deviceName, func(c *Command) bool { return c.ID == id })
+
+	for _, c := range removed {
+		publishStatus(context.Background(), h.broker, deviceName, c, Expired)
+	}
+}
+
+// remove removes the queued commands of deviceName that match and returns them
+func (h *Handler) remove(deviceName string, match func(*Command) bool) (removed []*Command) {
+	h.formations.UpdateDevice(deviceName, func(tx *devices.Tx) error {
+		queue, ok := Slot.Get(tx, deviceName)
+		if !ok {
+			return nil
+		}
+
+		var remaining []*Command
+		for _, c := range queue {
+			if match(c) {
+				removed = append(removed, c)
+			} else {
+				remaining = append(remaining, c)
+			}
+		}
+
+		if len(removed) == 0 {
+			return nil
+		}
+		if len(remaining) == 0 {
+			Slot.Delete(tx, tx.Formation(), deviceName)
+		} else {
+			Slot.Put(tx, tx.Formation(), deviceName, remaining)
+		}
+		return nil
+	})
+	return
+}
+
+func publishStatus(ctx context.Context, broker *mqtt.Broker, deviceName string, c *Command, status string) {
+	msg := &StatusMessage{ID: c.ID, Topic: c.Topic, Status: status, ExpiresAt: c.ExpiresAt}
+	broker.Publish(ctx, fmt.Sprintf("matriarch/%s/%s", deviceName, statusTopicPath), msg)
+}
+
+func newID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
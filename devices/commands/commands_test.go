@@ -0,0 +1,124 @@
+package commands_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/commands"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("Command Queue", func() {
+
+	var broker *mqtt.Broker
+	var formations *devices.FormationMap
+	var deviceRecorder, statusRecorder *testutils.PubSubRecorder
+	var handler *commands.Handler
+
+	var formationID = "00000000-0000-0000-0000-000000000001"
+	var deviceName = "1.marsara"
+	var topic = "pylon/" + deviceName + "/reboot"
+
+	send := func(ttl time.Duration) (bool, error) {
+		return handler.Send(context.Background(), deviceName, topic, []byte("{}"), ttl)
+	}
+	lastStatus := func() string {
+		_, raw := statusRecorder.Last()
+		return raw.(*commands.StatusMessage).Status
+	}
+	connect := func() {
+		broker.Publish(context.Background(), devices.ConnectTopic.String(), devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName})
+	}
+
+	BeforeEach(func() {
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
+		formations = devices.NewFormationMap()
+		deviceRecorder = testutils.NewPubSubRecorder()
+		statusRecorder = testutils.NewPubSubRecorder()
+
+		broker.Subscribe(topic, deviceRecorder)
+		broker.Subscribe("matriarch/"+deviceName+"/commands", statusRecorder)
+		handler = commands.Register(broker, formations, logging.New("test")).(*commands.Handler)
+
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			tx.AddDevice(deviceName)
+			return nil
+		})
+	})
+	It("rejects commands for unknown devices", func() {
+		_, err := handler.Send(context.Background(), "2.marsara", "pylon/2.marsara/reboot", nil, time.Minute)
+		Expect(err).To(HaveOccurred())
+	})
+	It("delivers commands to connected devices", func() {
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			devices.LifecycleSlot.Put(tx, formationID, deviceName, &devices.Lifecycle{ConnectedAt: time.Now()})
+			return nil
+		})
+
+		delivered, err := send(time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(delivered).To(BeTrue())
+		Expect(deviceRecorder.Count()).To(Equal(1))
+		Expect(lastStatus()).To(Equal(commands.Delivered))
+	})
+	Describe("with a disconnected device", func() {
+		BeforeEach(func() {
+			delivered, err := send(time.Minute)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(delivered).To(BeFalse())
+		})
+		It("queues commands", func() {
+			Expect(deviceRecorder.Count()).To(Equal(0))
+			Expect(lastStatus()).To(Equal(commands.Queued))
+		})
+		It("delivers queued commands on connect", func() {
+			send(time.Minute)
+			connect()
+
+			Expect(deviceRecorder.Count()).To(Equal(2))
+			Expect(lastStatus()).To(Equal(commands.Delivered))
+
+			connect()
+			Expect(deviceRecorder.Count()).To(Equal(2))
+		})
+		It("expires commands", func() {
+			send(10 * time.Millisecond)
+			Eventually(lastStatus).Should(Equal(commands.Expired))
+
+			connect()
+			Expect(deviceRecorder.Count()).To(Equal(1))
+		})
+		It("drops the oldest commands from full queues", func() {
+			Expect(handler.Reconfigure(&commands.Config{MaxQueued: 2})).To(Succeed())
+
+			_, raw := statusRecorder.First()
+			oldest := raw.(*commands.StatusMessage).ID
+
+			send(time.Minute)
+			send(time.Minute)
+
+			_, raw = statusRecorder.Get(statusRecorder.Count() - 2)
+			Expect(raw.(*commands.StatusMessage).ID).To(Equal(oldest))
+			Expect(raw.(*commands.StatusMessage).Status).To(Equal(commands.Dropped))
+			Expect(lastStatus()).To(Equal(commands.Queued))
+
+			connect()
+			Expect(deviceRecorder.Count()).To(Equal(2))
+		})
+		It("rejects queue limits that are not positive", func() {
+			Expect(handler.Reconfigure(&commands.Config{})).To(MatchError("max_queued must be positive"))
+		})
+		It("cancels queued commands", func() {
+			Expect(handler.Cancel(context.Background(), deviceName, topic)).To(Equal(1))
+			Expect(lastStatus()).To(Equal(commands.Cancelled))
+
+			connect()
+			Expect(deviceRecorder.Count()).To(Equal(0))
+		})
+	})
+})
@@ -1,33 +1,52 @@
 package deviceInfo
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/sirupsen/logrus"
 	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/handlers"
 	"github.com/superscale/spire/mqtt"
 )
 
+// Slot holds the device info of a device that other handlers use, e.g. "device_os"
+var Slot = devices.NewDeviceSlot[map[string]interface{}]("deviceInfo", "device_info")
+
 // Handler ...
 type Handler struct {
 	formations *devices.FormationMap
+	log        *logrus.Entry
+	router     *devices.Router
+}
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name:     "deviceInfo",
+		Register: handlers.Wrap(Register),
+	})
 }
 
 // Register ...
-func Register(broker *mqtt.Broker, formations *devices.FormationMap) interface{} {
-	h := &Handler{formations: formations}
-	broker.Subscribe(devices.ConnectTopic.String(), h)
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, logger *logrus.Entry) interface{} {
+	h := &Handler{formations: formations, log: logger, router: devices.NewRouter("deviceInfo")}
+	devices.Route(h.router, devices.ConnectTopic.String(), h.onConnect)
+	h.router.Subscribe(broker, h)
 	return h
 }
 
 // HandleMessage ...
-func (h *Handler) HandleMessage(_ string, message interface{}) error {
-	h.formations.Lock()
-	defer h.formations.Unlock()
+func (h *Handler) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	return h.router.HandleMessage(ctx, topic, message)
+}
 
-	cm := message.(devices.ConnectMessage)
+func (h *Handler) onConnect(_ context.Context, _ devices.Topic, cm devices.ConnectMessage) error {
 	state := map[string]interface{}{"device_os": getDeviceOS(cm.DeviceInfo)}
-	h.formations.PutDeviceState(cm.FormationID, cm.DeviceName, "device_info", state)
-	return nil
+
+	return h.formations.Update(cm.FormationID, func(tx *devices.Tx) error {
+		Slot.Put(tx, cm.FormationID, cm.DeviceName, state)
+		return nil
+	})
 }
 
 func getDeviceOS(info map[string]interface{}) (res string) {
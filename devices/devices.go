@@ -1,17 +1,23 @@
 package devices
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math"
-	"net/http"
+	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
-	"github.com/superscale/spire/config"
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/metrics"
 	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/tracing"
 )
 
 // ConnectTopic ...
@@ -25,26 +31,62 @@ type ConnectMessage struct {
 	FormationID string `json:"formation_id"`
 	DeviceName  string
 	DeviceInfo  map[string]interface{}
-	IPAddress   string `json:"ip_address"`
+	// DeviceInfoStale is set if the device registry was unavailable and DeviceInfo was taken from a cache
+	DeviceInfoStale bool   `json:"device_info_stale"`
+	IPAddress       string `json:"ip_address"`
+	// Takeover is set if the device was still connected on another session, which was closed
+	Takeover bool `json:"takeover,omitempty"`
 }
 
 // DisconnectMessage ...
 type DisconnectMessage struct {
 	FormationID string
 	DeviceName  string
+	Reason      string `json:"reason"`
+}
+
+// disconnect reasons. Sessions that are taken over by a new connection of the device are not reported
+// with a DisconnectMessage, see ConnectMessage.Takeover.
+const (
+	// DisconnectEOF means that the device closed the connection without sending DISCONNECT
+	DisconnectEOF = "eof"
+	// DisconnectTimeout means that the device did not send anything within the idle timeout
+	DisconnectTimeout = "timeout"
+	// DisconnectError means that reading from the connection failed
+	DisconnectError = "error"
+	// DisconnectClean means that the device sent DISCONNECT
+	DisconnectClean = "disconnect"
+	// DisconnectTakeover is used for sessions that were closed because the device connected again
+	DisconnectTakeover = "takeover"
+)
+
+// DeviceRegistry provides the device info that is passed on in ConnectMessage.
+// Devices that are not known to the registry are rejected.
+type DeviceRegistry interface {
+	// DeviceInfo returns the device info for deviceName. stale is set if the registry
+	// could not be reached and the device info was taken from a cache.
+	DeviceInfo(ctx context.Context, deviceName string) (info map[string]interface{}, stale bool, err error)
 }
 
 // Handler ...
 type Handler struct {
 	formations *FormationMap
 	broker     *mqtt.Broker
+	registry   DeviceRegistry
+	log        *logrus.Entry
+
+	sl       sync.Mutex
+	sessions map[string]*mqtt.Session // device name -> current session
 }
 
 // NewHandler ...
-func NewHandler(formations *FormationMap, broker *mqtt.Broker) *Handler {
+func NewHandler(formations *FormationMap, broker *mqtt.Broker, registry DeviceRegistry, logger *logrus.Entry) *Handler {
 	return &Handler{
 		formations: formations,
 		broker:     broker,
+		registry:   registry,
+		log:        logger,
+		sessions:   make(map[string]*mqtt.Session),
 	}
 }
 
@@ -70,6 +112,7 @@ func (t Topic) String() string {
 }
 
 // ParseTopic ...
+// Missing parts of short topics are left empty.
 func ParseTopic(topic string) Topic {
 	if strings.HasPrefix(topic, "/") {
 		topic = topic[1:]
@@ -77,33 +120,51 @@ func ParseTopic(topic string) Topic {
 
 	if strings.HasPrefix(topic, mqtt.InternalTopicPrefix) {
 		parts := strings.SplitN(topic, "/", 2)
-		return Topic{parts[0], "", parts[1]}
+		t := Topic{Prefix: parts[0]}
+		if len(parts) > 1 {
+			t.Path = parts[1]
+		}
+		return t
 	}
 
 	parts := strings.SplitN(topic, "/", 3)
-	return Topic{parts[0], parts[1], parts[2]}
+	t := Topic{Prefix: parts[0]}
+	if len(parts) > 1 {
+		t.DeviceName = parts[1]
+	}
+	if len(parts) > 2 {
+		t.Path = parts[2]
+	}
+	return t
 }
 
 // HandleConnection ...
 func (h *Handler) HandleConnection(session *mqtt.Session) {
+	logger := h.log.WithField(logging.RemoteAddrKey, session.RemoteAddr().String())
 
 	cm, err := h.connect(session)
 	if err != nil {
 		if err != io.EOF {
-			log.Println("failed to establish a session:", err)
+			logger.WithError(err).Warn("failed to establish a session")
 			session.Close()
 		}
 		return
 	}
 
+	logger = logger.WithFields(logrus.Fields{
+		logging.DeviceKey:    cm.DeviceName,
+		logging.FormationKey: cm.FormationID,
+	})
+	logger.Debug("device connected")
+
 	for {
 		ca, err := session.Read()
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("error while reading packet from %s: %v. closing connection", cm.DeviceName, err)
+			if err != io.EOF && h.current(cm.DeviceName, session) {
+				logger.WithError(err).Warn("error while reading packet. closing connection")
 			}
 
-			h.deviceDisconnected(cm.FormationID, cm.DeviceName, session)
+			h.deviceDisconnected(cm.FormationID, cm.DeviceName, disconnectReason(err), session, logger)
 			return
 		}
 
@@ -111,28 +172,41 @@ func (h *Handler) HandleConnection(session *mqtt.Session) {
 		case *packets.PingreqPacket:
 			err = session.SendPingresp()
 		case *packets.PublishPacket:
-			h.broker.Publish(ca.TopicName, ca.Payload)
+			h.publish("device message", cm.FormationID, cm.DeviceName, ca.TopicName, ca.Payload)
 		case *packets.SubscribePacket:
 			err = h.broker.HandleSubscribePacket(ca, session, false)
 		case *packets.UnsubscribePacket:
 			h.broker.UnsubscribeAll(ca, session)
 			err = session.SendUnsuback(ca.MessageID)
 		case *packets.DisconnectPacket:
-			h.deviceDisconnected(cm.FormationID, cm.DeviceName, session)
+			h.deviceDisconnected(cm.FormationID, cm.DeviceName, DisconnectClean, session, logger)
 			return
 		default:
-			log.Println("ignoring unsupported message from", cm.DeviceName)
+			logger.Warn("ignoring unsupported message")
 		}
 
 		if err != nil {
-			log.Printf("error while handling packet from device %s (%v): %v", cm.DeviceName, session.RemoteAddr(), err)
+			logger.WithError(err).Error("error while handling packet")
 		}
 	}
 }
 
+// publish starts a new trace for message and publishes it on the broker
+func (h *Handler) publish(spanName, formationID, deviceName, topic string, message interface{}) {
+	ctx, span := tracing.NewContext(context.Background(), spanName)
+	span.SetAttribute(logging.DeviceKey, deviceName)
+	span.SetAttribute(logging.FormationKey, formationID)
+
+	h.broker.Publish(ctx, topic, message)
+	span.Finish(nil)
+}
+
 func (h *Handler) connect(session *mqtt.Session) (*ConnectMessage, error) {
+	start := time.Now()
+
 	pkg, err := session.ReadConnect()
 	if err != nil {
+		rejectConnection("handshake")
 		if err == io.EOF {
 			return nil, err
 		}
@@ -141,66 +215,160 @@ func (h *Handler) connect(session *mqtt.Session) (*ConnectMessage, error) {
 
 	cm := ConnectMessage{DeviceName: pkg.ClientIdentifier}
 	if err := json.Unmarshal([]byte(pkg.Username), &cm); err != nil {
+		rejectConnection("invalid_connect")
 		return nil, err
 	}
 
 	if len(cm.FormationID) == 0 {
+		rejectConnection("invalid_connect")
 		return nil, fmt.Errorf("CONNECT packet from %v is missing formation ID. closing connection", session.RemoteAddr())
 	}
 
-	cm.DeviceInfo, err = fetchDeviceInfo(cm.DeviceName)
+	cm.DeviceInfo, cm.DeviceInfoStale, err = h.registry.DeviceInfo(context.Background(), cm.DeviceName)
 	if err != nil {
+		rejectConnection("device_info")
 		return nil, err
 	}
 
-	h.formations.Lock()
-	h.formations.AddDevice(cm.DeviceName, cm.FormationID)
-	h.formations.Unlock()
+	oldFormationID, moved := h.formations.MoveDevice(cm.DeviceName, cm.FormationID)
+
+	// a previous session must not mark the device disconnected after this one marked it connected
+	cm.Takeover = h.takeover(cm.DeviceName, session)
+
+	var previous *Lifecycle
+	h.formations.Update(cm.FormationID, func(tx *Tx) error {
+		tx.AddDevice(cm.DeviceName)
+		previous, _ = LifecycleSlot.Get(tx, cm.DeviceName)
+		remoteAddrSlot.Put(tx, cm.FormationID, cm.DeviceName, session.RemoteAddr().String())
+		LifecycleSlot.Put(tx, cm.FormationID, cm.DeviceName, &Lifecycle{ConnectedAt: time.Now().UTC()})
+		return nil
+	})
 
 	if err = session.AcknowledgeConnect(); err != nil {
+		h.abortConnect(&cm, session, previous, oldFormationID, moved)
+		rejectConnection("handshake")
 		return nil, err
 	}
 
-	h.broker.Publish(ConnectTopic.String(), cm)
+	metrics.HandshakeDuration.Observe(time.Since(start).Seconds())
+	metrics.ConnectionsAccepted.WithLabelValues("devices").Inc()
+
+	if moved {
+		fc := FormationChangedMessage{DeviceName: cm.DeviceName, OldFormationID: oldFormationID, FormationID: cm.FormationID}
+		h.publish("device formation change", cm.FormationID, cm.DeviceName, FormationChangedTopic.String(), fc)
+	}
+
+	h.publish("device connect", cm.FormationID, cm.DeviceName, ConnectTopic.String(), cm)
 	return &cm, nil
 }
 
-func (h *Handler) deviceDisconnected(formationID, deviceName string, session *mqtt.Session) {
-	h.broker.Remove(session)
+// abortConnect reverts a connect that could not be acknowledged. A device that was moved to the formation
+// of the connect is moved back, since the move was not reported. The device is reported disconnected if
+// this session took over another one, otherwise its previous lifecycle is restored.
+func (h *Handler) abortConnect(cm *ConnectMessage, session *mqtt.Session, previous *Lifecycle, oldFormationID string, moved bool) {
+	formationID := cm.FormationID
+	if moved && h.current(cm.DeviceName, session) {
+		h.formations.MoveDevice(cm.DeviceName, oldFormationID)
+		formationID = oldFormationID
+	}
 
-	if err := session.Close(); err != nil {
-		log.Println(err)
+	if cm.Takeover {
+		logger := h.log.WithFields(logrus.Fields{logging.DeviceKey: cm.DeviceName, logging.FormationKey: formationID})
+		h.deviceDisconnected(formationID, cm.DeviceName, DisconnectError, session, logger)
+		return
 	}
 
-	h.broker.Publish(DisconnectTopic.String(), DisconnectMessage{formationID, deviceName})
+	h.sl.Lock()
+	defer h.sl.Unlock()
+
+	h.formations.Update(formationID, func(tx *Tx) error {
+		if h.sessions[cm.DeviceName] != session {
+			return nil
+		}
+		delete(h.sessions, cm.DeviceName)
+
+		if previous == nil {
+			LifecycleSlot.Delete(tx, formationID, cm.DeviceName)
+		} else {
+			LifecycleSlot.Put(tx, formationID, cm.DeviceName, previous)
+		}
+		return nil
+	})
 }
 
-func fetchDeviceInfo(deviceName string) (map[string]interface{}, error) {
-	url := fmt.Sprintf("%s/v2/devices/%s", config.Config.LiberatorBaseURL, deviceName)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+func rejectConnection(reason string) {
+	metrics.ConnectionsRejected.WithLabelValues("devices", reason).Inc()
+}
+
+// takeover makes session the current session of deviceName. It closes the previous session and returns
+// true if there was one. It waits for the disconnect of a previous session that is being reported.
+func (h *Handler) takeover(deviceName string, session *mqtt.Session) bool {
+	h.sl.Lock()
+	old, exists := h.sessions[deviceName]
+	h.sessions[deviceName] = session
+	h.sl.Unlock()
+
+	if exists {
+		old.Close()
 	}
+	return exists
+}
 
-	req.Header.Add("Authorization", "Bearer "+config.Config.LiberatorJWTToken)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+// current returns true if session is the current session of deviceName
+func (h *Handler) current(deviceName string, session *mqtt.Session) bool {
+	h.sl.Lock()
+	defer h.sl.Unlock()
+
+	return h.sessions[deviceName] == session
+}
+
+func disconnectReason(err error) string {
+	var netErr net.Error
+
+	switch {
+	case err == io.EOF:
+		return DisconnectEOF
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return DisconnectTimeout
+	default:
+		return DisconnectError
 	}
+}
 
-	info := make(map[string]interface{})
-	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
-		return nil, err
+func (h *Handler) deviceDisconnected(formationID, deviceName, reason string, session *mqtt.Session, logger *logrus.Entry) {
+	h.broker.Remove(session)
+
+	if err := session.Close(); err != nil && h.current(deviceName, session) {
+		logger.WithError(err).Warn("error while closing connection")
 	}
 
-	if resp.StatusCode != 200 {
-		err := fmt.Errorf("unexpected response from liberator for device %s. status: %d %s. error: %v",
-			deviceName, resp.StatusCode, resp.Status, info["error"])
+	// holding h.sl until the DisconnectMessage is published orders it before the ConnectMessage of a new session
+	h.sl.Lock()
+	defer h.sl.Unlock()
 
-		return nil, err
+	var current bool
+	h.formations.Update(formationID, func(tx *Tx) error {
+		// the device is connected on another session, which reported the takeover
+		if current = h.sessions[deviceName] == session; !current {
+			return nil
+		}
+		delete(h.sessions, deviceName)
+
+		disconnected := &Lifecycle{DisconnectedAt: time.Now().UTC()}
+		if lc, ok := LifecycleSlot.Get(tx, deviceName); ok {
+			disconnected.ConnectedAt = lc.ConnectedAt
+		}
+		LifecycleSlot.Put(tx, formationID, deviceName, disconnected)
+		return nil
+	})
+
+	if !current {
+		logger.Debug("session taken over")
+		return
 	}
+	logger.WithField("reason", reason).Debug("device disconnected")
 
-	return info, nil
+	h.publish("device disconnect", formationID, deviceName, DisconnectTopic.String(), DisconnectMessage{formationID, deviceName, reason})
 }
 
 // Round ...
@@ -6,8 +6,11 @@ import (
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/config"
 	"github.com/superscale/spire/devices"
 	"github.com/superscale/spire/devices/deviceInfo"
+	"github.com/superscale/spire/liberator"
+	"github.com/superscale/spire/logging"
 	"github.com/superscale/spire/mqtt"
 	"github.com/superscale/spire/testutils"
 )
@@ -25,9 +28,10 @@ var _ = Describe("Device Message Handlers", func() {
 	var deviceName = "1.marsara"
 
 	BeforeEach(func() {
-		broker = mqtt.NewBroker(false)
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
 		formations = devices.NewFormationMap()
-		devMsgHandler = devices.NewHandler(formations, broker)
+		liberatorClient := liberator.NewClient(liberator.OptionsFromConfig(config.Config), logging.New("test"))
+		devMsgHandler = devices.NewHandler(formations, broker, liberatorClient, logging.New("test"))
 		deviceServer, deviceClient = testutils.Pipe()
 	})
 	JustBeforeEach(func() {
@@ -51,7 +55,7 @@ var _ = Describe("Device Message Handlers", func() {
 		})
 		Describe("device info", func() {
 			BeforeEach(func() {
-				deviceInfo.Register(broker, formations)
+				deviceInfo.Register(broker, formations, logging.New("test"))
 			})
 			It("fetches device info and adds 'device_os' to device state", func() {
 				var deviceInfoState interface{}
@@ -67,6 +71,41 @@ var _ = Describe("Device Message Handlers", func() {
 				Expect(deviceInfoState.(map[string]interface{})["device_os"]).To(Equal("tplink-archer-c7-lingrush-44"))
 			})
 		})
+		Describe("with a new formation ID", func() {
+			var oldFormationID = "00000000-0000-0000-0000-000000000002"
+			var recorder *testutils.PubSubRecorder
+
+			BeforeEach(func() {
+				recorder = testutils.NewPubSubRecorder()
+				broker.Subscribe(devices.FormationChangedTopic.String(), recorder)
+
+				formations.Update(oldFormationID, func(tx *devices.Tx) error {
+					tx.AddDevice(deviceName)
+					tx.PutDeviceState(oldFormationID, deviceName, "count", 23)
+					return nil
+				})
+			})
+			It("moves the device state to the new formation", func() {
+				formations.View(formationID, func(tx *devices.Tx) error {
+					Expect(tx.GetDeviceState(deviceName, "count")).To(Equal(23))
+					return nil
+				})
+				formations.View(oldFormationID, func(tx *devices.Tx) error {
+					Expect(tx.GetDeviceState(deviceName, "count")).To(BeNil())
+					return nil
+				})
+			})
+			It("publishes a formation changed message", func() {
+				Eventually(recorder.Count).Should(BeNumerically("==", 1))
+
+				_, raw := recorder.First()
+				Expect(raw).To(Equal(devices.FormationChangedMessage{
+					DeviceName:     deviceName,
+					OldFormationID: oldFormationID,
+					FormationID:    formationID,
+				}))
+			})
+		})
 		Describe("pub/sub", func() {
 			var recorder *testutils.PubSubRecorder
 
@@ -117,6 +156,18 @@ var _ = Describe("Device Message Handlers", func() {
 
 				Expect(cm.FormationID).To(Equal(formationID))
 				Expect(cm.DeviceName).To(Equal(deviceName))
+				Expect(cm.Reason).To(Equal(devices.DisconnectClean))
+			})
+			It("records the disconnect time", func() {
+				Eventually(recorder.Count).Should(BeNumerically("==", 1))
+
+				formations.View(formationID, func(tx *devices.Tx) error {
+					lc, ok := devices.LifecycleSlot.Get(tx, deviceName)
+					Expect(ok).To(BeTrue())
+					Expect(lc.ConnectedAt).NotTo(BeZero())
+					Expect(lc.Connected()).To(BeFalse())
+					return nil
+				})
 			})
 		})
 		Context("by closing the connection", func() {
@@ -136,6 +187,53 @@ var _ = Describe("Device Message Handlers", func() {
 
 				Expect(cm.FormationID).To(Equal(formationID))
 				Expect(cm.DeviceName).To(Equal(deviceName))
+				Expect(cm.Reason).To(Equal(devices.DisconnectEOF))
+			})
+		})
+		Context("by timing out", func() {
+			It("publishes a disconnect message with the reason", func() {
+				Eventually(recorder.Count, "3s").Should(BeNumerically("==", 1))
+
+				_, raw := recorder.First()
+				Expect(raw.(devices.DisconnectMessage).Reason).To(Equal(devices.DisconnectTimeout))
+			})
+		})
+		Context("by connecting again", func() {
+			var connectRecorder *testutils.PubSubRecorder
+
+			JustBeforeEach(func() {
+				connectRecorder = testutils.NewPubSubRecorder()
+				broker.Subscribe(devices.ConnectTopic.String(), connectRecorder)
+
+				server, client := testutils.Pipe()
+				go devMsgHandler.HandleConnection(server)
+
+				Expect(testutils.WriteConnectPacket(formationID, deviceName, "", client)).NotTo(HaveOccurred())
+				_, err := client.Read()
+				Expect(err).NotTo(HaveOccurred())
+			})
+			It("closes the previous session", func() {
+				_, err := deviceClient.Read()
+				Expect(err).To(HaveOccurred())
+			})
+			It("reports the takeover in the connect message", func() {
+				// the connect message of the first session may be published after the recorder subscribed
+				Eventually(func() bool {
+					if connectRecorder.Count() == 0 {
+						return false
+					}
+					_, raw := connectRecorder.Last()
+					return raw.(devices.ConnectMessage).Takeover
+				}).Should(BeTrue())
+			})
+			It("does not disconnect the device", func() {
+				Consistently(recorder.Count, "200ms").Should(BeZero())
+
+				formations.View(formationID, func(tx *devices.Tx) error {
+					lc, _ := devices.LifecycleSlot.Get(tx, deviceName)
+					Expect(lc.Connected()).To(BeTrue())
+					return nil
+				})
 			})
 		})
 	})
@@ -172,6 +270,18 @@ var _ = Describe("Device Message Handlers", func() {
 				})
 			})
 		})
+		Context("short topic", func() {
+			It("does not panic", func() {
+				Expect(func() { result = devices.ParseTopic("pylon/1.marsara") }).NotTo(Panic())
+				Expect(result.Prefix).To(Equal("pylon"))
+				Expect(result.DeviceName).To(Equal(deviceName))
+				Expect(result.Path).To(BeEmpty())
+
+				Expect(func() { result = devices.ParseTopic(mqtt.InternalTopicPrefix) }).NotTo(Panic())
+				Expect(result.Prefix).To(Equal(mqtt.InternalTopicPrefix))
+				Expect(result.Path).To(BeEmpty())
+			})
+		})
 		Context("internal topic", func() {
 			JustBeforeEach(func() {
 				path = "spire/devices/connect"
@@ -200,3 +310,65 @@ var _ = Describe("Device Message Handlers", func() {
 		})
 	})
 })
+
+var _ = Describe("Failed handshakes", func() {
+
+	var formations *devices.FormationMap
+	var recorder *testutils.PubSubRecorder
+	var failConnect func()
+
+	var formationID = "00000000-0000-0000-0000-000000000001"
+	var oldFormationID = "00000000-0000-0000-0000-000000000002"
+	var deviceName = "1.marsara"
+
+	BeforeEach(func() {
+		broker := mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
+		formations = devices.NewFormationMap()
+		liberatorClient := liberator.NewClient(liberator.OptionsFromConfig(config.Config), logging.New("test"))
+		devMsgHandler := devices.NewHandler(formations, broker, liberatorClient, logging.New("test"))
+
+		recorder = testutils.NewPubSubRecorder()
+		broker.Subscribe(devices.ConnectTopic.String(), recorder)
+		broker.Subscribe(devices.FormationChangedTopic.String(), recorder)
+
+		failConnect = func() {
+			server, client := testutils.Pipe()
+			done := make(chan struct{})
+			go func() {
+				devMsgHandler.HandleConnection(server)
+				close(done)
+			}()
+
+			// closing the client without reading fails the CONNACK
+			Expect(testutils.WriteConnectPacket(formationID, deviceName, "", client)).NotTo(HaveOccurred())
+			client.Close()
+			Eventually(done).Should(BeClosed())
+		}
+	})
+	It("does not mark the device connected if CONNACK cannot be sent", func() {
+		failConnect()
+
+		Expect(recorder.Count()).To(BeZero())
+		formations.ViewDevice(deviceName, func(tx *devices.Tx) error {
+			_, ok := devices.LifecycleSlot.Get(tx, deviceName)
+			Expect(ok).To(BeFalse())
+			return nil
+		})
+	})
+	It("does not move the device to another formation if CONNACK cannot be sent", func() {
+		formations.Update(oldFormationID, func(tx *devices.Tx) error {
+			tx.AddDevice(deviceName)
+			tx.PutDeviceState(oldFormationID, deviceName, "count", 23)
+			return nil
+		})
+
+		failConnect()
+
+		Expect(recorder.Count()).To(BeZero())
+		Expect(formations.FormationID(deviceName)).To(Equal(oldFormationID))
+		formations.ViewDevice(deviceName, func(tx *devices.Tx) error {
+			Expect(tx.GetDeviceState(deviceName, "count")).To(Equal(23))
+			return nil
+		})
+	})
+})
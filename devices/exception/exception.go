@@ -1,14 +1,17 @@
 package exception
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
-	"fmt"
 
 	"github.com/bugsnag/bugsnag-go"
+	"github.com/sirupsen/logrus"
 	"github.com/superscale/spire/config"
 	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/deviceInfo"
+	"github.com/superscale/spire/devices/handlers"
 	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/tracing"
 )
 
 // Message ...
@@ -20,45 +23,55 @@ type Message struct {
 // Handler ...
 type Handler struct {
 	formations *devices.FormationMap
+	log        *logrus.Entry
+	router     *devices.Router
+}
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name:      "exception",
+		Register:  handlers.Wrap(Register),
+		DependsOn: []string{"deviceInfo"},
+	})
 }
 
 // Register ...
-func Register(broker *mqtt.Broker, formations *devices.FormationMap) interface{} {
-	h := &Handler{formations}
-	broker.Subscribe("pylon/+/exception", h)
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, logger *logrus.Entry) interface{} {
+	h := &Handler{formations: formations, log: logger, router: devices.NewRouter("exception")}
+	devices.Route(h.router, "pylon/+/exception", h.onException)
+	h.router.Subscribe(broker, h)
 	return h
 }
 
 // HandleMessage ...
-func (h *Handler) HandleMessage(topic string, payload interface{}) error {
+func (h *Handler) HandleMessage(ctx context.Context, topic string, payload interface{}) error {
+	return h.router.HandleMessage(ctx, topic, payload)
+}
+
+func (h *Handler) onException(ctx context.Context, t devices.Topic, m Message) error {
 	if len(config.Config.BugsnagKey) == 0 {
 		return errors.New("bugsnag API key not set")
 	}
 
-	buf, ok := payload.([]byte)
-	if !ok {
-		return fmt.Errorf("[exception] expected byte buffer, got this instead: %v", payload)
+	if len(m.Error) == 0 {
+		m.Error = "unknown exception on device"
 	}
-
-	m := Message{Error: "unknown exception on device", Context: "unknown originating topic"}
-	if err := json.Unmarshal(buf, &m); err != nil {
-		return err
+	if len(m.Context) == 0 {
+		m.Context = "unknown originating topic"
 	}
 
-	t := devices.ParseTopic(topic)
 	metadata := bugsnag.MetaData{}
 	metadata.Add("device", "hostname", t.DeviceName)
+	metadata.Add("trace", "id", tracing.ID(ctx))
 
-	h.formations.RLock()
-	defer h.formations.RUnlock()
-
-	rawState := h.formations.GetDeviceState(t.DeviceName, "device_info")
-
-	if deviceInfo, ok := rawState.(map[string]interface{}); ok {
-		metadata.Add("device", "osVersion", deviceInfo["device_os"])
-	} else {
-		metadata.Add("device", "osVersion", "unknown")
-	}
+	osVersion := interface{}("unknown")
+	h.formations.ViewDevice(t.DeviceName, func(tx *devices.Tx) error {
+		if info, ok := deviceInfo.Slot.Get(tx, t.DeviceName); ok {
+			osVersion = info["device_os"]
+		}
+		return nil
+	})
+	metadata.Add("device", "osVersion", osVersion)
 
 	return bugsnag.Notify(errors.New(m.Error), bugsnag.SeverityError, bugsnag.Context{String: m.Context}, metadata)
 }
@@ -1,6 +1,22 @@
 package devices
 
-import "sync"
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/metrics"
+)
+
+// remoteAddrSlot holds the address of the device's connection
+var remoteAddrSlot = NewDeviceSlot[string]("devices", "remote_addr")
+
+// numShards is the number of independently locked shards that formations are distributed over
+const numShards = 64
 
 type stateMap map[string]interface{}
 
@@ -12,44 +28,164 @@ type formationS struct {
 	devices deviceStateMap
 }
 
-// FormationMap ...
-type FormationMap struct {
-	m map[string]formationS
-	d map[string]string // device name -> formation ID
+type shard struct {
 	l sync.RWMutex
+	m map[string]formationS // formation ID -> formation
+}
+
+// State gives access to formation and device state. It is implemented by FormationMap
+// (with all shards locked) and by Tx (with the shard of a single formation locked).
+type State interface {
+	GetState(formationID, key string) interface{}
+	PutState(formationID, key string, value interface{})
+	DeleteState(formationID, key string)
+	GetDeviceState(deviceName, key string) interface{}
+	PutDeviceState(formationID, deviceName, key string, value interface{})
+	DeleteDeviceState(formationID, deviceName, key string)
+	FormationID(deviceName string) string
+}
+
+// FormationMap holds the state of all formations and their devices. Formations are distributed
+// over shards that are locked independently. Handlers use Update and View to access the state of
+// a single formation. Lock and RLock lock all shards, e.g. for snapshots or tests.
+type FormationMap struct {
+	shards  [numShards]shard
+	dl      sync.RWMutex
+	d       map[string]string // device name -> formation ID. guarded by dl
+	journal StateJournal
 }
 
 // NewFormationMap ...
 func NewFormationMap() *FormationMap {
-	return &FormationMap{
-		m: make(map[string]formationS),
-		d: make(map[string]string),
+	fm := &FormationMap{d: make(map[string]string)}
+	for i := range fm.shards {
+		fm.shards[i].m = make(map[string]formationS)
+	}
+	return fm
+}
+
+var readLockWait = metrics.FormationLockWait.WithLabelValues("read")
+var writeLockWait = metrics.FormationLockWait.WithLabelValues("write")
+
+func (fm *FormationMap) shard(formationID string) *shard {
+	return &fm.shards[shardIndex(formationID)]
+}
+
+func shardIndex(formationID string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(formationID))
+	return h.Sum32() % numShards
+}
+
+// lockPair locks the shards of two formations for writing. Shards are locked in index order, so that
+// concurrent calls cannot deadlock. It returns a function that unlocks them.
+func (fm *FormationMap) lockPair(a, b string) (unlock func()) {
+	i, j := shardIndex(a), shardIndex(b)
+	if i == j {
+		fm.shards[i].l.Lock()
+		return fm.shards[i].l.Unlock
+	}
+	if i > j {
+		i, j = j, i
+	}
+
+	fm.shards[i].l.Lock()
+	fm.shards[j].l.Lock()
+	return func() {
+		fm.shards[j].l.Unlock()
+		fm.shards[i].l.Unlock()
 	}
 }
 
-// Lock ...
+// Update calls fn with the shard of formationID locked for writing. Use it for read-modify-write
+// cycles on the state of one formation. fn must not block, e.g. on broker publishes.
+func (fm *FormationMap) Update(formationID string, fn func(tx *Tx) error) error {
+	s := fm.shard(formationID)
+
+	start := time.Now()
+	s.l.Lock()
+	writeLockWait.Observe(time.Since(start).Seconds())
+	defer s.l.Unlock()
+
+	return fn(&Tx{fm: fm, formationID: formationID, writable: true})
+}
+
+// View calls fn with the shard of formationID locked for reading
+func (fm *FormationMap) View(formationID string, fn func(tx *Tx) error) error {
+	s := fm.shard(formationID)
+
+	start := time.Now()
+	s.l.RLock()
+	readLockWait.Observe(time.Since(start).Seconds())
+	defer s.l.RUnlock()
+
+	return fn(&Tx{fm: fm, formationID: formationID})
+}
+
+// UpdateDevice calls Update for the formation of deviceName
+func (fm *FormationMap) UpdateDevice(deviceName string, fn func(tx *Tx) error) error {
+	return fm.Update(fm.FormationID(deviceName), fn)
+}
+
+// ViewDevice calls View for the formation of deviceName
+func (fm *FormationMap) ViewDevice(deviceName string, fn func(tx *Tx) error) error {
+	return fm.View(fm.FormationID(deviceName), fn)
+}
+
+// Lock locks all shards for writing
 func (fm *FormationMap) Lock() {
-	fm.l.Lock()
+	start := time.Now()
+	for i := range fm.shards {
+		fm.shards[i].l.Lock()
+	}
+	writeLockWait.Observe(time.Since(start).Seconds())
 }
 
 // Unlock ...
 func (fm *FormationMap) Unlock() {
-	fm.l.Unlock()
+	for i := range fm.shards {
+		fm.shards[i].l.Unlock()
+	}
 }
 
-// RLock ...
+// RLock locks all shards for reading
 func (fm *FormationMap) RLock() {
-	fm.l.RLock()
+	start := time.Now()
+	for i := range fm.shards {
+		fm.shards[i].l.RLock()
+	}
+	readLockWait.Observe(time.Since(start).Seconds())
 }
 
 // RUnlock ...
 func (fm *FormationMap) RUnlock() {
-	fm.l.RUnlock()
+	for i := range fm.shards {
+		fm.shards[i].l.RUnlock()
+	}
 }
 
-// PutState ...
+// FormationIDs returns the IDs of all formations, sorted
+func (fm *FormationMap) FormationIDs() []string {
+	var ids []string
+	for i := range fm.shards {
+		s := &fm.shards[i]
+
+		s.l.RLock()
+		for id := range s.m {
+			ids = append(ids, id)
+		}
+		s.l.RUnlock()
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+// PutState stores formation state under key. Handlers should use a FormationSlot instead.
+// Callers must hold the lock of the formation's shard.
 func (fm *FormationMap) PutState(formationID, key string, value interface{}) {
-	formation, exists := fm.m[formationID]
+	s := fm.shard(formationID)
+	formation, exists := s.m[formationID]
 
 	if exists {
 		formation.state[key] = value
@@ -59,13 +195,27 @@ func (fm *FormationMap) PutState(formationID, key string, value interface{}) {
 			devices: make(deviceStateMap),
 		}
 
-		fm.m[formationID] = formation
+		s.m[formationID] = formation
+	}
+
+	fm.record(PutOp, formationID, "", key, value)
+}
+
+// DeleteState ...
+func (fm *FormationMap) DeleteState(formationID, key string) {
+	formation, exists := fm.shard(formationID).m[formationID]
+
+	if !exists {
+		return
 	}
+
+	delete(formation.state, key)
+	fm.record(DeleteOp, formationID, "", key, nil)
 }
 
 // GetState ...
 func (fm *FormationMap) GetState(formationID, key string) interface{} {
-	formation, exists := fm.m[formationID]
+	formation, exists := fm.shard(formationID).m[formationID]
 
 	if !exists {
 		return nil
@@ -74,13 +224,15 @@ func (fm *FormationMap) GetState(formationID, key string) interface{} {
 	return formation.state[key]
 }
 
-// PutDeviceState ...
+// PutDeviceState stores device state under key. Handlers should use a DeviceSlot instead.
+// Callers must hold the lock of the formation's shard.
 func (fm *FormationMap) PutDeviceState(formationID, deviceName, key string, value interface{}) {
-	formation, fExists := fm.m[formationID]
+	s := fm.shard(formationID)
+	formation, fExists := s.m[formationID]
 
 	if !fExists {
 		formation = formationS{make(stateMap), make(deviceStateMap)}
-		fm.m[formationID] = formation
+		s.m[formationID] = formation
 	}
 
 	state, dExists := formation.devices[deviceName]
@@ -90,27 +242,30 @@ func (fm *FormationMap) PutDeviceState(formationID, deviceName, key string, valu
 	}
 
 	state[key] = value
-	fm.d[deviceName] = formationID
+	fm.setFormationID(deviceName, formationID)
+
+	fm.record(PutOp, formationID, deviceName, key, value)
 }
 
 // GetDeviceState ...
 func (fm *FormationMap) GetDeviceState(deviceName, key string) interface{} {
-	if formationID, exists := fm.d[deviceName]; exists {
+	return fm.deviceState(fm.FormationID(deviceName), deviceName, key)
+}
 
-		if formation, exists := fm.m[formationID]; exists {
+func (fm *FormationMap) deviceState(formationID, deviceName, key string) interface{} {
+	if formation, exists := fm.shard(formationID).m[formationID]; exists {
 
-			if state, exists := formation.devices[deviceName]; exists {
-				return state[key]
-			}
+		if state, exists := formation.devices[deviceName]; exists {
+			return state[key]
 		}
 	}
 
 	return nil
 }
 
-// DeleteDeviceState ...
+// DeleteDeviceState deletes a single key. Use RemoveDevice to remove the device.
 func (fm *FormationMap) DeleteDeviceState(formationID, deviceName, key string) {
-	formation, fExists := fm.m[formationID]
+	formation, fExists := fm.shard(formationID).m[formationID]
 
 	if !fExists {
 		return
@@ -121,15 +276,141 @@ func (fm *FormationMap) DeleteDeviceState(formationID, deviceName, key string) {
 		delete(state, key)
 	}
 
-	delete(fm.d, deviceName)
+	fm.record(DeleteOp, formationID, deviceName, key, nil)
 }
 
-// FormationID returns the devices formation ID
+// FormationID returns the devices formation ID. It does not require a lock.
 func (fm *FormationMap) FormationID(deviceName string) string {
+	fm.dl.RLock()
+	defer fm.dl.RUnlock()
+
 	return fm.d[deviceName]
 }
 
-// AddDevice ...
+// AddDevice assigns deviceName to formationID. Callers must hold the lock of the formation's shard.
 func (fm *FormationMap) AddDevice(deviceName, formationID string) {
+	fm.setFormationID(deviceName, formationID)
+
+	fm.record(AddDeviceOp, formationID, deviceName, "", nil)
+}
+
+func (fm *FormationMap) setFormationID(deviceName, formationID string) {
+	fm.dl.Lock()
+	defer fm.dl.Unlock()
+
 	fm.d[deviceName] = formationID
 }
+
+// Logger returns a logger with the device name, formation ID and remote address of the device
+// added to the entries. Callers must hold at least the read lock.
+func (fm *FormationMap) Logger(logger *logrus.Entry, deviceName string) *logrus.Entry {
+	return deviceLogger(fm, logger, deviceName)
+}
+
+func deviceLogger(s State, logger *logrus.Entry, deviceName string) *logrus.Entry {
+	fields := logrus.Fields{
+		logging.DeviceKey:    deviceName,
+		logging.FormationKey: s.FormationID(deviceName),
+	}
+
+	if addr, ok := remoteAddrSlot.Get(s, deviceName); ok {
+		fields[logging.RemoteAddrKey] = addr
+	}
+
+	return logger.WithFields(fields)
+}
+
+// Tx gives access to the state of a single formation while its shard is locked.
+// It is only valid inside the function passed to Update or View.
+type Tx struct {
+	fm          *FormationMap
+	formationID string
+	writable    bool
+}
+
+// Formation returns the ID of the formation the transaction is for
+func (tx *Tx) Formation() string {
+	return tx.formationID
+}
+
+// check panics if the transaction is used for another formation or for writing in View
+func (tx *Tx) check(formationID string, write bool) {
+	if formationID != tx.formationID {
+		panic(fmt.Sprintf("devices: transaction for formation %q used for formation %q", tx.formationID, formationID))
+	}
+	if write && !tx.writable {
+		panic("devices: write in read-only transaction")
+	}
+}
+
+// GetState implements State
+func (tx *Tx) GetState(formationID, key string) interface{} {
+	tx.check(formationID, false)
+	return tx.fm.GetState(formationID, key)
+}
+
+// PutState implements State
+func (tx *Tx) PutState(formationID, key string, value interface{}) {
+	tx.check(formationID, true)
+	tx.fm.PutState(formationID, key, value)
+}
+
+// DeleteState implements State
+func (tx *Tx) DeleteState(formationID, key string) {
+	tx.check(formationID, true)
+	tx.fm.DeleteState(formationID, key)
+}
+
+// GetDeviceState implements State. It returns nil for devices of other formations.
+func (tx *Tx) GetDeviceState(deviceName, key string) interface{} {
+	return tx.fm.deviceState(tx.formationID, deviceName, key)
+}
+
+// PutDeviceState implements State
+func (tx *Tx) PutDeviceState(formationID, deviceName, key string, value interface{}) {
+	tx.check(formationID, true)
+	tx.fm.PutDeviceState(formationID, deviceName, key, value)
+}
+
+// DeleteDeviceState implements State
+func (tx *Tx) DeleteDeviceState(formationID, deviceName, key string) {
+	tx.check(formationID, true)
+	tx.fm.DeleteDeviceState(formationID, deviceName, key)
+}
+
+// AddDevice assigns deviceName to the formation of the transaction
+func (tx *Tx) AddDevice(deviceName string) {
+	tx.check(tx.formationID, true)
+	tx.fm.AddDevice(deviceName, tx.formationID)
+}
+
+// RemoveDevice removes all state of the device from the formation of the transaction. It returns false if the device is unknown.
+func (tx *Tx) RemoveDevice(deviceName string) bool {
+	tx.check(tx.formationID, true)
+	return tx.fm.removeDevice(tx.formationID, deviceName)
+}
+
+// Devices returns the names of the devices that have state in the formation of the transaction, sorted by name
+func (tx *Tx) Devices() []string {
+	formation, exists := tx.fm.shard(tx.formationID).m[tx.formationID]
+	if !exists {
+		return nil
+	}
+
+	deviceNames := make([]string, 0, len(formation.devices))
+	for deviceName := range formation.devices {
+		deviceNames = append(deviceNames, deviceName)
+	}
+	sort.Strings(deviceNames)
+	return deviceNames
+}
+
+// FormationID implements State
+func (tx *Tx) FormationID(deviceName string) string {
+	return tx.fm.FormationID(deviceName)
+}
+
+// Logger returns a logger with the device name, formation ID and remote address of the device added to the entries
+func (tx *Tx) Logger(logger *logrus.Entry, deviceName string) *logrus.Entry {
+	return deviceLogger(tx, logger, deviceName)
+}
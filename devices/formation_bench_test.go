@@ -0,0 +1,63 @@
+package devices_test
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/superscale/spire/devices"
+)
+
+const benchFormations = 1000
+
+// benchmarkFormations returns a formation map with one device in each of n formations
+func benchmarkFormations(n int) (*devices.FormationMap, []string) {
+	formations := devices.NewFormationMap()
+	deviceNames := make([]string, n)
+
+	for i := range deviceNames {
+		formationID := fmt.Sprintf("00000000-0000-0000-0000-%012d", i)
+		deviceNames[i] = fmt.Sprintf("%d.marsara", i)
+
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			tx.AddDevice(deviceNames[i])
+			return nil
+		})
+	}
+	return formations, deviceNames
+}
+
+// BenchmarkUpdateDevice does read-modify-write cycles on devices of different formations
+func BenchmarkUpdateDevice(b *testing.B) {
+	formations, deviceNames := benchmarkFormations(benchFormations)
+	var next uint64
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			deviceName := deviceNames[atomic.AddUint64(&next, 1)%benchFormations]
+
+			formations.UpdateDevice(deviceName, func(tx *devices.Tx) error {
+				count, _ := tx.GetDeviceState(deviceName, "count").(int)
+				tx.PutDeviceState(tx.Formation(), deviceName, "count", count+1)
+				return nil
+			})
+		}
+	})
+}
+
+// BenchmarkUpdateDeviceGlobalLock does the same with all shards locked, like handlers did before sharding
+func BenchmarkUpdateDeviceGlobalLock(b *testing.B) {
+	formations, deviceNames := benchmarkFormations(benchFormations)
+	var next uint64
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			deviceName := deviceNames[atomic.AddUint64(&next, 1)%benchFormations]
+
+			formations.Lock()
+			count, _ := formations.GetDeviceState(deviceName, "count").(int)
+			formations.PutDeviceState(formations.FormationID(deviceName), deviceName, "count", count+1)
+			formations.Unlock()
+		}
+	})
+}
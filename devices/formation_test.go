@@ -0,0 +1,117 @@
+package devices_test
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/devices"
+)
+
+var _ = Describe("Formation Map", func() {
+
+	var formations *devices.FormationMap
+
+	var formationID = "00000000-0000-0000-0000-000000000001"
+	var otherFormationID = "00000000-0000-0000-0000-000000000002"
+	var deviceName = "1.marsara"
+
+	BeforeEach(func() {
+		formations = devices.NewFormationMap()
+	})
+	Describe("transactions", func() {
+		It("reads state written in an earlier transaction", func() {
+			err := formations.Update(formationID, func(tx *devices.Tx) error {
+				tx.AddDevice(deviceName)
+				tx.PutDeviceState(formationID, deviceName, "count", 23)
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			var count interface{}
+			formations.ViewDevice(deviceName, func(tx *devices.Tx) error {
+				Expect(tx.Formation()).To(Equal(formationID))
+				count = tx.GetDeviceState(deviceName, "count")
+				return nil
+			})
+			Expect(count).To(Equal(23))
+		})
+		It("returns the error of the function", func() {
+			err := formations.Update(formationID, func(tx *devices.Tx) error {
+				return errors.New("failed")
+			})
+			Expect(err).To(MatchError("failed"))
+		})
+		It("does not return device state of other formations", func() {
+			formations.Update(otherFormationID, func(tx *devices.Tx) error {
+				tx.PutDeviceState(otherFormationID, deviceName, "count", 23)
+				return nil
+			})
+
+			formations.View(formationID, func(tx *devices.Tx) error {
+				Expect(tx.GetDeviceState(deviceName, "count")).To(BeNil())
+				return nil
+			})
+		})
+		It("lists the devices of the formation", func() {
+			formations.Update(formationID, func(tx *devices.Tx) error {
+				tx.PutDeviceState(formationID, "2.marsara", "count", 1)
+				tx.PutDeviceState(formationID, deviceName, "count", 2)
+				return nil
+			})
+			formations.Update(otherFormationID, func(tx *devices.Tx) error {
+				tx.PutDeviceState(otherFormationID, "3.marsara", "count", 3)
+				return nil
+			})
+
+			formations.View(formationID, func(tx *devices.Tx) error {
+				Expect(tx.Devices()).To(Equal([]string{deviceName, "2.marsara"}))
+				return nil
+			})
+		})
+		It("lists all formations", func() {
+			formations.Update(otherFormationID, func(tx *devices.Tx) error {
+				tx.PutState(otherFormationID, "count", 1)
+				return nil
+			})
+			formations.Update(formationID, func(tx *devices.Tx) error {
+				tx.PutDeviceState(formationID, deviceName, "count", 2)
+				return nil
+			})
+
+			Expect(formations.FormationIDs()).To(Equal([]string{formationID, otherFormationID}))
+		})
+		It("panics when used for another formation", func() {
+			formations.Update(formationID, func(tx *devices.Tx) error {
+				Expect(func() { tx.PutState(otherFormationID, "count", 23) }).To(Panic())
+				return nil
+			})
+		})
+		It("panics on writes in View", func() {
+			formations.View(formationID, func(tx *devices.Tx) error {
+				Expect(func() { tx.PutState(formationID, "count", 23) }).To(Panic())
+				return nil
+			})
+		})
+		It("does not block transactions of other formations", func() {
+			locked := make(chan struct{})
+			release := make(chan struct{})
+			defer close(release)
+
+			go formations.Update(formationID, func(tx *devices.Tx) error {
+				close(locked)
+				<-release
+				return nil
+			})
+			<-locked
+
+			done := make(chan struct{})
+			go func() {
+				formations.Update(otherFormationID, func(tx *devices.Tx) error { return nil })
+				close(done)
+			}()
+			Eventually(done, time.Second).Should(BeClosed())
+		})
+	})
+})
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/mqtt"
+)
+
+// Deps are passed to the register function of a handler
+type Deps struct {
+	Broker     *mqtt.Broker
+	Formations *devices.FormationMap
+	Logger     *logrus.Entry
+	// Config is the handler's config section as returned by Definition.Config, populated from the
+	// environment and the config file.
+	// nil if the handler does not have a config section.
+	Config interface{}
+	// Dependencies holds the registered handlers listed in Definition.DependsOn by name
+	Dependencies map[string]interface{}
+}
+
+// RegisterFn subscribes a handler to the broker and returns it
+type RegisterFn func(deps Deps) (interface{}, error)
+
+// Wrap turns the Register function of a handler package that cannot fail into a RegisterFn
+func Wrap(register func(*mqtt.Broker, *devices.FormationMap, *logrus.Entry) interface{}) RegisterFn {
+	return func(deps Deps) (interface{}, error) {
+		return register(deps.Broker, deps.Formations, deps.Logger), nil
+	}
+}
+
+// Definition describes a message handler
+type Definition struct {
+	Name     string
+	Register RegisterFn
+	// Config returns a pointer to a new, empty config section with "env" and "yaml" tags. Optional.
+	Config func() interface{}
+	// DependsOn lists the names of handlers that must be registered before this one.
+	DependsOn []string
+}
+
+var (
+	l           sync.Mutex
+	definitions = make(map[string]Definition)
+	order       []string // names in the order they were added
+)
+
+// Add makes a handler available to Load. It is meant to be called from the init function
+// of the handler's package and panics if a handler with the same name was already added.
+func Add(def Definition) {
+	l.Lock()
+	defer l.Unlock()
+
+	if def.Register == nil {
+		panic("handlers: Add called with nil Register function for handler " + def.Name)
+	}
+
+	if _, exists := definitions[def.Name]; exists {
+		panic("handlers: Add called twice for handler " + def.Name)
+	}
+
+	definitions[def.Name] = def
+	order = append(order, def.Name)
+}
+
+// Names returns the names of all available handlers in alphabetical order
+func Names() []string {
+	l.Lock()
+	defer l.Unlock()
+
+	names := make([]string, len(order))
+	copy(names, order)
+	sort.Strings(names)
+	return names
+}
+
+// Selection decides which handlers are loaded
+type Selection struct {
+	// Enabled lists the handlers to load. All available handlers are loaded if empty.
+	Enabled []string
+	// Disabled lists handlers that are not loaded, even if they are in Enabled.
+	Disabled []string
+}
+
+// SelectionFromConfig returns the selection configured via SPIRE_HANDLERS and SPIRE_DISABLED_HANDLERS
+func SelectionFromConfig(params *config.Params) Selection {
+	return Selection{
+		Enabled:  splitList(params.Handlers),
+		Disabled: splitList(params.DisabledHandlers),
+	}
+}
+
+// Load registers all selected handlers in dependency order and returns them by name.
+// Handlers that fail to register, or whose dependencies are not loaded, are skipped and
+// reported in the returned error.
+func Load(broker *mqtt.Broker, formations *devices.FormationMap, sel Selection) (map[string]interface{}, error) {
+	names, errs := resolve(sel)
+	loaded := make(map[string]interface{})
+
+	for _, name := range names {
+		def := definitionFor(name)
+
+		if missing := missingDeps(def, loaded); len(missing) > 0 {
+			errs = append(errs, fmt.Sprintf("%s: dependencies not loaded: %s", name, strings.Join(missing, ", ")))
+			continue
+		}
+
+		deps := Deps{
+			Broker:       broker,
+			Formations:   formations,
+			Logger:       logging.ForHandler(name),
+			Dependencies: make(map[string]interface{}, len(def.DependsOn)),
+		}
+		for _, dep := range def.DependsOn {
+			deps.Dependencies[dep] = loaded[dep]
+		}
+
+		if def.Config != nil {
+			deps.Config = def.Config()
+			if err := config.ParseSection(name, deps.Config); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: invalid config: %v", name, err))
+				continue
+			}
+		}
+
+		h, err := def.Register(deps)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		loaded[name] = h
+	}
+
+	if len(errs) > 0 {
+		return loaded, fmt.Errorf("failed to load message handlers:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return loaded, nil
+}
+
+// Reconfigurer is implemented by handlers that can apply a new config section at runtime
+type Reconfigurer interface {
+	Reconfigure(section interface{}) error
+}
+
+// Reload parses the config sections of the loaded handlers again and passes them to
+// all handlers that implement Reconfigurer.
+func Reload(loaded map[string]interface{}) error {
+	var errs []string
+
+	for name, h := range loaded {
+		def := definitionFor(name)
+		r, ok := h.(Reconfigurer)
+		if def.Config == nil || !ok {
+			continue
+		}
+
+		section := def.Config()
+		if err := config.ParseSection(name, section); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: invalid config: %v", name, err))
+			continue
+		}
+
+		if err := r.Reconfigure(section); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("failed to reconfigure message handlers:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+func definitionFor(name string) Definition {
+	l.Lock()
+	defer l.Unlock()
+
+	return definitions[name]
+}
+
+// resolve returns the names of the selected handlers, sorted so that every handler comes after its dependencies
+func resolve(sel Selection) ([]string, []string) {
+	l.Lock()
+	defer l.Unlock()
+
+	var errs []string
+	selected := make(map[string]bool)
+
+	if len(sel.Enabled) == 0 {
+		for _, name := range order {
+			selected[name] = true
+		}
+	} else {
+		for _, name := range sel.Enabled {
+			if _, exists := definitions[name]; !exists {
+				errs = append(errs, fmt.Sprintf("%s: unknown handler", name))
+				continue
+			}
+			selected[name] = true
+		}
+	}
+
+	for _, name := range sel.Disabled {
+		delete(selected, name)
+	}
+
+	res := []string{}
+	visited := make(map[string]bool)
+	visiting := make(map[string]bool)
+
+	var visit func(name string)
+	visit = func(name string) {
+		if visited[name] || !selected[name] {
+			return
+		}
+		if visiting[name] {
+			errs = append(errs, fmt.Sprintf("%s: dependency cycle", name))
+			return
+		}
+
+		visiting[name] = true
+		for _, dep := range definitions[name].DependsOn {
+			visit(dep)
+		}
+		visiting[name] = false
+
+		visited[name] = true
+		res = append(res, name)
+	}
+
+	for _, name := range order {
+		visit(name)
+	}
+
+	return res, errs
+}
+
+func missingDeps(def Definition, loaded map[string]interface{}) []string {
+	var missing []string
+	for _, dep := range def.DependsOn {
+		if _, exists := loaded[dep]; !exists {
+			missing = append(missing, dep)
+		}
+	}
+	return missing
+}
+
+func splitList(s string) []string {
+	res := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			res = append(res, item)
+		}
+	}
+	return res
+}
@@ -0,0 +1,176 @@
+package handlers_test
+
+import (
+	"errors"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/handlers"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/mqtt"
+)
+
+type testConfig struct {
+	Threshold int `env:"SPIRE_TEST_THRESHOLD"  envDefault:"23"  yaml:"threshold"`
+}
+
+type testHandler struct {
+	name     string
+	deps     handlers.Deps
+	sections []interface{}
+}
+
+func (h *testHandler) Reconfigure(section interface{}) error {
+	h.sections = append(h.sections, section)
+	return nil
+}
+
+var registered []string
+
+func register(name string) handlers.RegisterFn {
+	return func(deps handlers.Deps) (interface{}, error) {
+		registered = append(registered, name)
+		return &testHandler{name: name, deps: deps}, nil
+	}
+}
+
+func init() {
+	handlers.Add(handlers.Definition{Name: "consumer", Register: register("consumer"), DependsOn: []string{"producer"}})
+	handlers.Add(handlers.Definition{Name: "producer", Register: register("producer")})
+	handlers.Add(handlers.Definition{
+		Name:     "configured",
+		Register: register("configured"),
+		Config:   func() interface{} { return new(testConfig) },
+	})
+	handlers.Add(handlers.Definition{
+		Name: "broken",
+		Register: func(handlers.Deps) (interface{}, error) {
+			return nil, errors.New("missing credentials")
+		},
+	})
+}
+
+var _ = Describe("Handler Registry", func() {
+
+	var broker *mqtt.Broker
+	var formations *devices.FormationMap
+	var sel handlers.Selection
+	var loaded map[string]interface{}
+	var err error
+
+	BeforeEach(func() {
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
+		formations = devices.NewFormationMap()
+		sel = handlers.Selection{Disabled: []string{"broken"}}
+		registered = nil
+	})
+	JustBeforeEach(func() {
+		loaded, err = handlers.Load(broker, formations, sel)
+	})
+	It("lists available handlers", func() {
+		Expect(handlers.Names()).To(Equal([]string{"broken", "configured", "consumer", "producer"}))
+	})
+	Context("with all handlers enabled", func() {
+		It("loads all handlers that are not disabled", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded).To(HaveLen(3))
+			Expect(loaded).NotTo(HaveKey("broken"))
+		})
+		It("registers dependencies first", func() {
+			Expect(registered).To(Equal([]string{"producer", "consumer", "configured"}))
+		})
+		It("passes broker, formation map and a logger to the handler", func() {
+			h := loaded["producer"].(*testHandler)
+			Expect(h.deps.Broker).To(Equal(broker))
+			Expect(h.deps.Formations).To(Equal(formations))
+			Expect(h.deps.Logger.Data[logging.HandlerKey]).To(Equal("producer"))
+			Expect(h.deps.Config).To(BeNil())
+		})
+		It("passes dependencies to the handler", func() {
+			h := loaded["consumer"].(*testHandler)
+			Expect(h.deps.Dependencies).To(HaveLen(1))
+			Expect(h.deps.Dependencies["producer"]).To(BeIdenticalTo(loaded["producer"]))
+		})
+		It("passes the config section to the handler", func() {
+			h := loaded["configured"].(*testHandler)
+			cfg, ok := h.deps.Config.(*testConfig)
+			Expect(ok).To(BeTrue())
+			Expect(cfg.Threshold).To(Equal(23))
+		})
+	})
+	Context("reloading", func() {
+		BeforeEach(func() {
+			os.Setenv("SPIRE_TEST_THRESHOLD", "42")
+		})
+		AfterEach(func() {
+			os.Unsetenv("SPIRE_TEST_THRESHOLD")
+		})
+		It("passes new config sections to handlers", func() {
+			Expect(handlers.Reload(loaded)).NotTo(HaveOccurred())
+
+			h := loaded["configured"].(*testHandler)
+			Expect(h.sections).To(HaveLen(1))
+			Expect(h.sections[0].(*testConfig).Threshold).To(Equal(42))
+		})
+		It("skips handlers without a config section", func() {
+			Expect(handlers.Reload(loaded)).NotTo(HaveOccurred())
+			Expect(loaded["producer"].(*testHandler).sections).To(BeEmpty())
+		})
+	})
+	Context("with a handler that fails to register", func() {
+		BeforeEach(func() {
+			sel.Disabled = nil
+		})
+		It("reports the error and loads the other handlers", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("broken: missing credentials"))
+			Expect(loaded).To(HaveLen(3))
+		})
+	})
+	Context("with an explicit list of handlers", func() {
+		BeforeEach(func() {
+			sel.Enabled = []string{"producer", "configured"}
+		})
+		It("loads only those handlers", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded).To(HaveLen(2))
+			Expect(loaded).To(HaveKey("producer"))
+			Expect(loaded).To(HaveKey("configured"))
+		})
+	})
+	Context("with a disabled dependency", func() {
+		BeforeEach(func() {
+			sel.Disabled = append(sel.Disabled, "producer")
+		})
+		It("reports the missing dependency", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("consumer: dependencies not loaded: producer"))
+			Expect(loaded).To(HaveLen(1))
+		})
+	})
+	Context("with an unknown handler", func() {
+		BeforeEach(func() {
+			sel.Enabled = []string{"producer", "nope"}
+		})
+		It("reports the unknown handler", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("nope: unknown handler"))
+			Expect(loaded).To(HaveLen(1))
+		})
+	})
+	Context("with an invalid config section", func() {
+		BeforeEach(func() {
+			os.Setenv("SPIRE_TEST_THRESHOLD", "many")
+		})
+		AfterEach(func() {
+			os.Unsetenv("SPIRE_TEST_THRESHOLD")
+		})
+		It("reports the error", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("configured: invalid config"))
+			Expect(loaded).NotTo(HaveKey("configured"))
+		})
+	})
+})
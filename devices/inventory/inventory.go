@@ -0,0 +1,344 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/handlers"
+	"github.com/superscale/spire/mqtt"
+)
+
+// QueryTopic Control clients query the inventory by subscribing to this topic, optionally followed by
+// a query string, e.g. "$SYS/spire/query/inventory?formation_id=<id>&version_lt=42". The Result is
+// published once on the subscribed topic.
+const QueryTopic = mqtt.InternalTopicPrefix + "/spire/query/inventory"
+
+// SystemImage is the firmware of a device, taken from the current_system_image of its device info
+type SystemImage struct {
+	Vendor  string `json:"vendor"`
+	Product string `json:"product"`
+	Variant string `json:"variant"`
+	Version int    `json:"version"`
+}
+
+func (s *SystemImage) String() string {
+	return fmt.Sprintf("%s-%s-%s-%d", s.Vendor, s.Product, s.Variant, s.Version)
+}
+
+// Model ...
+type Model struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Port is a port of a switch. Device is set for CPU ports.
+type Port struct {
+	Number  int    `json:"num"`
+	Device  string `json:"device,omitempty"`
+	Role    string `json:"role,omitempty"`
+	NeedTag bool   `json:"need_tag,omitempty"`
+}
+
+// Switch ...
+type Switch struct {
+	Enable bool   `json:"enable"`
+	Reset  bool   `json:"reset"`
+	Ports  []Port `json:"ports"`
+}
+
+// Board is the board description that devices publish in sys/facts
+type Board struct {
+	Model  Model             `json:"model"`
+	Switch map[string]Switch `json:"switch,omitempty"`
+}
+
+// Entry holds what is known about the hardware and firmware of a device. Stored entries are never modified.
+type Entry struct {
+	SystemImage *SystemImage               `json:"system_image"` // nil if the device info has none
+	Board       *Board                     `json:"board"`        // nil until the device published sys/facts
+	Facts       map[string]json.RawMessage `json:"facts,omitempty"`
+	UpdatedAt   time.Time                  `json:"updated_at"`
+}
+
+// Device is an entry in query results
+type Device struct {
+	DeviceName  string `json:"device_name"`
+	FormationID string `json:"formation_id"`
+	*Entry
+}
+
+// Result is published on the topic of a query
+type Result struct {
+	Devices []Device `json:"devices"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Slot holds the inventory entry of a device
+var Slot = devices.NewDeviceSlot[*Entry]("inventory", "inventory").Persist(func() *Entry { return new(Entry) })
+
+// Handler ...
+type Handler struct {
+	broker     *mqtt.Broker
+	formations *devices.FormationMap
+	log        *logrus.Entry
+	router     *devices.Router
+}
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name:     "inventory",
+		Register: handlers.Wrap(Register),
+	})
+}
+
+// Register ...
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, logger *logrus.Entry) interface{} {
+	h := &Handler{broker: broker, formations: formations, log: logger, router: devices.NewRouter("inventory")}
+
+	devices.Route(h.router, devices.ConnectTopic.String(), h.onConnect)
+	devices.Route(h.router, "pylon/+/sys/facts", h.onFactsMessage)
+	devices.Route(h.router, mqtt.SubscribeEventTopic, h.onSubscribeEvent)
+	h.router.Subscribe(broker, h)
+	return h
+}
+
+// HandleMessage ...
+func (h *Handler) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	return h.router.HandleMessage(ctx, topic, message)
+}
+
+func (h *Handler) onConnect(_ context.Context, _ devices.Topic, cm devices.ConnectMessage) error {
+	sysimg := systemImage(cm.DeviceInfo)
+
+	return h.formations.Update(cm.FormationID, func(tx *devices.Tx) error {
+		entry := new(Entry)
+		if current, ok := Slot.Get(tx, cm.DeviceName); ok {
+			*entry = *current
+		}
+
+		entry.SystemImage = sysimg
+		entry.UpdatedAt = time.Now().UTC()
+		Slot.Put(tx, cm.FormationID, cm.DeviceName, entry)
+		return nil
+	})
+}
+
+func (h *Handler) onFactsMessage(_ context.Context, t devices.Topic, facts map[string]json.RawMessage) error {
+	var board *Board
+	if raw, ok := facts["board"]; ok {
+		board = new(Board)
+		if err := json.Unmarshal(raw, board); err != nil {
+			return err
+		}
+	}
+
+	other := make(map[string]json.RawMessage, len(facts))
+	for key, value := range facts {
+		if key != "board" {
+			other[key] = value
+		}
+	}
+
+	return h.formations.UpdateDevice(t.DeviceName, func(tx *devices.Tx) error {
+		if len(tx.Formation()) == 0 {
+			return fmt.Errorf("received facts of unknown device %s", t.DeviceName)
+		}
+
+		entry := new(Entry)
+		if current, ok := Slot.Get(tx, t.DeviceName); ok {
+			*entry = *current
+		}
+
+		entry.Board = board
+		entry.Facts = other
+		entry.UpdatedAt = time.Now().UTC()
+		Slot.Put(tx, tx.Formation(), t.DeviceName, entry)
+		return nil
+	})
+}
+
+func (h *Handler) onSubscribeEvent(ctx context.Context, _ devices.Topic, sm mqtt.SubscribeMessage) error {
+	for _, topic := range sm.Topics {
+		rawQuery, ok := queryString(topic)
+		if !ok {
+			continue
+		}
+
+		var result Result
+		if q, err := parseRawQuery(rawQuery); err != nil {
+			result.Error = err.Error()
+			result.Devices = []Device{}
+		} else {
+			result.Devices = Find(h.formations, q)
+		}
+
+		h.broker.Publish(ctx, topic, &result)
+	}
+	return nil
+}
+
+// queryString returns the query string of topics under QueryTopic
+func queryString(topic string) (string, bool) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(topic, "/"), QueryTopic)
+
+	switch {
+	case len(rest) == 0:
+		return "", true
+	case rest[0] == '?':
+		return rest[1:], true
+	default:
+		return "", false
+	}
+}
+
+func parseRawQuery(rawQuery string) (*Query, error) {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	return ParseQuery(values)
+}
+
+// Query selects inventory entries. Empty fields match all devices. Devices without a system image
+// do not match queries for a version.
+type Query struct {
+	FormationID string
+	Vendor      string
+	Product     string
+	Variant     string
+	Model       string // ID of the board model
+	MinVersion  *int
+	MaxVersion  *int
+}
+
+// ParseQuery builds a query from parameters like "formation_id", "vendor", "product", "variant", "model",
+// "version" and the comparisons "version_lt", "version_lte", "version_gt" and "version_gte".
+func ParseQuery(values url.Values) (*Query, error) {
+	q := new(Query)
+
+	for key := range values {
+		value := values.Get(key)
+
+		switch key {
+		case "formation_id":
+			q.FormationID = value
+		case "vendor":
+			q.Vendor = value
+		case "product":
+			q.Product = value
+		case "variant":
+			q.Variant = value
+		case "model":
+			q.Model = value
+		case "version", "version_lt", "version_lte", "version_gt", "version_gte":
+			version, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", key, value)
+			}
+			q.constrainVersion(key, version)
+		default:
+			return nil, fmt.Errorf("unknown query parameter %q", key)
+		}
+	}
+	return q, nil
+}
+
+func (q *Query) constrainVersion(op string, version int) {
+	min, max := q.MinVersion, q.MaxVersion
+
+	switch op {
+	case "version":
+		min, max = &version, &version
+	case "version_lt":
+		version--
+		max = &version
+	case "version_lte":
+		max = &version
+	case "version_gt":
+		version++
+		min = &version
+	case "version_gte":
+		min = &version
+	}
+
+	if min != nil && (q.MinVersion == nil || *min > *q.MinVersion) {
+		q.MinVersion = min
+	}
+	if max != nil && (q.MaxVersion == nil || *max < *q.MaxVersion) {
+		q.MaxVersion = max
+	}
+}
+
+// Matches returns true if entry is selected by the query
+func (q *Query) Matches(entry *Entry) bool {
+	sysimg := entry.SystemImage
+	if sysimg == nil {
+		if len(q.Vendor) > 0 || len(q.Product) > 0 || len(q.Variant) > 0 || q.MinVersion != nil || q.MaxVersion != nil {
+			return false
+		}
+	} else {
+		if len(q.Vendor) > 0 && q.Vendor != sysimg.Vendor ||
+			len(q.Product) > 0 && q.Product != sysimg.Product ||
+			len(q.Variant) > 0 && q.Variant != sysimg.Variant ||
+			q.MinVersion != nil && sysimg.Version < *q.MinVersion ||
+			q.MaxVersion != nil && sysimg.Version > *q.MaxVersion {
+			return false
+		}
+	}
+
+	if len(q.Model) > 0 && (entry.Board == nil || entry.Board.Model.ID != q.Model) {
+		return false
+	}
+	return true
+}
+
+// Find returns the devices selected by q, sorted by formation and device name
+func Find(formations *devices.FormationMap, q *Query) []Device {
+	formationIDs := formations.FormationIDs()
+	if len(q.FormationID) > 0 {
+		formationIDs = []string{q.FormationID}
+	}
+
+	found := []Device{}
+	for _, formationID := range formationIDs {
+		formations.View(formationID, func(tx *devices.Tx) error {
+			for _, deviceName := range tx.Devices() {
+				if entry, ok := Slot.Get(tx, deviceName); ok && q.Matches(entry) {
+					found = append(found, Device{DeviceName: deviceName, FormationID: formationID, Entry: entry})
+				}
+			}
+			return nil
+		})
+	}
+	return found
+}
+
+// systemImage returns the current system image of the device info returned by the device registry
+func systemImage(info map[string]interface{}) *SystemImage {
+	data, ok := info["data"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	sysimg, ok := data["current_system_image"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	vendor, _ := sysimg["vendor"].(string)
+	product, _ := sysimg["product"].(string)
+	variant, _ := sysimg["variant"].(string)
+	version, ok := sysimg["version"].(float64)
+	if !ok {
+		return nil
+	}
+
+	return &SystemImage{Vendor: vendor, Product: product, Variant: variant, Version: int(version)}
+}
@@ -0,0 +1,169 @@
+package inventory_test
+
+import (
+	"context"
+	"net/url"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/inventory"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("Inventory", func() {
+
+	var broker *mqtt.Broker
+	var formations *devices.FormationMap
+
+	var formationID = "00000000-0000-0000-0000-000000000001"
+	var otherFormationID = "00000000-0000-0000-0000-000000000002"
+
+	var factsMsg = []byte(`{
+		"board": {
+			"model": {"id": "tplink,archer-c7", "name": "TP-Link Archer C7"},
+			"switch": {
+				"switch0": {
+					"enable": true,
+					"reset": true,
+					"ports": [
+						{"num": 0, "device": "eth1", "need_tag": false},
+						{"num": 1, "role": "wan"},
+						{"num": 2, "role": "lan"}
+					]
+				}
+			}
+		},
+		"memory": {"total": 131072}
+	}`)
+
+	connect := func(formationID, deviceName string, version int) {
+		info := map[string]interface{}{
+			"data": map[string]interface{}{
+				"current_system_image": map[string]interface{}{
+					"vendor":  "superscale",
+					"product": "mr3020",
+					"variant": "default",
+					"version": float64(version),
+				},
+			},
+		}
+
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			tx.AddDevice(deviceName)
+			return nil
+		})
+
+		cm := devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName, DeviceInfo: info}
+		broker.Publish(context.Background(), devices.ConnectTopic.String(), cm)
+	}
+
+	getEntry := func(deviceName string) *inventory.Entry {
+		var entry *inventory.Entry
+		formations.ViewDevice(deviceName, func(tx *devices.Tx) error {
+			entry, _ = inventory.Slot.Get(tx, deviceName)
+			return nil
+		})
+		return entry
+	}
+
+	find := func(rawQuery string) []string {
+		values, err := url.ParseQuery(rawQuery)
+		Expect(err).NotTo(HaveOccurred())
+
+		q, err := inventory.ParseQuery(values)
+		Expect(err).NotTo(HaveOccurred())
+
+		names := []string{}
+		for _, d := range inventory.Find(formations, q) {
+			names = append(names, d.DeviceName)
+		}
+		return names
+	}
+
+	BeforeEach(func() {
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
+		formations = devices.NewFormationMap()
+		inventory.Register(broker, formations, logging.New("test"))
+
+		connect(formationID, "1.marsara", 41)
+		connect(formationID, "2.marsara", 42)
+		connect(otherFormationID, "1.korhal", 40)
+	})
+	It("stores the system image on connect", func() {
+		entry := getEntry("1.marsara")
+		Expect(entry).NotTo(BeNil())
+		Expect(entry.SystemImage.String()).To(Equal("superscale-mr3020-default-41"))
+		Expect(entry.Board).To(BeNil())
+	})
+	It("stores the board and other facts", func() {
+		broker.Publish(context.Background(), "pylon/1.marsara/sys/facts", factsMsg)
+
+		entry := getEntry("1.marsara")
+		Expect(entry.SystemImage.Version).To(Equal(41))
+		Expect(entry.Board.Model.ID).To(Equal("tplink,archer-c7"))
+		Expect(entry.Board.Switch["switch0"].Ports).To(HaveLen(3))
+		Expect(entry.Board.Switch["switch0"].Ports[0].Device).To(Equal("eth1"))
+		Expect(entry.Facts).To(HaveKey("memory"))
+		Expect(entry.Facts).NotTo(HaveKey("board"))
+	})
+	Describe("queries", func() {
+		It("finds all devices", func() {
+			Expect(find("")).To(Equal([]string{"1.marsara", "2.marsara", "1.korhal"}))
+		})
+		It("finds devices of a formation below a version", func() {
+			Expect(find("formation_id=" + formationID + "&version_lt=42")).To(Equal([]string{"1.marsara"}))
+		})
+		It("combines version comparisons", func() {
+			Expect(find("version_gte=41&version_lte=41")).To(Equal([]string{"1.marsara"}))
+			Expect(find("version_gt=40")).To(Equal([]string{"1.marsara", "2.marsara"}))
+		})
+		It("finds devices by board model", func() {
+			broker.Publish(context.Background(), "pylon/2.marsara/sys/facts", factsMsg)
+			Expect(find("model=tplink,archer-c7")).To(Equal([]string{"2.marsara"}))
+		})
+		It("rejects unknown parameters and invalid versions", func() {
+			_, err := inventory.ParseQuery(url.Values{"colour": {"red"}})
+			Expect(err).To(MatchError(`unknown query parameter "colour"`))
+
+			_, err = inventory.ParseQuery(url.Values{"version_lt": {"latest"}})
+			Expect(err).To(MatchError(`invalid version_lt "latest"`))
+		})
+	})
+	Describe("queries over MQTT", func() {
+		var recorder *testutils.PubSubRecorder
+
+		query := func(topic string) *inventory.Result {
+			broker.Subscribe(topic, recorder)
+			broker.Publish(context.Background(), mqtt.SubscribeEventTopic, mqtt.SubscribeMessage{Topics: []string{topic}})
+
+			Expect(recorder.Count()).To(Equal(1))
+			t, msg := recorder.First()
+			Expect(t).To(Equal(topic))
+			return msg.(*inventory.Result)
+		}
+
+		BeforeEach(func() {
+			recorder = testutils.NewPubSubRecorder()
+		})
+		It("publishes the result on the subscribed topic", func() {
+			result := query(inventory.QueryTopic + "?formation_id=" + formationID + "&version_lt=42")
+			Expect(result.Error).To(BeEmpty())
+			Expect(result.Devices).To(HaveLen(1))
+			Expect(result.Devices[0].DeviceName).To(Equal("1.marsara"))
+			Expect(result.Devices[0].FormationID).To(Equal(formationID))
+		})
+		It("publishes errors of invalid queries", func() {
+			result := query(inventory.QueryTopic + "?version=new")
+			Expect(result.Error).To(Equal(`invalid version "new"`))
+			Expect(result.Devices).To(BeEmpty())
+		})
+		It("ignores other topics", func() {
+			broker.Subscribe(inventory.QueryTopic+"/other", recorder)
+			broker.Publish(context.Background(), mqtt.SubscribeEventTopic, mqtt.SubscribeMessage{Topics: []string{inventory.QueryTopic + "/other"}})
+			Expect(recorder.Count()).To(Equal(0))
+		})
+	})
+})
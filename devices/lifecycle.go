@@ -0,0 +1,309 @@
+package devices
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/metrics"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/tracing"
+)
+
+// DeviceEvictedTopic ...
+var DeviceEvictedTopic = Topic{Prefix: mqtt.InternalTopicPrefix, Path: "spire/devices/evicted"}
+
+// FormationEvictedTopic ...
+var FormationEvictedTopic = Topic{Prefix: mqtt.InternalTopicPrefix, Path: "spire/formations/evicted"}
+
+// FormationChangedTopic ...
+var FormationChangedTopic = Topic{Prefix: mqtt.InternalTopicPrefix, Path: "spire/devices/formation_changed"}
+
+// eviction reasons
+const (
+	// ExpiredReason is used for state of devices that were disconnected for longer than the retention
+	ExpiredReason = "expired"
+	// RemovedReason is used for state that was removed explicitly
+	RemovedReason = "removed"
+)
+
+// Lifecycle records when a device connected and disconnected
+type Lifecycle struct {
+	ConnectedAt    time.Time `json:"connected_at"`
+	DisconnectedAt time.Time `json:"disconnected_at"` // zero while the device is connected
+}
+
+// Connected ...
+func (l *Lifecycle) Connected() bool {
+	return l.DisconnectedAt.IsZero()
+}
+
+// LifecycleSlot holds the lifecycle of a device. Stored values are never modified.
+var LifecycleSlot = NewDeviceSlot[*Lifecycle]("devices", "lifecycle").Persist(func() *Lifecycle { return new(Lifecycle) })
+
+// EvictionMessage is published on DeviceEvictedTopic and FormationEvictedTopic when state is evicted
+type EvictionMessage struct {
+	FormationID    string `json:"formation_id"`
+	DeviceName     string `json:"device_name,omitempty"`
+	Reason         string `json:"reason"`
+	DisconnectedAt int64  `json:"disconnected_at,omitempty"`
+}
+
+// FormationChangedMessage is published on FormationChangedTopic before the ConnectMessage of a device
+// that connected with another formation ID than before. Its device state has already been moved to the
+// new formation. Handlers remove what they derived from the device from the old formation's state.
+type FormationChangedMessage struct {
+	DeviceName     string `json:"device_name"`
+	OldFormationID string `json:"old_formation_id"`
+	FormationID    string `json:"formation_id"`
+}
+
+// MoveDevice assigns a device to formationID and moves its device state from the formation it belonged to.
+// It returns the old formation ID and false if the device is unknown or already belongs to formationID.
+func (fm *FormationMap) MoveDevice(deviceName, formationID string) (oldFormationID string, moved bool) {
+	oldFormationID = fm.FormationID(deviceName)
+	if len(oldFormationID) == 0 || oldFormationID == formationID {
+		return oldFormationID, false
+	}
+
+	unlock := fm.lockPair(oldFormationID, formationID)
+	defer unlock()
+
+	// the device may have been moved or removed while the shards were not locked
+	if fm.FormationID(deviceName) != oldFormationID {
+		return oldFormationID, false
+	}
+
+	var state stateMap
+	if formation, exists := fm.shard(oldFormationID).m[oldFormationID]; exists {
+		state = formation.devices[deviceName]
+	}
+
+	fm.removeDevice(oldFormationID, deviceName)
+	fm.AddDevice(deviceName, formationID)
+
+	for key, value := range state {
+		fm.PutDeviceState(formationID, deviceName, key, value)
+	}
+	return oldFormationID, true
+}
+
+// DisconnectAll marks all devices as disconnected at t, e.g. after restoring the state of devices
+// that were connected when spire was stopped. Devices that were already disconnected are not changed.
+func (fm *FormationMap) DisconnectAll(t time.Time) {
+	for i := range fm.shards {
+		s := &fm.shards[i]
+		s.l.Lock()
+
+		for formationID, formation := range s.m {
+			for deviceName, state := range formation.devices {
+				lc, _ := state[LifecycleSlot.Key()].(*Lifecycle)
+				if lc != nil && !lc.Connected() {
+					continue
+				}
+
+				disconnected := &Lifecycle{DisconnectedAt: t}
+				if lc != nil {
+					disconnected.ConnectedAt = lc.ConnectedAt
+				}
+				fm.PutDeviceState(formationID, deviceName, LifecycleSlot.Key(), disconnected)
+			}
+		}
+
+		s.l.Unlock()
+	}
+}
+
+// RemoveDevice removes all state of a device and its formation ID. It returns false if the device is unknown.
+func (fm *FormationMap) RemoveDevice(deviceName string) (removed bool) {
+	fm.UpdateDevice(deviceName, func(tx *Tx) error {
+		removed = fm.removeDevice(tx.Formation(), deviceName)
+		return nil
+	})
+	return
+}
+
+// RemoveFormation removes all state of a formation and its devices. It returns the names of the removed
+// devices and false if the formation is unknown.
+func (fm *FormationMap) RemoveFormation(formationID string) (deviceNames []string, removed bool) {
+	fm.Update(formationID, func(tx *Tx) error {
+		deviceNames, removed = fm.removeFormation(formationID)
+		return nil
+	})
+	return
+}
+
+// removeDevice requires the lock of the formation's shard
+func (fm *FormationMap) removeDevice(formationID, deviceName string) bool {
+	formation, exists := fm.shard(formationID).m[formationID]
+	if !exists {
+		return false
+	}
+
+	_, exists = formation.devices[deviceName]
+	delete(formation.devices, deviceName)
+
+	fm.dl.Lock()
+	if fm.d[deviceName] == formationID {
+		delete(fm.d, deviceName)
+		exists = true
+	}
+	fm.dl.Unlock()
+
+	if exists {
+		fm.record(RemoveDeviceOp, formationID, deviceName, "", nil)
+	}
+	return exists
+}
+
+// removeFormation requires the lock of the formation's shard
+func (fm *FormationMap) removeFormation(formationID string) ([]string, bool) {
+	s := fm.shard(formationID)
+	formation, exists := s.m[formationID]
+	if !exists {
+		return nil, false
+	}
+
+	deviceNames := make([]string, 0, len(formation.devices))
+	for deviceName := range formation.devices {
+		deviceNames = append(deviceNames, deviceName)
+	}
+
+	fm.dl.Lock()
+	for deviceName, id := range fm.d {
+		if id == formationID {
+			delete(fm.d, deviceName)
+		}
+	}
+	fm.dl.Unlock()
+
+	delete(s.m, formationID)
+	fm.record(RemoveFormationOp, formationID, "", "", nil)
+	return deviceNames, true
+}
+
+// Collector evicts the state of devices that have been disconnected for longer than the retention,
+// and of formations without devices, e.g. after all their devices were evicted or moved to other formations. It publishes EvictionMessages for evicted state.
+type Collector struct {
+	formations *FormationMap
+	broker     *mqtt.Broker
+	retention  func() time.Duration
+	done       chan struct{}
+	stopOnce   sync.Once
+	log        *logrus.Entry
+}
+
+// NewCollector returns a collector. retention is called on every collection, so that it can be reloaded.
+func NewCollector(formations *FormationMap, broker *mqtt.Broker, retention func() time.Duration, logger *logrus.Entry) *Collector {
+	return &Collector{
+		formations: formations,
+		broker:     broker,
+		retention:  retention,
+		done:       make(chan struct{}),
+		log:        logger,
+	}
+}
+
+// Run collects every interval until Stop is called
+func (c *Collector) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			c.Collect(now)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Stop ...
+func (c *Collector) Stop() {
+	c.stopOnce.Do(func() { close(c.done) })
+}
+
+// Collect evicts state that expired at now. Shards are locked one at a time.
+func (c *Collector) Collect(now time.Time) {
+	retention := c.retention()
+	var evictions []EvictionMessage
+
+	for i := range c.formations.shards {
+		s := &c.formations.shards[i]
+		s.l.Lock()
+
+		for formationID, formation := range s.m {
+			for deviceName, state := range formation.devices {
+				lc, ok := state[LifecycleSlot.Key()].(*Lifecycle)
+				if !ok || lc.Connected() || now.Sub(lc.DisconnectedAt) < retention {
+					continue
+				}
+
+				c.formations.removeDevice(formationID, deviceName)
+				evictions = append(evictions, EvictionMessage{
+					FormationID:    formationID,
+					DeviceName:     deviceName,
+					Reason:         ExpiredReason,
+					DisconnectedAt: lc.DisconnectedAt.Unix(),
+				})
+			}
+
+			if len(formation.devices) == 0 {
+				c.formations.removeFormation(formationID) // deleting during range is safe
+				evictions = append(evictions, EvictionMessage{FormationID: formationID, Reason: ExpiredReason})
+			}
+		}
+
+		s.l.Unlock()
+	}
+
+	for _, e := range evictions {
+		c.publish(e)
+	}
+
+	if len(evictions) > 0 {
+		c.log.WithField("evictions", len(evictions)).Info("evicted expired state")
+	}
+}
+
+// RemoveDevice removes the state of a device and publishes an EvictionMessage. It returns false if the device is unknown.
+func (c *Collector) RemoveDevice(deviceName string) bool {
+	formationID := c.formations.FormationID(deviceName)
+	if !c.formations.RemoveDevice(deviceName) {
+		return false
+	}
+
+	c.publish(EvictionMessage{FormationID: formationID, DeviceName: deviceName, Reason: RemovedReason})
+	return true
+}
+
+// RemoveFormation removes the state of a formation and its devices and publishes EvictionMessages.
+// It returns false if the formation is unknown.
+func (c *Collector) RemoveFormation(formationID string) bool {
+	deviceNames, removed := c.formations.RemoveFormation(formationID)
+	if !removed {
+		return false
+	}
+
+	for _, deviceName := range deviceNames {
+		c.publish(EvictionMessage{FormationID: formationID, DeviceName: deviceName, Reason: RemovedReason})
+	}
+	c.publish(EvictionMessage{FormationID: formationID, Reason: RemovedReason})
+	return true
+}
+
+func (c *Collector) publish(e EvictionMessage) {
+	topic, scope := DeviceEvictedTopic, "device"
+	if len(e.DeviceName) == 0 {
+		topic, scope = FormationEvictedTopic, "formation"
+	}
+	metrics.StateEvictions.WithLabelValues(scope, e.Reason).Inc()
+
+	ctx, span := tracing.NewContext(context.Background(), "state eviction")
+	span.SetAttribute(logging.FormationKey, e.FormationID)
+	c.broker.Publish(ctx, topic.String(), e)
+	span.Finish(nil)
+}
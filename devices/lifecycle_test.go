@@ -0,0 +1,159 @@
+package devices_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("Lifecycle", func() {
+
+	var broker *mqtt.Broker
+	var formations *devices.FormationMap
+	var collector *devices.Collector
+	var recorder *testutils.PubSubRecorder
+
+	var formationID = "00000000-0000-0000-0000-000000000001"
+	var deviceName = "1.marsara"
+	var otherDeviceName = "2.marsara"
+	var now = time.Date(2017, 8, 23, 12, 0, 0, 0, time.UTC)
+
+	setLifecycle := func(deviceName string, lc *devices.Lifecycle) {
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			tx.AddDevice(deviceName)
+			tx.PutDeviceState(formationID, deviceName, "count", 23)
+			devices.LifecycleSlot.Put(tx, formationID, deviceName, lc)
+			return nil
+		})
+	}
+
+	BeforeEach(func() {
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
+		formations = devices.NewFormationMap()
+		recorder = testutils.NewPubSubRecorder()
+		broker.Subscribe(mqtt.InternalTopicPrefix+"/spire/+/evicted", recorder)
+
+		collector = devices.NewCollector(formations, broker, func() time.Duration { return time.Hour }, logging.New("test"))
+
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			tx.PutState(formationID, "total", 42)
+			return nil
+		})
+	})
+	It("keeps the formation ID when single keys are deleted", func() {
+		setLifecycle(deviceName, &devices.Lifecycle{ConnectedAt: now})
+
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			tx.DeleteDeviceState(formationID, deviceName, "count")
+			return nil
+		})
+		Expect(formations.FormationID(deviceName)).To(Equal(formationID))
+	})
+	Describe("collecting", func() {
+		It("keeps connected devices", func() {
+			setLifecycle(deviceName, &devices.Lifecycle{ConnectedAt: now.Add(-48 * time.Hour)})
+			collector.Collect(now)
+
+			Expect(formations.FormationID(deviceName)).To(Equal(formationID))
+			Expect(recorder.Count()).To(BeZero())
+		})
+		It("keeps devices that were disconnected recently", func() {
+			setLifecycle(deviceName, &devices.Lifecycle{DisconnectedAt: now.Add(-time.Minute)})
+			collector.Collect(now)
+
+			Expect(formations.FormationID(deviceName)).To(Equal(formationID))
+		})
+		Context("with devices disconnected for longer than the retention", func() {
+			BeforeEach(func() {
+				setLifecycle(deviceName, &devices.Lifecycle{DisconnectedAt: now.Add(-2 * time.Hour)})
+			})
+			It("evicts them", func() {
+				collector.Collect(now)
+
+				Expect(formations.FormationID(deviceName)).To(BeEmpty())
+				formations.View(formationID, func(tx *devices.Tx) error {
+					Expect(tx.GetDeviceState(deviceName, "count")).To(BeNil())
+					return nil
+				})
+			})
+			It("evicts the formation with its last device", func() {
+				collector.Collect(now)
+
+				Expect(formations.FormationSlotValues(formationID)).To(BeEmpty())
+				formations.View(formationID, func(tx *devices.Tx) error {
+					Expect(tx.GetState(formationID, "total")).To(BeNil())
+					return nil
+				})
+
+				Expect(recorder.Count()).To(Equal(2))
+				topic, msg := recorder.Get(0)
+				Expect(topic).To(Equal(devices.DeviceEvictedTopic.String()))
+				Expect(msg).To(Equal(devices.EvictionMessage{
+					FormationID:    formationID,
+					DeviceName:     deviceName,
+					Reason:         devices.ExpiredReason,
+					DisconnectedAt: now.Add(-2 * time.Hour).Unix(),
+				}))
+
+				topic, msg = recorder.Get(1)
+				Expect(topic).To(Equal(devices.FormationEvictedTopic.String()))
+				Expect(msg).To(Equal(devices.EvictionMessage{FormationID: formationID, Reason: devices.ExpiredReason}))
+			})
+			It("keeps the formation while other devices remain", func() {
+				setLifecycle(otherDeviceName, &devices.Lifecycle{ConnectedAt: now})
+				collector.Collect(now)
+
+				Expect(recorder.Count()).To(Equal(1))
+				formations.View(formationID, func(tx *devices.Tx) error {
+					Expect(tx.GetState(formationID, "total")).To(Equal(42))
+					return nil
+				})
+			})
+		})
+	})
+	Describe("removing", func() {
+		BeforeEach(func() {
+			setLifecycle(deviceName, &devices.Lifecycle{ConnectedAt: now})
+			setLifecycle(otherDeviceName, &devices.Lifecycle{ConnectedAt: now})
+		})
+		It("removes a device", func() {
+			Expect(collector.RemoveDevice(deviceName)).To(BeTrue())
+
+			Expect(formations.FormationID(deviceName)).To(BeEmpty())
+			Expect(formations.FormationID(otherDeviceName)).To(Equal(formationID))
+
+			_, msg := recorder.Last()
+			Expect(msg.(devices.EvictionMessage).Reason).To(Equal(devices.RemovedReason))
+		})
+		It("does not remove unknown devices", func() {
+			Expect(collector.RemoveDevice("3.marsara")).To(BeFalse())
+			Expect(recorder.Count()).To(BeZero())
+		})
+		It("removes a formation with its devices", func() {
+			Expect(collector.RemoveFormation(formationID)).To(BeTrue())
+
+			Expect(formations.FormationID(deviceName)).To(BeEmpty())
+			Expect(formations.FormationID(otherDeviceName)).To(BeEmpty())
+			Expect(recorder.Count()).To(Equal(3))
+		})
+	})
+	Describe("restored devices", func() {
+		It("are marked as disconnected", func() {
+			setLifecycle(deviceName, &devices.Lifecycle{ConnectedAt: now.Add(-time.Minute)})
+			formations.DisconnectAll(now)
+
+			formations.View(formationID, func(tx *devices.Tx) error {
+				lc, ok := devices.LifecycleSlot.Get(tx, deviceName)
+				Expect(ok).To(BeTrue())
+				Expect(lc.Connected()).To(BeFalse())
+				Expect(lc.ConnectedAt).To(Equal(now.Add(-time.Minute)))
+				return nil
+			})
+		})
+	})
+})
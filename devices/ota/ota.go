@@ -1,10 +1,15 @@
 package ota
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/commands"
+	"github.com/superscale/spire/devices/handlers"
 	"github.com/superscale/spire/mqtt"
 )
 
@@ -21,6 +26,8 @@ const (
 	Error
 	// Cancelled ...
 	Cancelled
+	// Queued means that a sysupgrade is queued until the device connects
+	Queued
 )
 
 // Message ...
@@ -36,147 +43,222 @@ type Message struct {
 type Handler struct {
 	broker     *mqtt.Broker
 	formations *devices.FormationMap
+	commands   *commands.Handler // queues sysupgrades for offline devices
+	log        *logrus.Entry
+	router     *devices.Router
 }
 
-const formationCacheKey = "ota"
+// StateSlot holds the last OTA state of a device
+var StateSlot = devices.NewDeviceSlot[*Message]("ota", "ota").Persist(func() *Message { return new(Message) })
+
 const stateTopicPath = "ota/state"
 const upgradeTopicPath = "ota/sysupgrade"
 const cancelTopicPath = "ota/cancel"
+const commandsTopicPath = "commands"
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name: "ota",
+		Register: func(deps handlers.Deps) (interface{}, error) {
+			return Register(deps.Broker, deps.Formations, deps.Dependencies["commands"].(*commands.Handler), deps.Logger), nil
+		},
+		DependsOn: []string{"commands"},
+	})
+}
 
 // Register ...
-func Register(broker *mqtt.Broker, formations *devices.FormationMap) interface{} {
-	h := &Handler{broker, formations}
-
-	broker.Subscribe(devices.ConnectTopic.String(), h)
-	broker.Subscribe(devices.DisconnectTopic.String(), h)
-	broker.Subscribe("pylon/+/"+stateTopicPath, h)
-	broker.Subscribe("armada/+/ota/#", h)
-	broker.Subscribe(mqtt.SubscribeEventTopic, h)
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, cmds *commands.Handler, logger *logrus.Entry) interface{} {
+	h := &Handler{broker: broker, formations: formations, commands: cmds, log: logger, router: devices.NewRouter("ota")}
+	h.restore()
+
+	devices.Route(h.router, devices.ConnectTopic.String(), h.onConnect)
+	devices.Route(h.router, devices.DisconnectTopic.String(), h.onDisconnect)
+	devices.Route(h.router, "pylon/+/"+stateTopicPath, h.onStateMessage)
+	devices.Route(h.router, "armada/+/"+upgradeTopicPath, h.onUpgradeMessage)
+	devices.Route(h.router, "armada/+/"+cancelTopicPath, h.onCancelMessage)
+	devices.Route(h.router, "matriarch/+/"+commandsTopicPath, h.onCommandStatus)
+	devices.Route(h.router, mqtt.SubscribeEventTopic, h.onSubscribeEvent)
+	h.router.Subscribe(broker, h)
 	return h
 }
 
-// HandleMessage implements mqtt.Subscriber
-func (h *Handler) HandleMessage(topic string, message interface{}) error {
-	h.formations.Lock()
-	defer h.formations.Unlock()
-
-	t := devices.ParseTopic(topic)
-
-	if t.Path == devices.ConnectTopic.Path {
-		return h.onConnect(message.(devices.ConnectMessage))
+// restore fails sysupgrades that were queued when spire was stopped. The command queue is not persisted,
+// so they would never be delivered.
+func (h *Handler) restore() {
+	for _, formationID := range h.formations.FormationIDs() {
+		h.formations.Update(formationID, func(tx *devices.Tx) error {
+			for _, deviceName := range tx.Devices() {
+				if state, ok := StateSlot.Get(tx, deviceName); !ok || state.State != Queued || h.upgradeQueued(tx, deviceName) {
+					continue
+				}
+
+				StateSlot.Put(tx, formationID, deviceName, &Message{State: Error, Error: "queued sysupgrade was lost on restart"})
+			}
+			return nil
+		})
 	}
+}
 
-	if t.Path == devices.DisconnectTopic.Path {
-		return h.onDisconnect(message.(devices.DisconnectMessage))
+// upgradeQueued returns true if a sysupgrade for deviceName is queued
+func (h *Handler) upgradeQueued(tx *devices.Tx, deviceName string) bool {
+	queue, _ := commands.Slot.Get(tx, deviceName)
+	for _, c := range queue {
+		if c.Topic == h.deviceTopic(deviceName, upgradeTopicPath) {
+			return true
+		}
 	}
+	return false
+}
 
-	if t.Path == cancelTopicPath {
-		h.forwardAndUpdateState(t, message, Cancelled)
-		return nil
-	}
+// HandleMessage implements mqtt.Subscriber
+func (h *Handler) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	return h.router.HandleMessage(ctx, topic, message)
+}
 
-	if topic == mqtt.SubscribeEventTopic {
-		return h.onSubscribeEvent(message.(mqtt.SubscribeMessage))
+func (h *Handler) onStateMessage(ctx context.Context, topic devices.Topic, msg *Message) error {
+	if msg.State != Downloading {
+		h.putState(topic.DeviceName, msg)
 	}
 
-	buf, ok := message.([]byte)
-	if !ok {
-		return fmt.Errorf("[OTA] expected byte buffer, got this instead: %v", message)
+	h.sendToUI(ctx, topic.DeviceName, msg)
+	return nil
+}
+
+func (h *Handler) onUpgradeMessage(ctx context.Context, topic devices.Topic, buf []byte) error {
+	msg := make(map[string]interface{})
+	if err := json.Unmarshal(buf, &msg); err != nil {
+		return err
 	}
 
-	if t.Path == stateTopicPath {
-		return h.onStateMessage(t, buf)
+	if err := checkStrings(msg, "url", "sha256"); err != nil {
+		return err
 	}
 
-	if t.Path == upgradeTopicPath {
-		return h.onUpgradeMessage(t, buf)
+	// ttl is optional and given in seconds
+	ttl := commands.DefaultTTL
+	if seconds, ok := msg["ttl"].(float64); ok && seconds > 0 {
+		ttl = time.Duration(seconds * float64(time.Second))
 	}
 
-	return nil
+	return h.forwardAndUpdateState(ctx, topic, buf, ttl, Downloading)
 }
 
-func (h *Handler) onStateMessage(topic devices.Topic, buf []byte) error {
-	msg := new(Message)
-	if err := json.Unmarshal(buf, msg); err != nil {
-		return err
+func (h *Handler) onCancelMessage(ctx context.Context, topic devices.Topic, message interface{}) error {
+	// a queued sysupgrade has not started yet, so there is nothing to cancel on the device
+	if h.commands.Cancel(ctx, topic.DeviceName, h.deviceTopic(topic.DeviceName, upgradeTopicPath)) > 0 {
+		stateMsg := &Message{State: Cancelled}
+		h.sendToUI(ctx, topic.DeviceName, stateMsg)
+		h.putState(topic.DeviceName, stateMsg)
+		return nil
 	}
 
-	if msg.State != Downloading {
-		formationID := h.formations.FormationID(topic.DeviceName)
-		h.formations.PutDeviceState(formationID, topic.DeviceName, formationCacheKey, msg)
-	}
+	return h.forwardAndUpdateState(ctx, topic, message, commands.DefaultTTL, Cancelled)
+}
+
+func (h *Handler) onConnect(ctx context.Context, _ devices.Topic, cm devices.ConnectMessage) error {
+	msg := &Message{State: Default}
+	h.formations.Update(cm.FormationID, func(tx *devices.Tx) error {
+		// queued sysupgrades are delivered by the commands handler on connect
+		if state, ok := StateSlot.Get(tx, cm.DeviceName); ok && state.State == Queued {
+			msg.State = Downloading
+		}
 
-	h.sendToUI(topic.DeviceName, msg)
+		StateSlot.Put(tx, cm.FormationID, cm.DeviceName, msg)
+		return nil
+	})
+	h.sendToUI(ctx, cm.DeviceName, msg)
 	return nil
 }
 
-func (h *Handler) onUpgradeMessage(topic devices.Topic, buf []byte) error {
-	msg := make(map[string]interface{})
-	if err := json.Unmarshal(buf, &msg); err != nil {
-		return err
+func (h *Handler) onCommandStatus(ctx context.Context, topic devices.Topic, sm *commands.StatusMessage) error {
+	if sm.Topic != h.deviceTopic(topic.DeviceName, upgradeTopicPath) {
+		return nil
 	}
 
-	if err := checkStrings(msg, "url", "sha256"); err != nil {
-		return err
+	var stateMsg *Message
+	switch sm.Status {
+	case commands.Expired:
+		stateMsg = &Message{State: Error, Error: "sysupgrade expired while the device was offline"}
+	case commands.Dropped:
+		stateMsg = &Message{State: Error, Error: "sysupgrade dropped from a full command queue"}
+	default:
+		return nil
 	}
 
-	h.forwardAndUpdateState(topic, buf, Downloading)
+	h.sendToUI(ctx, topic.DeviceName, stateMsg)
+	h.putState(topic.DeviceName, stateMsg)
 	return nil
 }
 
-func (h *Handler) onConnect(cm devices.ConnectMessage) error {
-	msg := &Message{State: Default}
-	h.formations.PutDeviceState(cm.FormationID, cm.DeviceName, formationCacheKey, msg)
-	h.sendToUI(cm.DeviceName, msg)
-	return nil
-}
-
-func (h *Handler) onDisconnect(dm devices.DisconnectMessage) error {
-	rawState := h.formations.GetDeviceState(dm.DeviceName, formationCacheKey)
-	state, ok := rawState.(*Message)
+func (h *Handler) onDisconnect(ctx context.Context, _ devices.Topic, dm devices.DisconnectMessage) error {
+	var state *Message
+	h.formations.View(dm.FormationID, func(tx *devices.Tx) error {
+		state, _ = StateSlot.Get(tx, dm.DeviceName)
+		return nil
+	})
 
-	if ok && state.State == Downloading {
-		h.sendToUI(dm.DeviceName, &Message{State: Error, Error: "connection to device lost during download"})
+	if state != nil && state.State == Downloading {
+		h.sendToUI(ctx, dm.DeviceName, &Message{State: Error, Error: "connection to device lost during download"})
 	}
 
 	return nil
 }
 
-func (h *Handler) onSubscribeEvent(sm mqtt.SubscribeMessage) error {
+func (h *Handler) onSubscribeEvent(ctx context.Context, _ devices.Topic, sm mqtt.SubscribeMessage) error {
 
 	for _, topic := range sm.Topics {
 		t := devices.ParseTopic(topic)
 
 		if t.DeviceName != "+" && (t.Path == stateTopicPath || t.Path == "#") {
-			state, _ := h.formations.GetDeviceState(t.DeviceName, formationCacheKey).(*Message)
-			h.sendToUI(t.DeviceName, state)
+			var state *Message
+			h.formations.ViewDevice(t.DeviceName, func(tx *devices.Tx) error {
+				state, _ = StateSlot.Get(tx, t.DeviceName)
+				return nil
+			})
+			h.sendToUI(ctx, t.DeviceName, state)
 		}
 	}
 	return nil
 }
 
-func (h *Handler) sendToUI(deviceName string, msg *Message) {
+func (h *Handler) sendToUI(ctx context.Context, deviceName string, msg *Message) {
 	if msg == nil {
 		msg = &Message{State: Default}
 	}
 
 	topic := fmt.Sprintf("matriarch/%s/%s", deviceName, stateTopicPath)
-	h.broker.Publish(topic, msg)
+	h.broker.Publish(ctx, topic, msg)
 }
 
-func (h *Handler) sendToDevice(topic devices.Topic, msg interface{}) {
-	topic.Prefix = "pylon"
-	h.broker.Publish(topic.String(), msg)
+func (h *Handler) deviceTopic(deviceName, path string) string {
+	return fmt.Sprintf("pylon/%s/%s", deviceName, path)
 }
 
-func (h *Handler) forwardAndUpdateState(topic devices.Topic, message interface{}, state states) {
-	h.sendToDevice(topic, message)
+// forwardAndUpdateState sends message to the device, or queues it if the device is offline.
+// Queued sysupgrades are in state Queued until they are delivered.
+func (h *Handler) forwardAndUpdateState(ctx context.Context, topic devices.Topic, message interface{}, ttl time.Duration, state states) error {
+	delivered, err := h.commands.Send(ctx, topic.DeviceName, h.deviceTopic(topic.DeviceName, topic.Path), message, ttl)
+	if err != nil {
+		return err
+	}
+
+	if !delivered && state == Downloading {
+		state = Queued
+	}
 
-	formationID := h.formations.FormationID(topic.DeviceName)
 	stateMsg := &Message{State: state}
 
-	h.sendToUI(topic.DeviceName, stateMsg)
-	h.formations.PutDeviceState(formationID, topic.DeviceName, formationCacheKey, stateMsg)
+	h.sendToUI(ctx, topic.DeviceName, stateMsg)
+	h.putState(topic.DeviceName, stateMsg)
+	return nil
+}
+
+// putState stores msg as the OTA state of a device. Stored messages are never modified.
+func (h *Handler) putState(deviceName string, msg *Message) {
+	h.formations.UpdateDevice(deviceName, func(tx *devices.Tx) error {
+		StateSlot.Put(tx, tx.Formation(), deviceName, msg)
+		return nil
+	})
 }
 
 func (s states) String() string {
@@ -191,6 +273,8 @@ func (s states) String() string {
 		return "error"
 	case Cancelled:
 		return "cancelled"
+	case Queued:
+		return "queued"
 	default:
 		return "unknown"
 	}
@@ -231,6 +315,8 @@ func (s *Message) UnmarshalJSON(data []byte) error {
 		s.State = Error
 	case "cancelled":
 		s.State = Cancelled
+	case "queued":
+		s.State = Queued
 	default:
 		s.State = Default
 	}
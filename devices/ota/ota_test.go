@@ -1,13 +1,17 @@
 package ota_test
 
 import (
+	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/commands"
 	"github.com/superscale/spire/devices/ota"
+	"github.com/superscale/spire/logging"
 	"github.com/superscale/spire/mqtt"
 	"github.com/superscale/spire/testutils"
 )
@@ -17,6 +21,7 @@ var _ = Describe("OTA Message Handler", func() {
 	var broker *mqtt.Broker
 	var formations *devices.FormationMap
 	var uiRecorder *testutils.PubSubRecorder
+	var cmds *commands.Handler
 
 	var formationID = "00000000-0000-0000-0000-000000000001"
 	var deviceName = "1.marsara"
@@ -25,17 +30,18 @@ var _ = Describe("OTA Message Handler", func() {
 	var uiTopic = "matriarch/" + deviceName + topicPath
 
 	BeforeEach(func() {
-		broker = mqtt.NewBroker(false)
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
 		formations = devices.NewFormationMap()
 		uiRecorder = testutils.NewPubSubRecorder()
 
 		broker.Subscribe(uiTopic, uiRecorder)
-		ota.Register(broker, formations)
+		cmds = commands.Register(broker, formations, logging.New("test")).(*commands.Handler)
+		ota.Register(broker, formations, cmds, logging.New("test"))
 	})
 	Describe("on connect", func() {
 		BeforeEach(func() {
 			m := devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName, DeviceInfo: nil}
-			broker.Publish(devices.ConnectTopic.String(), m)
+			broker.Publish(context.Background(), devices.ConnectTopic.String(), m)
 		})
 		It("sets state to 'default'", func() {
 			formations.RLock()
@@ -70,7 +76,7 @@ var _ = Describe("OTA Message Handler", func() {
 					"progress": 10
 				}`)
 
-			broker.Publish(deviceTopic, payload)
+			broker.Publish(context.Background(), deviceTopic, payload)
 		})
 		It("updates device state", func() {
 			formations.RLock()
@@ -97,10 +103,17 @@ var _ = Describe("OTA Message Handler", func() {
 		var deviceRecorder *testutils.PubSubRecorder
 		var payload []byte
 
+		BeforeEach(func() {
+			formations.Update(formationID, func(tx *devices.Tx) error {
+				tx.AddDevice(deviceName)
+				devices.LifecycleSlot.Put(tx, formationID, deviceName, &devices.Lifecycle{ConnectedAt: time.Now()})
+				return nil
+			})
+		})
 		JustBeforeEach(func() {
 			deviceRecorder = testutils.NewPubSubRecorder()
 			broker.Subscribe(deviceTopic, deviceRecorder)
-			broker.Publish(controlTopic, payload)
+			broker.Publish(context.Background(), controlTopic, payload)
 		})
 		Context("'sysupgrade'", func() {
 			BeforeEach(func() {
@@ -181,6 +194,76 @@ var _ = Describe("OTA Message Handler", func() {
 			})
 		})
 	})
+	Describe("handling control messages for offline devices", func() {
+		var upgradeTopic = "pylon/" + deviceName + "/ota/sysupgrade"
+		var deviceRecorder, commandsRecorder *testutils.PubSubRecorder
+
+		getState := func() *ota.Message {
+			var state *ota.Message
+			formations.View(formationID, func(tx *devices.Tx) error {
+				state, _ = ota.StateSlot.Get(tx, deviceName)
+				return nil
+			})
+			return state
+		}
+
+		BeforeEach(func() {
+			deviceRecorder = testutils.NewPubSubRecorder()
+			commandsRecorder = testutils.NewPubSubRecorder()
+			broker.Subscribe(upgradeTopic, deviceRecorder)
+			broker.Subscribe("matriarch/"+deviceName+"/commands", commandsRecorder)
+
+			formations.Update(formationID, func(tx *devices.Tx) error {
+				tx.AddDevice(deviceName)
+				return nil
+			})
+
+			broker.Publish(context.Background(), "armada/"+deviceName+"/ota/sysupgrade", []byte(`{
+					"url": "http://your.shiny/new/image",
+					"sha256": "ab63bd5c3377e8d4fd4e16ae3ef24236b4008d4a2ae10a516aabd17a62df97fc",
+					"ttl": 0.05
+				}`))
+		})
+		It("queues the sysupgrade", func() {
+			Expect(deviceRecorder.Count()).To(Equal(0))
+			Expect(getState().State).To(Equal(ota.Queued))
+
+			_, raw := commandsRecorder.First()
+			Expect(raw.(*commands.StatusMessage).Status).To(Equal(commands.Queued))
+		})
+		It("delivers the sysupgrade when the device connects", func() {
+			m := devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName}
+			broker.Publish(context.Background(), devices.ConnectTopic.String(), m)
+
+			Expect(deviceRecorder.Count()).To(Equal(1))
+			Expect(getState().State).To(Equal(ota.Downloading))
+		})
+		It("sets an error when the sysupgrade expires", func() {
+			Eventually(func() interface{} { return getState().State }).Should(Equal(ota.Error))
+		})
+		It("drops the sysupgrade on cancel", func() {
+			broker.Publish(context.Background(), "armada/"+deviceName+"/ota/cancel", []byte("{}"))
+
+			Expect(getState().State).To(Equal(ota.Cancelled))
+			_, raw := commandsRecorder.Last()
+			Expect(raw.(*commands.StatusMessage).Status).To(Equal(commands.Cancelled))
+		})
+		It("keeps queued sysupgrades when registered again", func() {
+			ota.Register(mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test")), formations, cmds, logging.New("test"))
+			Expect(getState().State).To(Equal(ota.Queued))
+		})
+		It("fails queued sysupgrades that were lost on restart", func() {
+			// the command queue is not persisted
+			formations.Update(formationID, func(tx *devices.Tx) error {
+				commands.Slot.Delete(tx, formationID, deviceName)
+				return nil
+			})
+
+			ota.Register(mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test")), formations, cmds, logging.New("test"))
+			Expect(getState().State).To(Equal(ota.Error))
+			Expect(getState().Error).To(Equal("queued sysupgrade was lost on restart"))
+		})
+	})
 	Describe("on disconnect during download", func() {
 		BeforeEach(func() {
 			formations.Lock()
@@ -189,7 +272,7 @@ var _ = Describe("OTA Message Handler", func() {
 			formations.Unlock()
 
 			dm := devices.DisconnectMessage{FormationID: formationID, DeviceName: deviceName}
-			broker.Publish(devices.DisconnectTopic.String(), dm)
+			broker.Publish(context.Background(), devices.DisconnectTopic.String(), dm)
 		})
 		It("publishes an error message to the UI", func() {
 			Expect(uiRecorder.Count()).To(BeNumerically("==", 1))
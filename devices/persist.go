@@ -0,0 +1,200 @@
+package devices
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sync"
+
+	"github.com/superscale/spire/metrics"
+)
+
+// StateOp is the kind of a StateChange
+type StateOp int
+
+const (
+	// PutOp sets formation state (if DeviceName is empty) or device state
+	PutOp StateOp = iota
+	// DeleteOp removes formation state (if DeviceName is empty) or device state
+	DeleteOp
+	// AddDeviceOp assigns a device to a formation
+	AddDeviceOp
+	// RemoveDeviceOp removes all state of a device and its formation ID
+	RemoveDeviceOp
+	// RemoveFormationOp removes all state of a formation and its devices
+	RemoveFormationOp
+)
+
+// StateChange describes a change of persisted formation or device state
+type StateChange struct {
+	Op          StateOp
+	FormationID string
+	DeviceName  string
+	Key         string
+	Value       []byte // gob encoded value for PutOp
+}
+
+// StateJournal receives all changes of persisted state, e.g. to write them to a write-ahead log.
+// Record is called while the shard of the changed formation is locked for writing. Changes of formations
+// in different shards are recorded concurrently. It must not block.
+type StateJournal interface {
+	Record(change StateChange)
+}
+
+var (
+	stateTypesL sync.RWMutex
+	stateTypes  = make(map[string]func() interface{}) // state key -> constructor
+)
+
+func init() {
+	// types held by interface{} values in decoded JSON, e.g. in stations.WifiStation
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// RegisterStateType marks formation and device state stored under key as persistent. newValue returns
+// a pointer to a new value of the type that handlers store under key. Maps in that value should be
+// initialized, since empty maps are restored as they are returned by newValue. Values are encoded with
+// encoding/gob, so all exported fields are persisted regardless of their JSON tags.
+// Handlers call this from their init function.
+func RegisterStateType(key string, newValue func() interface{}) {
+	stateTypesL.Lock()
+	defer stateTypesL.Unlock()
+
+	stateTypes[key] = newValue
+}
+
+func stateType(key string) (func() interface{}, bool) {
+	stateTypesL.RLock()
+	defer stateTypesL.RUnlock()
+
+	newValue, exists := stateTypes[key]
+	return newValue, exists
+}
+
+// SetJournal sets the journal that receives changes of persisted state. Callers must hold the write lock.
+func (fm *FormationMap) SetJournal(journal StateJournal) {
+	fm.journal = journal
+}
+
+// Export returns PutOp and AddDeviceOp changes for all persisted state. Changes must be applied in the
+// returned order. Values that cannot be encoded are skipped. Callers must hold at least the read lock.
+func (fm *FormationMap) Export() []StateChange {
+	var changes []StateChange
+
+	for i := range fm.shards {
+		for formationID, formation := range fm.shards[i].m {
+			for key, value := range formation.state {
+				if c, ok := encodeChange(formationID, "", key, value); ok {
+					changes = append(changes, c)
+				}
+			}
+
+			for deviceName, state := range formation.devices {
+				for key, value := range state {
+					if c, ok := encodeChange(formationID, deviceName, key, value); ok {
+						changes = append(changes, c)
+					}
+				}
+			}
+		}
+	}
+
+	// after the device state, so that the formation IDs of devices are not overwritten
+	for deviceName, formationID := range fm.d {
+		changes = append(changes, StateChange{Op: AddDeviceOp, FormationID: formationID, DeviceName: deviceName})
+	}
+
+	return changes
+}
+
+// Apply applies a change exported by Export or recorded in a journal, e.g. when restoring state
+// on startup. The change is not recorded again. Callers must hold the write lock.
+func (fm *FormationMap) Apply(change StateChange) error {
+	journal := fm.journal
+	fm.journal = nil
+	defer func() { fm.journal = journal }()
+
+	switch change.Op {
+	case AddDeviceOp:
+		fm.AddDevice(change.DeviceName, change.FormationID)
+	case RemoveDeviceOp:
+		fm.removeDevice(change.FormationID, change.DeviceName)
+	case RemoveFormationOp:
+		fm.removeFormation(change.FormationID)
+	case DeleteOp:
+		if len(change.DeviceName) == 0 {
+			fm.DeleteState(change.FormationID, change.Key)
+		} else {
+			fm.DeleteDeviceState(change.FormationID, change.DeviceName, change.Key)
+		}
+	case PutOp:
+		value, err := decodeState(change.Key, change.Value)
+		if err != nil {
+			return err
+		}
+
+		if len(change.DeviceName) == 0 {
+			fm.PutState(change.FormationID, change.Key, value)
+		} else {
+			fm.PutDeviceState(change.FormationID, change.DeviceName, change.Key, value)
+		}
+	default:
+		return fmt.Errorf("unknown state change op %d", change.Op)
+	}
+	return nil
+}
+
+// record passes a change to the journal, if one is set and the key is persisted
+func (fm *FormationMap) record(op StateOp, formationID, deviceName, key string, value interface{}) {
+	if fm.journal == nil {
+		return
+	}
+
+	var c StateChange
+	switch op {
+	case AddDeviceOp, RemoveDeviceOp, RemoveFormationOp:
+		c = StateChange{Op: op, FormationID: formationID, DeviceName: deviceName}
+	case DeleteOp:
+		if _, persisted := stateType(key); !persisted {
+			return
+		}
+		c = StateChange{Op: op, FormationID: formationID, DeviceName: deviceName, Key: key}
+	case PutOp:
+		var ok bool
+		if c, ok = encodeChange(formationID, deviceName, key, value); !ok {
+			return
+		}
+	}
+
+	fm.journal.Record(c)
+}
+
+// encodeChange returns a PutOp change with value encoded. ok is false if state stored under key
+// is not persisted or value cannot be encoded.
+func encodeChange(formationID, deviceName, key string, value interface{}) (StateChange, bool) {
+	if _, persisted := stateType(key); !persisted || value == nil {
+		return StateChange{}, false
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		metrics.PersistenceErrors.WithLabelValues("encode").Inc()
+		return StateChange{}, false
+	}
+
+	return StateChange{Op: PutOp, FormationID: formationID, DeviceName: deviceName, Key: key, Value: buf.Bytes()}, true
+}
+
+func decodeState(key string, data []byte) (interface{}, error) {
+	newValue, exists := stateType(key)
+	if !exists {
+		return nil, fmt.Errorf("no state type registered for key %s", key)
+	}
+
+	value := newValue()
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(value); err != nil {
+		return nil, fmt.Errorf("cannot decode state %s: %v", key, err)
+	}
+	return value, nil
+}
@@ -1,17 +1,23 @@
 package ping
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/handlers"
 	"github.com/superscale/spire/mqtt"
 )
 
 // Key ...
 const Key = "ping"
 
+// StateSlot holds the ping statistics of a device, including the 24h loss averages
+var StateSlot = devices.NewDeviceSlot[*Message]("ping", Key).Persist(func() *Message { return new(Message) })
+
 // Stats ...
 type Stats struct {
 	Sent        int64   `json:"sent"`
@@ -44,42 +50,46 @@ type Message struct {
 type Handler struct {
 	broker     *mqtt.Broker
 	formations *devices.FormationMap
+	log        *logrus.Entry
+	router     *devices.Router
+}
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name:     "ping",
+		Register: handlers.Wrap(Register),
+	})
 }
 
 // Register ...
-func Register(broker *mqtt.Broker, formations *devices.FormationMap) interface{} {
-	h := &Handler{broker, formations}
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, logger *logrus.Entry) interface{} {
+	h := &Handler{broker: broker, formations: formations, log: logger, router: devices.NewRouter("ping")}
 
-	broker.Subscribe("pylon/+/wan/ping", h)
+	devices.Route(h.router, "pylon/+/wan/ping", h.onPingMessage)
+	h.router.Subscribe(broker, h)
 	return h
 }
 
 // HandleMessage ...
-func (h *Handler) HandleMessage(topic string, payload interface{}) error {
-	h.formations.Lock()
-	defer h.formations.Unlock()
+func (h *Handler) HandleMessage(ctx context.Context, topic string, payload interface{}) error {
+	return h.router.HandleMessage(ctx, topic, payload)
+}
 
-	buf, ok := payload.([]byte)
-	if !ok {
-		return fmt.Errorf("[ping] expected byte buffer, got this instead: %v", payload)
-	}
+func (h *Handler) onPingMessage(ctx context.Context, t devices.Topic, msg *Message) error {
+	deviceName := t.DeviceName
 
-	msg := new(Message)
-	if err := json.Unmarshal(buf, msg); err != nil {
-		return err
-	}
+	// publish a copy, the stored state may be updated by the next message while subscribers encode it
+	var published Message
+	h.formations.UpdateDevice(deviceName, func(tx *devices.Tx) error {
+		currentState, _ := StateSlot.Get(tx, deviceName)
 
-	deviceName := devices.ParseTopic(topic).DeviceName
-	var currentState *Message
-	rawState := h.formations.GetDeviceState(deviceName, Key)
-	if rawState != nil {
-		currentState = rawState.(*Message)
-	}
+		newState := updatePingState(currentState, msg)
+		StateSlot.Put(tx, tx.Formation(), deviceName, newState)
+		published = *newState
+		return nil
+	})
 
-	newState := updatePingState(currentState, msg)
-	formationID := h.formations.FormationID(deviceName)
-	h.formations.PutDeviceState(formationID, deviceName, Key, newState)
-	h.broker.Publish(fmt.Sprintf("matriarch/%s/wan/ping", deviceName), newState)
+	h.broker.Publish(ctx, fmt.Sprintf("matriarch/%s/wan/ping", deviceName), &published)
 	return nil
 }
 
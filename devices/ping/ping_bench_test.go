@@ -0,0 +1,53 @@
+package ping_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/ping"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/mqtt"
+)
+
+// BenchmarkPing publishes ping messages of devices in 1000 formations. Run with -cpu 1,2,4,8
+// to see how throughput scales with cores.
+func BenchmarkPing(b *testing.B) {
+	const numDevices = 1000
+
+	broker := mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("bench"))
+	formations := devices.NewFormationMap()
+	ping.Register(broker, formations, logging.New("bench"))
+
+	topics := make([]string, numDevices)
+	for i := range topics {
+		deviceName := fmt.Sprintf("%d.marsara", i)
+		topics[i] = fmt.Sprintf("pylon/%s/wan/ping", deviceName)
+
+		formations.Update(fmt.Sprintf("00000000-0000-0000-0000-%012d", i), func(tx *devices.Tx) error {
+			tx.AddDevice(deviceName)
+			return nil
+		})
+	}
+
+	payload := []byte(fmt.Sprintf(`{
+		"version": 1,
+		"timestamp": %d,
+		"gateway": {"ping": {"received": 1, "sent": 1}},
+		"internet": {"ping": {"received": 1, "sent": 1}, "dns": {"received": 1, "sent": 1}},
+		"tunnel": {"ping": {"received": 1, "sent": 1}}
+	}`, time.Now().Unix()))
+
+	var next uint64
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			topic := topics[atomic.AddUint64(&next, 1)%numDevices]
+			broker.Publish(context.Background(), topic, payload)
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package ping_test
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -8,6 +9,7 @@ import (
 	. "github.com/onsi/gomega"
 	"github.com/superscale/spire/devices"
 	"github.com/superscale/spire/devices/ping"
+	"github.com/superscale/spire/logging"
 	"github.com/superscale/spire/mqtt"
 	"github.com/superscale/spire/testutils"
 )
@@ -24,12 +26,12 @@ var _ = Describe("Ping Message Handler", func() {
 	var payload []byte
 
 	BeforeEach(func() {
-		broker = mqtt.NewBroker(false)
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
 		formations = devices.NewFormationMap()
 		recorder = testutils.NewPubSubRecorder()
 
 		broker.Subscribe(uiTopic, recorder)
-		ping.Register(broker, formations)
+		ping.Register(broker, formations, logging.New("test"))
 	})
 	Context("first ping message from this device", func() {
 		var firstPingTimestamp time.Time
@@ -70,7 +72,7 @@ var _ = Describe("Ping Message Handler", func() {
 				}
 			`, firstPingTimestamp.Unix()))
 
-			broker.Publish(deviceTopic, payload)
+			broker.Publish(context.Background(), deviceTopic, payload)
 		})
 		It("adds ping state to the device state", func() {
 			formations.RLock()
@@ -131,7 +133,7 @@ var _ = Describe("Ping Message Handler", func() {
 		})
 		Context("subsequent ping message from this device", func() {
 			JustBeforeEach(func() {
-				broker.Publish(deviceTopic, payload)
+				broker.Publish(context.Background(), deviceTopic, payload)
 
 				pl := `
 				{
@@ -164,7 +166,7 @@ var _ = Describe("Ping Message Handler", func() {
 				ts := firstPingTimestamp
 				for i := 0; i < 50; i++ {
 					ts = ts.Add(10 * time.Second)
-					broker.Publish(deviceTopic, []byte(fmt.Sprintf(pl, ts.Unix())))
+					broker.Publish(context.Background(), deviceTopic, []byte(fmt.Sprintf(pl, ts.Unix())))
 				}
 			})
 			It("keeps counts and calculates losses", func() {
@@ -0,0 +1,215 @@
+package presence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/handlers"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/metrics"
+	"github.com/superscale/spire/mqtt"
+)
+
+const presenceTopicPath = "presence"
+
+// event types
+const (
+	Connect    = "connect"
+	Disconnect = "disconnect"
+)
+
+// Event is a connect or disconnect of a device
+type Event struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason,omitempty"` // disconnect reason, e.g. devices.DisconnectTimeout
+}
+
+// History holds the latest connects and disconnects of a device, oldest first. Stored histories are never modified.
+type History struct {
+	Events   []Event `json:"events"`
+	Flapping bool    `json:"flapping"`
+	// Connects holds the times of the latest connects, up to the flap threshold, independent of the history size
+	Connects []time.Time `json:"connects"`
+}
+
+// Message is published on matriarch/<device>/presence after every connect and disconnect
+type Message struct {
+	State      string `json:"state"` // "up" or "down"
+	Flapping   bool   `json:"flapping"`
+	Reconnects int    `json:"reconnects"` // number of connects within the flap window, up to the flap threshold
+	Last       *Event `json:"last,omitempty"`
+}
+
+// Config ...
+type Config struct {
+	HistorySize   int           `env:"SPIRE_PRESENCE_HISTORY_SIZE"  envDefault:"50"  yaml:"history_size"`
+	FlapThreshold int           `env:"SPIRE_PRESENCE_FLAP_THRESHOLD"  envDefault:"5"  yaml:"flap_threshold"` // connects within the window
+	FlapWindow    time.Duration `env:"SPIRE_PRESENCE_FLAP_WINDOW"  envDefault:"10m"  yaml:"flap_window"`
+}
+
+// HistorySlot holds the presence history of a device
+var HistorySlot = devices.NewDeviceSlot[*History]("presence", "presence").Persist(func() *History { return new(History) })
+
+// Handler ...
+type Handler struct {
+	broker     *mqtt.Broker
+	formations *devices.FormationMap
+	config     *Config
+	log        *logrus.Entry
+	router     *devices.Router
+}
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name: "presence",
+		Register: func(deps handlers.Deps) (interface{}, error) {
+			return Register(deps.Broker, deps.Formations, deps.Logger, deps.Config.(*Config))
+		},
+		Config: func() interface{} { return new(Config) },
+	})
+}
+
+// Register ...
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, logger *logrus.Entry, cfg *Config) (interface{}, error) {
+	if cfg.HistorySize <= 0 || cfg.FlapThreshold <= 0 || cfg.FlapWindow <= 0 {
+		return nil, errors.New("history size, flap threshold and flap window must be positive")
+	}
+
+	h := &Handler{broker: broker, formations: formations, config: cfg, log: logger, router: devices.NewRouter("presence")}
+
+	devices.Route(h.router, devices.ConnectTopic.String(), h.onConnect)
+	devices.Route(h.router, devices.DisconnectTopic.String(), h.onDisconnect)
+	devices.Route(h.router, mqtt.SubscribeEventTopic, h.onSubscribeEvent)
+	h.router.Subscribe(broker, h)
+	return h, nil
+}
+
+// HandleMessage implements mqtt.Subscriber
+func (h *Handler) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	return h.router.HandleMessage(ctx, topic, message)
+}
+
+func (h *Handler) onConnect(ctx context.Context, _ devices.Topic, cm devices.ConnectMessage) error {
+	now := time.Now().UTC()
+
+	events := []Event{{Type: Connect, Time: now}}
+	if cm.Takeover {
+		events = []Event{{Type: Disconnect, Time: now, Reason: devices.DisconnectTakeover}, events[0]}
+	}
+
+	h.record(ctx, cm.FormationID, cm.DeviceName, events...)
+	return nil
+}
+
+func (h *Handler) onDisconnect(ctx context.Context, _ devices.Topic, dm devices.DisconnectMessage) error {
+	h.record(ctx, dm.FormationID, dm.DeviceName, Event{Type: Disconnect, Time: time.Now().UTC(), Reason: dm.Reason})
+	return nil
+}
+
+func (h *Handler) onSubscribeEvent(ctx context.Context, _ devices.Topic, sm mqtt.SubscribeMessage) error {
+	for _, topic := range sm.Topics {
+		t := devices.ParseTopic(topic)
+
+		if t.Prefix == "matriarch" && t.DeviceName != "+" && (t.Path == presenceTopicPath || t.Path == "#") {
+			var history *History
+			h.formations.ViewDevice(t.DeviceName, func(tx *devices.Tx) error {
+				history, _ = HistorySlot.Get(tx, t.DeviceName)
+				return nil
+			})
+			h.publish(ctx, t.DeviceName, history)
+		}
+	}
+	return nil
+}
+
+// record appends events to the history of the device and publishes its presence
+func (h *Handler) record(ctx context.Context, formationID, deviceName string, events ...Event) {
+	var history *History
+	var started bool
+
+	h.formations.Update(formationID, func(tx *devices.Tx) error {
+		old, ok := HistorySlot.Get(tx, deviceName)
+		if !ok {
+			old = new(History)
+		}
+
+		all := append(old.Events[:len(old.Events):len(old.Events)], events...)
+		if len(all) > h.config.HistorySize {
+			all = all[len(all)-h.config.HistorySize:]
+		}
+
+		connects := old.Connects[:len(old.Connects):len(old.Connects)]
+		for _, e := range events {
+			if e.Type == Connect {
+				connects = append(connects, e.Time)
+			}
+		}
+		if len(connects) > h.config.FlapThreshold {
+			connects = connects[len(connects)-h.config.FlapThreshold:]
+		}
+
+		history = &History{Events: all, Connects: connects}
+		history.Flapping = h.reconnects(history, events[len(events)-1].Time) >= h.config.FlapThreshold
+		started = history.Flapping && !old.Flapping
+
+		HistorySlot.Put(tx, formationID, deviceName, history)
+		return nil
+	})
+
+	if started {
+		metrics.PresenceFlaps.Inc()
+		logging.WithTrace(h.log, ctx).WithField(logging.DeviceKey, deviceName).Warn("device is flapping")
+	}
+
+	h.publish(ctx, deviceName, history)
+}
+
+// reconnects returns the number of connects within the flap window before now
+func (h *Handler) reconnects(history *History, now time.Time) (n int) {
+	since := now.Add(-h.config.FlapWindow)
+	for _, t := range history.Connects {
+		if !t.Before(since) {
+			n++
+		}
+	}
+	return
+}
+
+func (h *Handler) publish(ctx context.Context, deviceName string, history *History) {
+	msg := &Message{State: "down"}
+
+	if history != nil && len(history.Events) > 0 {
+		last := history.Events[len(history.Events)-1]
+		if last.Type == Connect {
+			msg.State = "up"
+		}
+
+		msg.Flapping = history.Flapping
+		msg.Reconnects = h.reconnects(history, time.Now().UTC())
+		msg.Last = &last
+	}
+
+	h.broker.Publish(ctx, fmt.Sprintf("matriarch/%s/%s", deviceName, presenceTopicPath), msg)
+}
+
+// DeviceHistory returns the presence history of deviceName. ok is false if the device is unknown.
+func DeviceHistory(formations *devices.FormationMap, deviceName string) (history *History, ok bool) {
+	if len(formations.FormationID(deviceName)) == 0 {
+		return nil, false
+	}
+
+	formations.ViewDevice(deviceName, func(tx *devices.Tx) error {
+		history, _ = HistorySlot.Get(tx, deviceName)
+		return nil
+	})
+
+	if history == nil {
+		history = &History{Events: []Event{}, Connects: []time.Time{}}
+	}
+	return history, true
+}
@@ -0,0 +1,14 @@
+package presence_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// TestPresence ...
+func TestPresence(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Spire Presence Suite")
+}
@@ -0,0 +1,121 @@
+package presence_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/presence"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("Presence Handler", func() {
+
+	var broker *mqtt.Broker
+	var formations *devices.FormationMap
+	var recorder *testutils.PubSubRecorder
+
+	var formationID = "00000000-0000-0000-0000-000000000001"
+	var deviceName = "1.marsara"
+
+	connect := func(takeover bool) {
+		cm := devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName, Takeover: takeover}
+		broker.Publish(context.Background(), devices.ConnectTopic.String(), cm)
+	}
+	disconnect := func(reason string) {
+		dm := devices.DisconnectMessage{FormationID: formationID, DeviceName: deviceName, Reason: reason}
+		broker.Publish(context.Background(), devices.DisconnectTopic.String(), dm)
+	}
+	lastMessage := func() *presence.Message {
+		_, raw := recorder.Last()
+		return raw.(*presence.Message)
+	}
+	history := func() *presence.History {
+		h, ok := presence.DeviceHistory(formations, deviceName)
+		Expect(ok).To(BeTrue())
+		return h
+	}
+
+	BeforeEach(func() {
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
+		formations = devices.NewFormationMap()
+		recorder = testutils.NewPubSubRecorder()
+
+		broker.Subscribe("matriarch/"+deviceName+"/presence", recorder)
+		_, err := presence.Register(broker, formations, logging.New("test"), &presence.Config{HistorySize: 4, FlapThreshold: 3, FlapWindow: time.Minute})
+		Expect(err).NotTo(HaveOccurred())
+
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			tx.AddDevice(deviceName)
+			return nil
+		})
+	})
+	It("records connects and disconnects with their reason", func() {
+		connect(false)
+		disconnect(devices.DisconnectTimeout)
+
+		events := history().Events
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].Type).To(Equal(presence.Connect))
+		Expect(events[1].Type).To(Equal(presence.Disconnect))
+		Expect(events[1].Reason).To(Equal(devices.DisconnectTimeout))
+	})
+	It("records takeovers as disconnects", func() {
+		connect(false)
+		connect(true)
+
+		events := history().Events
+		Expect(events).To(HaveLen(3))
+		Expect(events[1].Reason).To(Equal(devices.DisconnectTakeover))
+		Expect(events[2].Type).To(Equal(presence.Connect))
+	})
+	It("bounds the history", func() {
+		for i := 0; i < 3; i++ {
+			connect(false)
+			disconnect(devices.DisconnectEOF)
+		}
+
+		events := history().Events
+		Expect(events).To(HaveLen(4))
+		Expect(events[3].Type).To(Equal(presence.Disconnect))
+	})
+	It("publishes the presence of the device", func() {
+		connect(false)
+
+		msg := lastMessage()
+		Expect(msg.State).To(Equal("up"))
+		Expect(msg.Flapping).To(BeFalse())
+		Expect(msg.Reconnects).To(Equal(1))
+
+		disconnect(devices.DisconnectClean)
+		msg = lastMessage()
+		Expect(msg.State).To(Equal("down"))
+		Expect(msg.Last.Reason).To(Equal(devices.DisconnectClean))
+	})
+	It("detects flapping", func() {
+		connect(false)
+		disconnect(devices.DisconnectEOF)
+		connect(false)
+		Expect(lastMessage().Flapping).To(BeFalse())
+
+		disconnect(devices.DisconnectEOF)
+		connect(false)
+		Expect(lastMessage().Flapping).To(BeTrue())
+		Expect(history().Flapping).To(BeTrue())
+	})
+	It("publishes the presence on subscribe", func() {
+		connect(false)
+		broker.Publish(context.Background(), mqtt.SubscribeEventTopic, mqtt.SubscribeMessage{Topics: []string{"matriarch/" + deviceName + "/#"}})
+
+		Expect(recorder.Count()).To(Equal(2))
+		Expect(lastMessage().State).To(Equal("up"))
+	})
+	It("does not return the history of unknown devices", func() {
+		_, ok := presence.DeviceHistory(formations, "2.marsara")
+		Expect(ok).To(BeFalse())
+	})
+})
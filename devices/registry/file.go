@@ -0,0 +1,93 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// File is a device registry backed by a static JSON or YAML file that maps device names to device info, e.g.
+//
+//	1.marsara:
+//	  data:
+//	    current_system_image: {vendor: tplink, product: archer-c7, variant: lingrush, version: 44}
+//
+// Device info has the same shape as the response of liberator's /v2/devices/<name> endpoint.
+type File struct {
+	*Memory
+	path string
+}
+
+// NewFile reads the registry file at path. Files ending in .yaml or .yml are parsed as YAML, all others as JSON.
+func NewFile(path string) (*File, error) {
+	f := &File{Memory: NewMemory(), path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the registry file again and replaces all device info. It implements Reloader.
+func (f *File) Reload() error {
+	devices, err := readDevices(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	f.devices = devices
+	return nil
+}
+
+func readDevices(path string) (map[string]map[string]interface{}, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read device registry: %v", err)
+	}
+
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		if buf, err = yamlToJSON(buf); err != nil {
+			return nil, fmt.Errorf("cannot parse device registry %s: %v", path, err)
+		}
+	}
+
+	devices := make(map[string]map[string]interface{})
+	if err := json.Unmarshal(buf, &devices); err != nil {
+		return nil, fmt.Errorf("cannot parse device registry %s: %v", path, err)
+	}
+	return devices, nil
+}
+
+// yamlToJSON converts YAML to JSON so that device info from YAML files
+// has the same types (e.g. float64 for numbers) as device info from liberator
+func yamlToJSON(buf []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(buf, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(stringKeys(v))
+}
+
+// stringKeys converts the map[interface{}]interface{} values produced by the YAML decoder to map[string]interface{}
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[fmt.Sprint(k)] = stringKeys(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = stringKeys(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,29 @@
+package registry
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/liberator"
+)
+
+// Reloader is implemented by registries that can re-read their device data, e.g. on SIGHUP
+type Reloader interface {
+	Reload() error
+}
+
+// FromConfig returns the device registry selected via SPIRE_DEVICE_REGISTRY
+func FromConfig(params *config.Params, logger *logrus.Entry) (devices.DeviceRegistry, error) {
+	switch params.DeviceRegistry {
+	case "liberator":
+		return liberator.NewClient(liberator.OptionsFromConfig(params), logger), nil
+	case "file":
+		return NewFile(params.DeviceRegistryFile)
+	case "memory":
+		return newMemoryFromFile(params.DeviceRegistryFile)
+	default:
+		return nil, fmt.Errorf("unknown device registry %q", params.DeviceRegistry)
+	}
+}
@@ -0,0 +1,149 @@
+package registry_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/devices/registry"
+	"github.com/superscale/spire/liberator"
+	"github.com/superscale/spire/logging"
+)
+
+var _ = Describe("Device Registry", func() {
+
+	var deviceName = "1.marsara"
+
+	Describe("memory", func() {
+		var reg *registry.Memory
+
+		BeforeEach(func() {
+			reg = registry.NewMemory()
+			reg.Put(deviceName, map[string]interface{}{"data": "foo"})
+		})
+		It("returns device info of known devices", func() {
+			info, stale, err := reg.DeviceInfo(context.Background(), deviceName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stale).To(BeFalse())
+			Expect(info["data"]).To(Equal("foo"))
+		})
+		It("rejects unknown devices", func() {
+			reg.Remove(deviceName)
+			_, _, err := reg.DeviceInfo(context.Background(), deviceName)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("file", func() {
+		var dir, path string
+		var reg *registry.File
+		var err error
+
+		write := func(content string) {
+			Expect(ioutil.WriteFile(path, []byte(content), 0644)).NotTo(HaveOccurred())
+		}
+
+		BeforeEach(func() {
+			dir, err = ioutil.TempDir("", "spire-registry")
+			Expect(err).NotTo(HaveOccurred())
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+		Context("in YAML", func() {
+			BeforeEach(func() {
+				path = filepath.Join(dir, "devices.yaml")
+				write(`
+1.marsara:
+  data:
+    current_system_image: {vendor: tplink, product: archer-c7, variant: lingrush, version: 44}
+`)
+				reg, err = registry.NewFile(path)
+				Expect(err).NotTo(HaveOccurred())
+			})
+			It("returns device info in the same shape as liberator", func() {
+				info, _, err := reg.DeviceInfo(context.Background(), deviceName)
+				Expect(err).NotTo(HaveOccurred())
+
+				sysimg := info["data"].(map[string]interface{})["current_system_image"].(map[string]interface{})
+				Expect(sysimg["vendor"]).To(Equal("tplink"))
+				Expect(sysimg["version"]).To(Equal(float64(44)))
+			})
+			It("rejects unknown devices", func() {
+				_, _, err := reg.DeviceInfo(context.Background(), "2.marsara")
+				Expect(err).To(HaveOccurred())
+			})
+			It("reloads the file", func() {
+				write(`2.marsara: {data: {}}`)
+				Expect(reg.Reload()).NotTo(HaveOccurred())
+
+				_, _, err := reg.DeviceInfo(context.Background(), deviceName)
+				Expect(err).To(HaveOccurred())
+				_, _, err = reg.DeviceInfo(context.Background(), "2.marsara")
+				Expect(err).NotTo(HaveOccurred())
+			})
+			It("keeps the current devices if the file is invalid", func() {
+				write(`[not, a, map]`)
+				Expect(reg.Reload()).To(HaveOccurred())
+
+				_, _, err := reg.DeviceInfo(context.Background(), deviceName)
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+		Context("in JSON", func() {
+			BeforeEach(func() {
+				path = filepath.Join(dir, "devices.json")
+				write(`{"1.marsara": {"data": {"name": "marsara"}}}`)
+				reg, err = registry.NewFile(path)
+				Expect(err).NotTo(HaveOccurred())
+			})
+			It("returns device info of known devices", func() {
+				info, _, err := reg.DeviceInfo(context.Background(), deviceName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info["data"]).To(HaveKeyWithValue("name", "marsara"))
+			})
+		})
+		It("fails if the file does not exist", func() {
+			_, err := registry.NewFile(filepath.Join(dir, "nope.json"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("from config", func() {
+		It("selects the liberator registry", func() {
+			reg, err := registry.FromConfig(&config.Params{DeviceRegistry: "liberator"}, logging.New("test"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reg).To(BeAssignableToTypeOf(&liberator.Client{}))
+		})
+		It("selects an empty memory registry", func() {
+			reg, err := registry.FromConfig(&config.Params{DeviceRegistry: "memory"}, logging.New("test"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = reg.DeviceInfo(context.Background(), "1.marsara")
+			Expect(err).To(MatchError("unknown device 1.marsara"))
+		})
+		It("seeds the memory registry from the registry file", func() {
+			f, err := ioutil.TempFile("", "spire-registry-*.json")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(f.Name())
+
+			_, err = f.WriteString(`{"1.marsara": {"data": {}}}`)
+			Expect(err).NotTo(HaveOccurred())
+			f.Close()
+
+			reg, err := registry.FromConfig(&config.Params{DeviceRegistry: "memory", DeviceRegistryFile: f.Name()}, logging.New("test"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reg).To(BeAssignableToTypeOf(&registry.Memory{}))
+
+			info, _, err := reg.DeviceInfo(context.Background(), "1.marsara")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info).To(HaveKey("data"))
+		})
+		It("fails for unknown registries", func() {
+			_, err := registry.FromConfig(&config.Params{DeviceRegistry: "ldap"}, logging.New("test"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
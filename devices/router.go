@@ -0,0 +1,120 @@
+package devices
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/superscale/spire/metrics"
+	"github.com/superscale/spire/mqtt"
+)
+
+// Router dispatches the messages of a handler to typed callbacks by topic pattern. Handlers create one
+// in Register, subscribe with Router.Subscribe and pass their messages to Router.HandleMessage.
+type Router struct {
+	name   string
+	routes []route
+}
+
+type route struct {
+	pattern string
+	device  bool // whether the pattern has a device name segment, e.g. "pylon/+/wifi/poll"
+	handle  func(ctx context.Context, t Topic, message interface{}) error
+}
+
+// DecodeError is returned for messages that cannot be decoded into the type expected by a route
+type DecodeError struct {
+	Handler string
+	Topic   string
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("[%s] cannot decode message on %s: %v", e.Handler, e.Topic, e.Err)
+}
+
+// TopicError is returned for messages on topics that match a route but lack the device name or path
+type TopicError struct {
+	Handler string
+	Topic   string
+}
+
+func (e *TopicError) Error() string {
+	return fmt.Sprintf("[%s] invalid topic %s", e.Handler, e.Topic)
+}
+
+// NewRouter returns a router. name is used in errors and metrics, e.g. "stations".
+func NewRouter(name string) *Router {
+	return &Router{name: name}
+}
+
+// Route registers fn for topics matching pattern, e.g. "pylon/+/wifi/poll". []byte payloads are decoded
+// from JSON into T, unless T is []byte. Payloads that are of type T already (e.g. ConnectMessage) are
+// passed on as they are. Routes are matched in the order they are registered.
+func Route[T any](r *Router, pattern string, fn func(ctx context.Context, t Topic, msg T) error) {
+	p := ParseTopic(pattern)
+
+	r.routes = append(r.routes, route{
+		pattern: pattern,
+		device:  p.DeviceName == "+",
+		handle: func(ctx context.Context, t Topic, message interface{}) error {
+			msg, err := decode[T](message)
+			if err != nil {
+				metrics.DecodeErrors.WithLabelValues(r.name).Inc()
+				return &DecodeError{Handler: r.name, Topic: t.String(), Err: err}
+			}
+			return fn(ctx, t, msg)
+		},
+	})
+}
+
+// Subscribe subscribes s to the patterns of all routes
+func (r *Router) Subscribe(broker *mqtt.Broker, s mqtt.Subscriber) {
+	for _, rt := range r.routes {
+		broker.Subscribe(rt.pattern, s)
+	}
+}
+
+// HandleMessage calls the first route that matches topic. Messages on other topics are ignored.
+func (r *Router) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	topic = strings.TrimPrefix(topic, "/")
+
+	for _, rt := range r.routes {
+		if len(mqtt.MatchTopics(topic, []string{rt.pattern})) == 0 {
+			continue
+		}
+
+		t := ParseTopic(topic)
+		if rt.device && (len(t.DeviceName) == 0 || len(t.Path) == 0) {
+			return &TopicError{Handler: r.name, Topic: topic}
+		}
+		return rt.handle(ctx, t, message)
+	}
+	return nil
+}
+
+func decode[T any](message interface{}) (T, error) {
+	var msg T
+	if m, ok := message.(T); ok {
+		return m, nil
+	}
+
+	buf, ok := message.([]byte)
+	if !ok {
+		return msg, fmt.Errorf("expected %T or a JSON payload, got %T", msg, message)
+	}
+
+	// allocate the value pointer types point to, e.g. for *WifiPollMessage
+	if t := reflect.TypeOf(msg); t != nil && t.Kind() == reflect.Ptr {
+		v := reflect.New(t.Elem())
+		if err := json.Unmarshal(buf, v.Interface()); err != nil {
+			return msg, err
+		}
+		return v.Interface().(T), nil
+	}
+
+	err := json.Unmarshal(buf, &msg)
+	return msg, err
+}
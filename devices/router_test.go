@@ -0,0 +1,78 @@
+package devices_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/devices"
+)
+
+type routedMessage struct {
+	Count int `json:"count"`
+}
+
+var _ = Describe("Router", func() {
+
+	var router *devices.Router
+	var topic devices.Topic
+	var received interface{}
+
+	BeforeEach(func() {
+		router = devices.NewRouter("test")
+		topic, received = devices.Topic{}, nil
+
+		devices.Route(router, "pylon/+/count", func(_ context.Context, t devices.Topic, msg *routedMessage) error {
+			topic, received = t, msg
+			return nil
+		})
+		devices.Route(router, "pylon/+/raw/#", func(_ context.Context, t devices.Topic, msg []byte) error {
+			topic, received = t, msg
+			return nil
+		})
+		devices.Route(router, devices.ConnectTopic.String(), func(_ context.Context, t devices.Topic, msg devices.ConnectMessage) error {
+			topic, received = t, msg
+			return nil
+		})
+	})
+	It("decodes JSON payloads", func() {
+		Expect(router.HandleMessage(context.Background(), "pylon/1.marsara/count", []byte(`{"count": 23}`))).To(Succeed())
+
+		Expect(topic).To(Equal(devices.Topic{Prefix: "pylon", DeviceName: "1.marsara", Path: "count"}))
+		Expect(received).To(Equal(&routedMessage{Count: 23}))
+	})
+	It("passes on raw payloads", func() {
+		Expect(router.HandleMessage(context.Background(), "/pylon/1.marsara/raw/data", []byte("raw"))).To(Succeed())
+
+		Expect(topic.Path).To(Equal("raw/data"))
+		Expect(received).To(Equal([]byte("raw")))
+	})
+	It("passes on typed messages", func() {
+		cm := devices.ConnectMessage{FormationID: "1", DeviceName: "1.marsara"}
+		Expect(router.HandleMessage(context.Background(), devices.ConnectTopic.String(), cm)).To(Succeed())
+
+		Expect(received).To(Equal(cm))
+	})
+	It("ignores topics without a route", func() {
+		Expect(router.HandleMessage(context.Background(), "pylon/1.marsara/other", []byte("{}"))).To(Succeed())
+		Expect(received).To(BeNil())
+	})
+	It("reports payloads that cannot be decoded", func() {
+		err := router.HandleMessage(context.Background(), "pylon/1.marsara/count", []byte("not json"))
+
+		decodeErr, ok := err.(*devices.DecodeError)
+		Expect(ok).To(BeTrue())
+		Expect(decodeErr.Handler).To(Equal("test"))
+		Expect(decodeErr.Topic).To(Equal("pylon/1.marsara/count"))
+		Expect(received).To(BeNil())
+	})
+	It("reports messages of the wrong type", func() {
+		err := router.HandleMessage(context.Background(), devices.ConnectTopic.String(), 23)
+		Expect(err).To(BeAssignableToTypeOf(&devices.DecodeError{}))
+	})
+	It("rejects topics without device name", func() {
+		err := router.HandleMessage(context.Background(), "pylon//count", []byte(`{"count": 23}`))
+		Expect(err).To(BeAssignableToTypeOf(&devices.TopicError{}))
+		Expect(received).To(BeNil())
+	})
+})
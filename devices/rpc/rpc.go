@@ -0,0 +1,267 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/handlers"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/metrics"
+	"github.com/superscale/spire/mqtt"
+)
+
+// ReplyPath is the path devices publish replies on, i.e. "pylon/<device>/rpc/reply"
+const ReplyPath = "rpc/reply"
+
+// errors returned to control clients in Reply.Error
+const (
+	// ErrDeviceOffline is returned if the device is not connected or disconnects before it replies
+	ErrDeviceOffline = "device_offline"
+	// ErrTimeout is returned if the device does not reply in time
+	ErrTimeout = "timeout"
+	// ErrTooManyRequests is returned if the device has too many requests in flight
+	ErrTooManyRequests = "too_many_requests"
+	// ErrInvalidRequest is returned for requests with invalid methods
+	ErrInvalidRequest = "invalid_request"
+)
+
+// Request is published by control clients on armada/<device>/rpc/<method>
+type Request struct {
+	ID      string          `json:"id"`                   // correlation ID chosen by the client
+	ReplyTo string          `json:"reply_to"`             // topic for the reply. defaults to matriarch/<device>/rpc/<method>/reply
+	Params  json.RawMessage `json:"params,omitempty"`     // passed on to the device
+	Timeout int64           `json:"timeout_ms,omitempty"` // capped at the configured timeout
+}
+
+// DeviceRequest is forwarded to pylon/<device>/rpc/<method>. ID is chosen by spire.
+type DeviceRequest struct {
+	ID     string          `json:"id"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Reply is published by devices on pylon/<device>/rpc/reply with the ID of the DeviceRequest, and
+// forwarded to the client with the ID of its Request. Error is set by the device or by spire.
+type Reply struct {
+	ID     string          `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Config ...
+type Config struct {
+	Timeout     time.Duration `env:"SPIRE_RPC_TIMEOUT"  envDefault:"30s"  yaml:"timeout"`
+	MaxInFlight int           `env:"SPIRE_RPC_MAX_IN_FLIGHT"  envDefault:"8"  yaml:"max_in_flight"` // per device
+}
+
+// call is a request that was forwarded to a device and waits for its reply
+type call struct {
+	clientID   string
+	replyTo    string
+	deviceName string
+	method     string
+	start      time.Time
+	timer      *time.Timer
+}
+
+// Handler ...
+type Handler struct {
+	broker     *mqtt.Broker
+	formations *devices.FormationMap
+	config     *Config
+	log        *logrus.Entry
+	router     *devices.Router
+
+	l        sync.Mutex
+	calls    map[string]*call // device request ID -> call
+	inFlight map[string]int   // device name -> number of calls
+}
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name: "rpc",
+		Register: func(deps handlers.Deps) (interface{}, error) {
+			return Register(deps.Broker, deps.Formations, deps.Logger, deps.Config.(*Config))
+		},
+		Config: func() interface{} { return new(Config) },
+	})
+}
+
+// Register ...
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, logger *logrus.Entry, cfg *Config) (interface{}, error) {
+	if cfg.Timeout <= 0 || cfg.MaxInFlight <= 0 {
+		return nil, errors.New("timeout and max in flight must be positive")
+	}
+
+	h := &Handler{
+		broker:     broker,
+		formations: formations,
+		config:     cfg,
+		log:        logger,
+		router:     devices.NewRouter("rpc"),
+		calls:      make(map[string]*call),
+		inFlight:   make(map[string]int),
+	}
+
+	devices.Route(h.router, "pylon/+/"+ReplyPath, h.onReply)
+	devices.Route(h.router, "armada/+/rpc/#", h.onRequest)
+	devices.Route(h.router, devices.DisconnectTopic.String(), h.onDisconnect)
+	h.router.Subscribe(broker, h)
+	return h, nil
+}
+
+// HandleMessage ...
+func (h *Handler) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	return h.router.HandleMessage(ctx, topic, message)
+}
+
+func (h *Handler) onRequest(ctx context.Context, t devices.Topic, req *Request) error {
+	// armada/<device>/rpc is matched by the route as well, and has no method
+	var method string
+	if strings.HasPrefix(t.Path, "rpc/") {
+		method = strings.TrimPrefix(t.Path, "rpc/")
+	}
+
+	if len(req.ID) == 0 {
+		return fmt.Errorf("[rpc] request for %s on %s without id", method, t.DeviceName)
+	}
+
+	if len(req.ReplyTo) == 0 {
+		req.ReplyTo = fmt.Sprintf("matriarch/%s/rpc/%s/reply", t.DeviceName, method)
+	} else if !strings.HasPrefix(req.ReplyTo, "matriarch/") {
+		return fmt.Errorf("[rpc] reply_to must start with matriarch/, got %s", req.ReplyTo)
+	}
+
+	if len(method) == 0 || strings.Contains(method, "/") || "rpc/"+method == ReplyPath {
+		h.reply(ctx, req.ReplyTo, Reply{ID: req.ID, Error: ErrInvalidRequest}, "invalid")
+		return nil
+	}
+
+	if !h.connected(t.DeviceName) {
+		h.reply(ctx, req.ReplyTo, Reply{ID: req.ID, Error: ErrDeviceOffline}, "offline")
+		return nil
+	}
+
+	timeout := h.config.Timeout
+	if req.Timeout > 0 && time.Duration(req.Timeout)*time.Millisecond < timeout {
+		timeout = time.Duration(req.Timeout) * time.Millisecond
+	}
+
+	id := newID()
+	c := &call{
+		clientID:   req.ID,
+		replyTo:    req.ReplyTo,
+		deviceName: t.DeviceName,
+		method:     method,
+		start:      time.Now(),
+	}
+
+	h.l.Lock()
+	if h.inFlight[t.DeviceName] >= h.config.MaxInFlight {
+		h.l.Unlock()
+		h.reply(ctx, req.ReplyTo, Reply{ID: req.ID, Error: ErrTooManyRequests}, "rejected")
+		return nil
+	}
+
+	h.calls[id] = c
+	h.inFlight[t.DeviceName]++
+	c.timer = time.AfterFunc(timeout, func() { h.expire(id) })
+	h.l.Unlock()
+
+	h.broker.Publish(ctx, fmt.Sprintf("pylon/%s/rpc/%s", t.DeviceName, method), &DeviceRequest{ID: id, Params: req.Params})
+	return nil
+}
+
+func (h *Handler) onReply(ctx context.Context, t devices.Topic, reply *Reply) error {
+	h.l.Lock()
+	c, exists := h.calls[reply.ID]
+	if !exists || c.deviceName != t.DeviceName {
+		h.l.Unlock()
+		logging.WithTrace(h.log, ctx).WithField(logging.DeviceKey, t.DeviceName).WithField("id", reply.ID).Debug("ignoring reply to unknown request")
+		return nil
+	}
+	h.finish(reply.ID, c)
+	h.l.Unlock()
+
+	result := "ok"
+	if len(reply.Error) > 0 {
+		result = "error"
+	}
+
+	h.reply(ctx, c.replyTo, Reply{ID: c.clientID, Result: reply.Result, Error: reply.Error}, result)
+	metrics.RPCDuration.WithLabelValues(c.method).Observe(time.Since(c.start).Seconds())
+	return nil
+}
+
+// onDisconnect fails the calls of the device
+func (h *Handler) onDisconnect(ctx context.Context, _ devices.Topic, dm devices.DisconnectMessage) error {
+	var failed []*call
+
+	h.l.Lock()
+	for id, c := range h.calls {
+		if c.deviceName == dm.DeviceName {
+			h.finish(id, c)
+			failed = append(failed, c)
+		}
+	}
+	h.l.Unlock()
+
+	for _, c := range failed {
+		h.reply(ctx, c.replyTo, Reply{ID: c.clientID, Error: ErrDeviceOffline}, "offline")
+	}
+	return nil
+}
+
+// expire fails a call that the device did not reply to in time
+func (h *Handler) expire(id string) {
+	h.l.Lock()
+	c, exists := h.calls[id]
+	if !exists {
+		h.l.Unlock()
+		return
+	}
+	h.finish(id, c)
+	h.l.Unlock()
+
+	h.reply(context.Background(), c.replyTo, Reply{ID: c.clientID, Error: ErrTimeout}, "timeout")
+}
+
+// finish removes a call. Callers must hold h.l.
+func (h *Handler) finish(id string, c *call) {
+	c.timer.Stop()
+	delete(h.calls, id)
+
+	if h.inFlight[c.deviceName]--; h.inFlight[c.deviceName] <= 0 {
+		delete(h.inFlight, c.deviceName)
+	}
+}
+
+func (h *Handler) reply(ctx context.Context, topic string, reply Reply, result string) {
+	metrics.RPCRequests.WithLabelValues(result).Inc()
+	h.broker.Publish(ctx, topic, &reply)
+}
+
+func (h *Handler) connected(deviceName string) (connected bool) {
+	h.formations.ViewDevice(deviceName, func(tx *devices.Tx) error {
+		lc, ok := devices.LifecycleSlot.Get(tx, deviceName)
+		connected = ok && lc.Connected()
+		return nil
+	})
+	return
+}
+
+func newID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,186 @@
+package rpc_test
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/rpc"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("RPC Handler", func() {
+
+	var broker *mqtt.Broker
+	var formations *devices.FormationMap
+	var clientRecorder, deviceRecorder *testutils.PubSubRecorder
+	var cfg *rpc.Config
+
+	var formationID = "00000000-0000-0000-0000-000000000001"
+	var deviceName = "1.marsara"
+	var requestTopic = "armada/" + deviceName + "/rpc/reboot"
+	var replyTopic = "matriarch/" + deviceName + "/rpc/reboot/reply"
+
+	request := func(id string) {
+		broker.Publish(context.Background(), requestTopic, []byte(`{"id": "`+id+`", "params": {"delay": 5}}`))
+	}
+	clientReply := func(i int) *rpc.Reply {
+		_, raw := clientRecorder.Get(i)
+		reply, ok := raw.(*rpc.Reply)
+		Expect(ok).To(BeTrue())
+		return reply
+	}
+
+	BeforeEach(func() {
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
+		formations = devices.NewFormationMap()
+		clientRecorder = testutils.NewPubSubRecorder()
+		deviceRecorder = testutils.NewPubSubRecorder()
+		cfg = &rpc.Config{Timeout: time.Second, MaxInFlight: 2}
+
+		broker.Subscribe(replyTopic, clientRecorder)
+		broker.Subscribe("pylon/"+deviceName+"/rpc/reboot", deviceRecorder)
+	})
+	JustBeforeEach(func() {
+		_, err := rpc.Register(broker, formations, logging.New("test"), cfg)
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("rejects invalid configurations", func() {
+		_, err := rpc.Register(broker, formations, logging.New("test"), &rpc.Config{})
+		Expect(err).To(HaveOccurred())
+	})
+	Describe("with a connected device", func() {
+		BeforeEach(func() {
+			formations.Update(formationID, func(tx *devices.Tx) error {
+				tx.AddDevice(deviceName)
+				devices.LifecycleSlot.Put(tx, formationID, deviceName, &devices.Lifecycle{ConnectedAt: time.Now()})
+				return nil
+			})
+		})
+		It("forwards requests to the device", func() {
+			request("abc")
+
+			Expect(deviceRecorder.Count()).To(Equal(1))
+			_, raw := deviceRecorder.First()
+			req, ok := raw.(*rpc.DeviceRequest)
+			Expect(ok).To(BeTrue())
+			Expect(req.ID).NotTo(BeEmpty())
+			Expect(req.ID).NotTo(Equal("abc"))
+			Expect(req.Params).To(MatchJSON(`{"delay": 5}`))
+		})
+		It("routes the reply back to the client", func() {
+			request("abc")
+			_, raw := deviceRecorder.First()
+			id := raw.(*rpc.DeviceRequest).ID
+
+			broker.Publish(context.Background(), "pylon/"+deviceName+"/rpc/reply", []byte(`{"id": "`+id+`", "result": {"rebooting": true}}`))
+
+			Expect(clientRecorder.Count()).To(Equal(1))
+			reply := clientReply(0)
+			Expect(reply.ID).To(Equal("abc"))
+			Expect(reply.Error).To(BeEmpty())
+			Expect(reply.Result).To(MatchJSON(`{"rebooting": true}`))
+		})
+		It("publishes replies on reply_to", func() {
+			recorder := testutils.NewPubSubRecorder()
+			broker.Subscribe("matriarch/custom/reply", recorder)
+
+			broker.Publish(context.Background(), requestTopic, []byte(`{"id": "abc", "reply_to": "matriarch/custom/reply"}`))
+			_, raw := deviceRecorder.First()
+			id := raw.(*rpc.DeviceRequest).ID
+			broker.Publish(context.Background(), "pylon/"+deviceName+"/rpc/reply", []byte(`{"id": "`+id+`"}`))
+
+			Expect(recorder.Count()).To(Equal(1))
+			Expect(clientRecorder.Count()).To(Equal(0))
+		})
+		It("ignores replies from other devices", func() {
+			request("abc")
+			_, raw := deviceRecorder.First()
+			id := raw.(*rpc.DeviceRequest).ID
+
+			broker.Publish(context.Background(), "pylon/2.marsara/rpc/reply", []byte(`{"id": "`+id+`"}`))
+			Expect(clientRecorder.Count()).To(Equal(0))
+		})
+		It("ignores requests without id", func() {
+			broker.Publish(context.Background(), requestTopic, []byte(`{}`))
+			Expect(deviceRecorder.Count()).To(Equal(0))
+		})
+		It("rejects the reserved reply method", func() {
+			recorder := testutils.NewPubSubRecorder()
+			broker.Subscribe("matriarch/"+deviceName+"/rpc/reply/reply", recorder)
+
+			broker.Publish(context.Background(), "armada/"+deviceName+"/rpc/reply", []byte(`{"id": "abc"}`))
+
+			Expect(recorder.Count()).To(Equal(1))
+			_, raw := recorder.First()
+			Expect(raw.(*rpc.Reply).Error).To(Equal(rpc.ErrInvalidRequest))
+		})
+		It("rejects requests without method", func() {
+			recorder := testutils.NewPubSubRecorder()
+			broker.Subscribe("matriarch/"+deviceName+"/rpc/client", recorder)
+
+			broker.Publish(context.Background(), "armada/"+deviceName+"/rpc", []byte(`{"id": "abc", "reply_to": "matriarch/`+deviceName+`/rpc/client"}`))
+
+			Expect(deviceRecorder.Count()).To(Equal(0))
+			Expect(recorder.Count()).To(Equal(1))
+			_, raw := recorder.First()
+			Expect(raw.(*rpc.Reply).Error).To(Equal(rpc.ErrInvalidRequest))
+		})
+		It("limits the number of requests in flight", func() {
+			request("1")
+			request("2")
+			request("3")
+
+			Expect(deviceRecorder.Count()).To(Equal(2))
+			Expect(clientRecorder.Count()).To(Equal(1))
+			reply := clientReply(0)
+			Expect(reply.ID).To(Equal("3"))
+			Expect(reply.Error).To(Equal(rpc.ErrTooManyRequests))
+		})
+		It("replies with an error if the device disconnects", func() {
+			request("abc")
+			broker.Publish(context.Background(), devices.DisconnectTopic.String(), devices.DisconnectMessage{FormationID: formationID, DeviceName: deviceName})
+
+			Expect(clientRecorder.Count()).To(Equal(1))
+			reply := clientReply(0)
+			Expect(reply.ID).To(Equal("abc"))
+			Expect(reply.Error).To(Equal(rpc.ErrDeviceOffline))
+		})
+		Describe("with a short timeout", func() {
+			BeforeEach(func() {
+				cfg.Timeout = 10 * time.Millisecond
+			})
+			It("replies with an error if the device does not reply", func() {
+				request("abc")
+
+				Eventually(clientRecorder.Count).Should(Equal(1))
+				reply := clientReply(0)
+				Expect(reply.ID).To(Equal("abc"))
+				Expect(reply.Error).To(Equal(rpc.ErrTimeout))
+			})
+			It("frees the slot of the request", func() {
+				request("1")
+				request("2")
+				Eventually(clientRecorder.Count).Should(Equal(2))
+
+				request("3")
+				Expect(deviceRecorder.Count()).To(Equal(3))
+			})
+		})
+	})
+	It("replies with an error if the device is offline", func() {
+		request("abc")
+
+		Expect(deviceRecorder.Count()).To(Equal(0))
+		Expect(clientRecorder.Count()).To(Equal(1))
+
+		buf, err := json.Marshal(clientReply(0))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(buf).To(MatchJSON(`{"id": "abc", "error": "device_offline"}`))
+	})
+})
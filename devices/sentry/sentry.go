@@ -1,8 +1,9 @@
 package sentry
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -11,14 +12,18 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
-	"github.com/superscale/spire/config"
+	"github.com/sirupsen/logrus"
 	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/handlers"
 	"github.com/superscale/spire/mqtt"
 )
 
 // ForwardedIP is the key used for storing/retrieving the public IP address of a device
 const ForwardedIP = "forwarded_ip"
 
+// forwardedIPSlot holds the public IP address of a device
+var forwardedIPSlot = devices.NewDeviceSlot[string]("sentry", ForwardedIP)
+
 // Message ...
 type Message struct {
 	IP        string    `json:"ip"`
@@ -26,55 +31,76 @@ type Message struct {
 	Timestamp time.Time `json:"timestamp"`
 }
 
+// Config ...
+type Config struct {
+	DynamoDBTable string `env:"SPIRE_SENTRY_DYNAMODB_TABLE,required"  yaml:"dynamodb_table"`
+	AWSRegion     string `env:"SPIRE_SENTRY_AWS_REGION"  envDefault:"eu-west-1"  yaml:"aws_region"`
+}
+
 // Handler ...
 type Handler struct {
 	formations     *devices.FormationMap
 	awsSession     *session.Session
 	dynamoDBClient dynamodbiface.DynamoDBAPI
+	tableName      string
+	log            *logrus.Entry
+	router         *devices.Router
+}
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name: "sentry",
+		Register: func(deps handlers.Deps) (interface{}, error) {
+			return Register(deps.Broker, deps.Formations, deps.Logger, deps.Config.(*Config))
+		},
+		Config: func() interface{} { return new(Config) },
+	})
 }
 
 // Register ...
-func Register(broker *mqtt.Broker, formations *devices.FormationMap) interface{} {
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(endpoints.EuWest1RegionID),
-	}))
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, logger *logrus.Entry, cfg *Config) (interface{}, error) {
+	if len(cfg.DynamoDBTable) == 0 {
+		return nil, errors.New("DynamoDB table name not set")
+	}
+
+	region := cfg.AWSRegion
+	if len(region) == 0 {
+		region = endpoints.EuWest1RegionID
+	}
+
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
 
 	h := &Handler{
 		formations:     formations,
 		awsSession:     sess,
 		dynamoDBClient: dynamodb.New(sess),
+		tableName:      cfg.DynamoDBTable,
+		log:            logger,
+		router:         devices.NewRouter("sentry"),
 	}
 
-	broker.Subscribe(devices.ConnectTopic.String(), h)
-	broker.Subscribe("pylon/+/sentry/accept", h)
-	return h
+	devices.Route(h.router, devices.ConnectTopic.String(), h.onConnect)
+	devices.Route(h.router, "pylon/+/sentry/accept", h.onMessage)
+	h.router.Subscribe(broker, h)
+	return h, nil
 }
 
 // HandleMessage ...
-func (h *Handler) HandleMessage(topic string, message interface{}) error {
-	h.formations.Lock()
-	defer h.formations.Unlock()
-
-	switch t := devices.ParseTopic(topic); t.Path {
-	case devices.ConnectTopic.Path:
-		cm := message.(devices.ConnectMessage)
-		h.formations.PutDeviceState(cm.FormationID, cm.DeviceName, ForwardedIP, cm.IPAddress)
-		return nil
-	default:
-		buf, ok := message.([]byte)
-		if !ok {
-			return fmt.Errorf("[sentry] expected []byte, got this instead: %v", message)
-		}
+func (h *Handler) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	return h.router.HandleMessage(ctx, topic, message)
+}
 
-		m := new(Message)
-		if err := json.Unmarshal(buf, m); err != nil {
-			return err
-		}
-		return h.onMessage(t, m)
-	}
+func (h *Handler) onConnect(_ context.Context, _ devices.Topic, cm devices.ConnectMessage) error {
+	return h.formations.Update(cm.FormationID, func(tx *devices.Tx) error {
+		forwardedIPSlot.Put(tx, cm.FormationID, cm.DeviceName, cm.IPAddress)
+		return nil
+	})
 }
 
-func (h *Handler) onMessage(t devices.Topic, m *Message) error {
+func (h *Handler) onMessage(_ context.Context, t devices.Topic, m *Message) error {
 	ts := m.Timestamp.Unix()
 
 	item, err := dynamodbattribute.MarshalMap(map[string]interface{}{
@@ -91,20 +117,21 @@ func (h *Handler) onMessage(t devices.Topic, m *Message) error {
 	}
 
 	_, err = h.dynamoDBClient.PutItem(&dynamodb.PutItemInput{
-		TableName: aws.String(config.Config.SentryDynamoDBTable),
+		TableName: aws.String(h.tableName),
 		Item:      item,
 	})
 	return err
 }
 
 func (h *Handler) getForwardedIP(deviceName string) string {
-	raw := h.formations.GetDeviceState(deviceName, ForwardedIP)
-	if raw != nil {
-		if ip, ok := raw.(string); ok {
-			return ip
+	ip := "unknown"
+	h.formations.ViewDevice(deviceName, func(tx *devices.Tx) error {
+		if v, ok := forwardedIPSlot.Get(tx, deviceName); ok {
+			ip = v
 		}
-	}
-	return "unknown"
+		return nil
+	})
+	return ip
 }
 
 // SetDynamoDBClient is used in tests to mock DynamoDB operations
@@ -1,6 +1,8 @@
 package sentry_test
 
 import (
+	"context"
+
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
@@ -8,8 +10,8 @@ import (
 	. "github.com/onsi/gomega"
 	"github.com/superscale/spire/devices"
 	"github.com/superscale/spire/devices/sentry"
+	"github.com/superscale/spire/logging"
 	"github.com/superscale/spire/mqtt"
-	"github.com/superscale/spire/testutils"
 )
 
 type dynamock struct {
@@ -30,7 +32,6 @@ var _ = Describe("Sentry Message Handler", func() {
 
 	var broker *mqtt.Broker
 	var formations *devices.FormationMap
-	var recorder *testutils.PubSubRecorder
 	var handler *sentry.Handler
 
 	var formationID = "00000000-0000-0000-0000-000000000001"
@@ -38,11 +39,12 @@ var _ = Describe("Sentry Message Handler", func() {
 	var ipAddress = "23.23.23.23"
 
 	BeforeEach(func() {
-		broker = mqtt.NewBroker(false)
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
 		formations = devices.NewFormationMap()
-		recorder = testutils.NewPubSubRecorder()
 
-		handler = sentry.Register(broker, formations).(*sentry.Handler)
+		h, err := sentry.Register(broker, formations, logging.New("test"), &sentry.Config{DynamoDBTable: "spire-test"})
+		Expect(err).NotTo(HaveOccurred())
+		handler = h.(*sentry.Handler)
 	})
 	Describe("connect", func() {
 		BeforeEach(func() {
@@ -52,7 +54,7 @@ var _ = Describe("Sentry Message Handler", func() {
 				DeviceInfo:  nil,
 				IPAddress:   ipAddress,
 			}
-			broker.Publish(devices.ConnectTopic.String(), m)
+			broker.Publish(context.Background(), devices.ConnectTopic.String(), m)
 		})
 		It("adds the ip address to the device state", func() {
 			formations.RLock()
@@ -74,7 +76,7 @@ var _ = Describe("Sentry Message Handler", func() {
 			dynamo = new(dynamock)
 			handler.SetDynamoDBClient(dynamo)
 
-			broker.Publish(topic, []byte(`{
+			broker.Publish(context.Background(), topic, []byte(`{
 				"ip": "1.2.3.4",
 				"mac": "23:23:23:23:23:23",
 				"timestamp": 1502982990
@@ -0,0 +1,262 @@
+package shadow
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/handlers"
+	"github.com/superscale/spire/mqtt"
+)
+
+const (
+	desiredTopicPath  = "shadow/desired"  // armada/<device>/shadow/desired
+	reportedTopicPath = "shadow/reported" // pylon/<device>/shadow/reported
+	deltaTopicPath    = "shadow/delta"    // pylon/<device>/shadow/delta
+	shadowTopicPath   = "shadow"          // matriarch/<device>/shadow
+	rejectedTopicPath = "shadow/rejected" // matriarch/<device>/shadow/rejected
+)
+
+// ErrVersionConflict is sent in a Rejection if a desired state is based on an outdated version
+const ErrVersionConflict = "version_conflict"
+
+// Shadow holds the desired and reported state of a device. Stored shadows are never modified.
+type Shadow struct {
+	Desired         map[string]interface{} `json:"desired"`
+	Reported        map[string]interface{} `json:"reported"`
+	Version         int64                  `json:"version"`          // incremented on every change of the desired state
+	ReportedVersion int64                  `json:"reported_version"` // version the device reported last
+}
+
+// Document is published to the UI on matriarch/<device>/shadow
+type Document struct {
+	*Shadow
+	Delta map[string]interface{} `json:"delta"`
+}
+
+// StateMessage is sent by control clients on armada/<device>/shadow/desired and by devices on
+// pylon/<device>/shadow/reported. Keys in State are merged into the shadow, null values delete keys.
+// Clients set Version to the version their change is based on, or leave it empty to overwrite
+// unconditionally. Devices set it to the version of the delta they applied.
+type StateMessage struct {
+	Version int64                  `json:"version,omitempty"`
+	State   map[string]interface{} `json:"state"`
+}
+
+// Rejection is published on matriarch/<device>/shadow/rejected if a desired state is not applied
+type Rejection struct {
+	Error   string `json:"error"`
+	Version int64  `json:"version"` // current version of the shadow
+}
+
+// Slot holds the shadow of a device
+var Slot = devices.NewDeviceSlot[*Shadow]("shadow", "shadow").Persist(func() *Shadow { return new(Shadow) })
+
+// Handler ...
+type Handler struct {
+	broker     *mqtt.Broker
+	formations *devices.FormationMap
+	log        *logrus.Entry
+	router     *devices.Router
+}
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name:     "shadow",
+		Register: handlers.Wrap(Register),
+	})
+}
+
+// Register ...
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, logger *logrus.Entry) interface{} {
+	h := &Handler{broker: broker, formations: formations, log: logger, router: devices.NewRouter("shadow")}
+
+	devices.Route(h.router, devices.ConnectTopic.String(), h.onConnect)
+	devices.Route(h.router, "armada/+/"+desiredTopicPath, h.onDesired)
+	devices.Route(h.router, "pylon/+/"+reportedTopicPath, h.onReported)
+	devices.Route(h.router, mqtt.SubscribeEventTopic, h.onSubscribeEvent)
+	h.router.Subscribe(broker, h)
+	return h
+}
+
+// HandleMessage implements mqtt.Subscriber
+func (h *Handler) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	return h.router.HandleMessage(ctx, topic, message)
+}
+
+func (h *Handler) onConnect(ctx context.Context, _ devices.Topic, cm devices.ConnectMessage) error {
+	var s *Shadow
+	h.formations.View(cm.FormationID, func(tx *devices.Tx) error {
+		s, _ = Slot.Get(tx, cm.DeviceName)
+		return nil
+	})
+
+	h.sendDelta(ctx, cm.DeviceName, s)
+	return nil
+}
+
+func (h *Handler) onDesired(ctx context.Context, t devices.Topic, msg *StateMessage) error {
+	var s *Shadow
+	var conflict, connected bool
+
+	err := h.formations.UpdateDevice(t.DeviceName, func(tx *devices.Tx) error {
+		if len(tx.Formation()) == 0 {
+			return fmt.Errorf("[shadow] desired state for unknown device %s", t.DeviceName)
+		}
+
+		s, _ = Slot.Get(tx, t.DeviceName)
+		if s == nil {
+			s = new(Shadow)
+		}
+
+		if msg.Version != 0 && msg.Version != s.Version {
+			conflict = true
+			return nil
+		}
+
+		s = &Shadow{
+			Desired:         merge(s.Desired, msg.State),
+			Reported:        s.Reported,
+			Version:         s.Version + 1,
+			ReportedVersion: s.ReportedVersion,
+		}
+		Slot.Put(tx, tx.Formation(), t.DeviceName, s)
+
+		lc, ok := devices.LifecycleSlot.Get(tx, t.DeviceName)
+		connected = ok && lc.Connected()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if conflict {
+		topic := fmt.Sprintf("matriarch/%s/%s", t.DeviceName, rejectedTopicPath)
+		h.broker.Publish(ctx, topic, &Rejection{Error: ErrVersionConflict, Version: s.Version})
+		return nil
+	}
+
+	h.sendToUI(ctx, t.DeviceName, s)
+	if connected {
+		h.sendDelta(ctx, t.DeviceName, s)
+	}
+	return nil
+}
+
+func (h *Handler) onReported(ctx context.Context, t devices.Topic, msg *StateMessage) error {
+	var s *Shadow
+	var outdated bool
+
+	err := h.formations.UpdateDevice(t.DeviceName, func(tx *devices.Tx) error {
+		if len(tx.Formation()) == 0 {
+			return fmt.Errorf("[shadow] reported state for unknown device %s", t.DeviceName)
+		}
+
+		s, _ = Slot.Get(tx, t.DeviceName)
+		if s == nil {
+			s = new(Shadow)
+		}
+
+		if msg.Version > s.Version {
+			return fmt.Errorf("[shadow] %s reported version %d, but the shadow has version %d", t.DeviceName, msg.Version, s.Version)
+		}
+
+		s = &Shadow{
+			Desired:         s.Desired,
+			Reported:        merge(s.Reported, msg.State),
+			Version:         s.Version,
+			ReportedVersion: msg.Version,
+		}
+		Slot.Put(tx, tx.Formation(), t.DeviceName, s)
+
+		outdated = msg.Version < s.Version
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	h.sendToUI(ctx, t.DeviceName, s)
+
+	// the device applied an older version, so the desired state has changed in the meantime
+	if outdated {
+		h.sendDelta(ctx, t.DeviceName, s)
+	}
+	return nil
+}
+
+func (h *Handler) onSubscribeEvent(ctx context.Context, _ devices.Topic, sm mqtt.SubscribeMessage) error {
+	for _, topic := range sm.Topics {
+		t := devices.ParseTopic(topic)
+
+		if t.Prefix == "matriarch" && t.DeviceName != "+" && (t.Path == shadowTopicPath || t.Path == "#") {
+			var s *Shadow
+			h.formations.ViewDevice(t.DeviceName, func(tx *devices.Tx) error {
+				s, _ = Slot.Get(tx, t.DeviceName)
+				return nil
+			})
+			h.sendToUI(ctx, t.DeviceName, s)
+		}
+	}
+	return nil
+}
+
+func (h *Handler) sendToUI(ctx context.Context, deviceName string, s *Shadow) {
+	if s == nil {
+		s = new(Shadow)
+	}
+
+	topic := fmt.Sprintf("matriarch/%s/%s", deviceName, shadowTopicPath)
+	h.broker.Publish(ctx, topic, &Document{Shadow: s, Delta: s.Delta()})
+}
+
+// sendDelta publishes the delta to the device, unless it is empty
+func (h *Handler) sendDelta(ctx context.Context, deviceName string, s *Shadow) {
+	if s == nil {
+		return
+	}
+
+	delta := s.Delta()
+	if len(delta) == 0 {
+		return
+	}
+
+	topic := fmt.Sprintf("pylon/%s/%s", deviceName, deltaTopicPath)
+	h.broker.Publish(ctx, topic, &StateMessage{Version: s.Version, State: delta})
+}
+
+// Delta returns the keys of the desired state whose values differ from the reported state.
+// Reported keys missing from the desired state are included with nil values, so the device deletes them.
+func (s *Shadow) Delta() map[string]interface{} {
+	delta := make(map[string]interface{})
+	for k, v := range s.Desired {
+		if r, exists := s.Reported[k]; !exists || !reflect.DeepEqual(r, v) {
+			delta[k] = v
+		}
+	}
+	for k := range s.Reported {
+		if _, exists := s.Desired[k]; !exists {
+			delta[k] = nil
+		}
+	}
+	return delta
+}
+
+// merge returns a copy of state with the keys of update applied. Keys with nil values are deleted.
+func merge(state, update map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(state)+len(update))
+	for k, v := range state {
+		res[k] = v
+	}
+
+	for k, v := range update {
+		if v == nil {
+			delete(res, k)
+		} else {
+			res[k] = v
+		}
+	}
+	return res
+}
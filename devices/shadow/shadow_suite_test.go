@@ -0,0 +1,14 @@
+package shadow_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// TestShadow ...
+func TestShadow(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Spire Shadow Suite")
+}
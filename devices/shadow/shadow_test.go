@@ -0,0 +1,179 @@
+package shadow_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/shadow"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("Shadow Handler", func() {
+
+	var broker *mqtt.Broker
+	var formations *devices.FormationMap
+	var uiRecorder, deviceRecorder, rejectedRecorder *testutils.PubSubRecorder
+
+	var formationID = "00000000-0000-0000-0000-000000000001"
+	var deviceName = "1.marsara"
+	var desiredTopic = "armada/" + deviceName + "/shadow/desired"
+	var reportedTopic = "pylon/" + deviceName + "/shadow/reported"
+
+	publish := func(topic, payload string) {
+		broker.Publish(context.Background(), topic, []byte(payload))
+	}
+	getShadow := func() *shadow.Shadow {
+		var s *shadow.Shadow
+		formations.ViewDevice(deviceName, func(tx *devices.Tx) error {
+			s, _ = shadow.Slot.Get(tx, deviceName)
+			return nil
+		})
+		return s
+	}
+	lastDelta := func() *shadow.StateMessage {
+		_, raw := deviceRecorder.Last()
+		msg, ok := raw.(*shadow.StateMessage)
+		Expect(ok).To(BeTrue())
+		return msg
+	}
+
+	BeforeEach(func() {
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
+		formations = devices.NewFormationMap()
+		uiRecorder = testutils.NewPubSubRecorder()
+		deviceRecorder = testutils.NewPubSubRecorder()
+		rejectedRecorder = testutils.NewPubSubRecorder()
+
+		broker.Subscribe("matriarch/"+deviceName+"/shadow", uiRecorder)
+		broker.Subscribe("matriarch/"+deviceName+"/shadow/rejected", rejectedRecorder)
+		broker.Subscribe("pylon/"+deviceName+"/shadow/delta", deviceRecorder)
+		shadow.Register(broker, formations, logging.New("test"))
+
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			tx.AddDevice(deviceName)
+			return nil
+		})
+	})
+	Describe("with a disconnected device", func() {
+		BeforeEach(func() {
+			publish(desiredTopic, `{"state": {"ssid": "marsara", "channel": 6}}`)
+		})
+		It("stores the desired state", func() {
+			s := getShadow()
+			Expect(s.Version).To(BeNumerically("==", 1))
+			Expect(s.Desired).To(Equal(map[string]interface{}{"ssid": "marsara", "channel": float64(6)}))
+		})
+		It("publishes the shadow to the UI", func() {
+			Expect(uiRecorder.Count()).To(Equal(1))
+			_, raw := uiRecorder.First()
+			doc := raw.(*shadow.Document)
+			Expect(doc.Version).To(BeNumerically("==", 1))
+			Expect(doc.Delta).To(HaveLen(2))
+		})
+		It("does not publish the delta", func() {
+			Expect(deviceRecorder.Count()).To(Equal(0))
+		})
+		It("publishes the delta when the device connects", func() {
+			broker.Publish(context.Background(), devices.ConnectTopic.String(), devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName})
+
+			Expect(deviceRecorder.Count()).To(Equal(1))
+			delta := lastDelta()
+			Expect(delta.Version).To(BeNumerically("==", 1))
+			Expect(delta.State).To(HaveLen(2))
+		})
+	})
+	Describe("with a connected device", func() {
+		BeforeEach(func() {
+			formations.Update(formationID, func(tx *devices.Tx) error {
+				devices.LifecycleSlot.Put(tx, formationID, deviceName, &devices.Lifecycle{ConnectedAt: time.Now()})
+				return nil
+			})
+			publish(desiredTopic, `{"state": {"ssid": "marsara", "channel": 6}}`)
+		})
+		It("publishes the delta to the device", func() {
+			Expect(deviceRecorder.Count()).To(Equal(1))
+			Expect(lastDelta().State).To(Equal(map[string]interface{}{"ssid": "marsara", "channel": float64(6)}))
+		})
+		It("only publishes keys that differ from the reported state", func() {
+			publish(reportedTopic, `{"version": 1, "state": {"ssid": "marsara", "channel": 6}}`)
+			publish(desiredTopic, `{"state": {"channel": 11}}`)
+
+			Expect(deviceRecorder.Count()).To(Equal(2))
+			delta := lastDelta()
+			Expect(delta.Version).To(BeNumerically("==", 2))
+			Expect(delta.State).To(Equal(map[string]interface{}{"channel": float64(11)}))
+		})
+		It("deletes keys set to null", func() {
+			publish(desiredTopic, `{"state": {"channel": null}}`)
+			Expect(getShadow().Desired).To(Equal(map[string]interface{}{"ssid": "marsara"}))
+		})
+		It("publishes null for reported keys deleted from the desired state", func() {
+			publish(reportedTopic, `{"version": 1, "state": {"ssid": "marsara", "channel": 6}}`)
+			publish(desiredTopic, `{"state": {"channel": null}}`)
+
+			Expect(deviceRecorder.Count()).To(Equal(2))
+			delta := lastDelta()
+			Expect(delta.Version).To(BeNumerically("==", 2))
+			Expect(delta.State).To(Equal(map[string]interface{}{"channel": nil}))
+
+			publish(reportedTopic, `{"version": 2, "state": {"channel": null}}`)
+			Expect(getShadow().Delta()).To(BeEmpty())
+		})
+		It("stores the reported state", func() {
+			publish(reportedTopic, `{"version": 1, "state": {"ssid": "marsara", "channel": 6}}`)
+
+			s := getShadow()
+			Expect(s.ReportedVersion).To(BeNumerically("==", 1))
+			Expect(s.Delta()).To(BeEmpty())
+			Expect(uiRecorder.Count()).To(Equal(2))
+		})
+		It("republishes the delta for outdated reports", func() {
+			publish(desiredTopic, `{"state": {"channel": 11}}`)
+			publish(reportedTopic, `{"version": 1, "state": {"ssid": "marsara", "channel": 6}}`)
+
+			Expect(deviceRecorder.Count()).To(Equal(3))
+			delta := lastDelta()
+			Expect(delta.Version).To(BeNumerically("==", 2))
+			Expect(delta.State).To(Equal(map[string]interface{}{"channel": float64(11)}))
+		})
+		It("ignores reports of unknown versions", func() {
+			publish(reportedTopic, `{"version": 5, "state": {"ssid": "marsara"}}`)
+			Expect(getShadow().Reported).To(BeEmpty())
+		})
+		It("rejects desired states based on outdated versions", func() {
+			publish(desiredTopic, `{"version": 1, "state": {"channel": 11}}`)
+			publish(desiredTopic, `{"version": 1, "state": {"channel": 1}}`)
+
+			Expect(getShadow().Desired["channel"]).To(Equal(float64(11)))
+			Expect(rejectedRecorder.Count()).To(Equal(1))
+			_, raw := rejectedRecorder.First()
+			Expect(raw).To(Equal(&shadow.Rejection{Error: shadow.ErrVersionConflict, Version: 2}))
+		})
+	})
+	It("ignores desired states of unknown devices", func() {
+		publish("armada/2.marsara/shadow/desired", `{"state": {"ssid": "marsara"}}`)
+		Expect(formations.FormationID("2.marsara")).To(BeEmpty())
+	})
+	It("ignores reported states of unknown devices", func() {
+		publish("pylon/2.marsara/shadow/reported", `{"state": {"ssid": "marsara"}}`)
+
+		formations.View("", func(tx *devices.Tx) error {
+			_, ok := shadow.Slot.Get(tx, "2.marsara")
+			Expect(ok).To(BeFalse())
+			return nil
+		})
+	})
+	It("publishes the shadow when the UI subscribes", func() {
+		publish(desiredTopic, `{"state": {"ssid": "marsara"}}`)
+		broker.Publish(context.Background(), mqtt.SubscribeEventTopic, mqtt.SubscribeMessage{Topics: []string{"matriarch/" + deviceName + "/#"}})
+
+		Expect(uiRecorder.Count()).To(Equal(2))
+		_, raw := uiRecorder.Last()
+		Expect(raw.(*shadow.Document).Desired).To(HaveKeyWithValue("ssid", "marsara"))
+	})
+})
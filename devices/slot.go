@@ -0,0 +1,200 @@
+package devices
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// SlotScope tells whether a slot holds state per formation or per device
+type SlotScope string
+
+const (
+	// FormationScope ...
+	FormationScope SlotScope = "formation"
+	// DeviceScope ...
+	DeviceScope SlotScope = "device"
+)
+
+// SlotInfo describes a declared state slot
+type SlotInfo struct {
+	Owner      string    `json:"owner"`
+	Key        string    `json:"key"`
+	Scope      SlotScope `json:"scope"`
+	Type       string    `json:"type"`
+	Persistent bool      `json:"persistent"`
+}
+
+// SlotValue is the JSON encoded value of a slot for a formation or device
+type SlotValue struct {
+	SlotInfo
+	Value json.RawMessage `json:"value"`
+}
+
+var (
+	slotsL sync.RWMutex
+	slots  = make(map[string]*SlotInfo) // key -> slot
+)
+
+func declareSlot(owner, key string, scope SlotScope, typ reflect.Type) *SlotInfo {
+	slotsL.Lock()
+	defer slotsL.Unlock()
+
+	if existing, exists := slots[key]; exists {
+		panic(fmt.Sprintf("devices: state key %q of %s is already declared by %s", key, owner, existing.Owner))
+	}
+
+	info := &SlotInfo{Owner: owner, Key: key, Scope: scope, Type: typ.String()}
+	slots[key] = info
+	return info
+}
+
+func persistSlot(info *SlotInfo, newValue func() interface{}) {
+	slotsL.Lock()
+	info.Persistent = true
+	slotsL.Unlock()
+
+	RegisterStateType(info.Key, newValue)
+}
+
+// Slots returns all declared slots, sorted by owner and key
+func Slots() []SlotInfo {
+	slotsL.RLock()
+	defer slotsL.RUnlock()
+
+	res := make([]SlotInfo, 0, len(slots))
+	for _, info := range slots {
+		res = append(res, *info)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Owner != res[j].Owner {
+			return res[i].Owner < res[j].Owner
+		}
+		return res[i].Key < res[j].Key
+	})
+	return res
+}
+
+// DeviceSlot is a typed slot for per-device state. Handlers declare their slots once as package
+// variables and access them inside FormationMap.Update or View by passing the transaction.
+type DeviceSlot[T any] struct {
+	info *SlotInfo
+}
+
+// NewDeviceSlot declares a device slot. It panics if key is already declared.
+func NewDeviceSlot[T any](owner, key string) DeviceSlot[T] {
+	return DeviceSlot[T]{declareSlot(owner, key, DeviceScope, reflect.TypeOf((*T)(nil)).Elem())}
+}
+
+// Persist marks the slot as persistent (see RegisterStateType). T must be a pointer type.
+func (s DeviceSlot[T]) Persist(newValue func() T) DeviceSlot[T] {
+	persistSlot(s.info, func() interface{} { return newValue() })
+	return s
+}
+
+// Key ...
+func (s DeviceSlot[T]) Key() string {
+	return s.info.Key
+}
+
+// Get returns the value for deviceName. ok is false if no value is stored.
+func (s DeviceSlot[T]) Get(st State, deviceName string) (value T, ok bool) {
+	value, ok = st.GetDeviceState(deviceName, s.info.Key).(T)
+	return
+}
+
+// Put ...
+func (s DeviceSlot[T]) Put(st State, formationID, deviceName string, value T) {
+	st.PutDeviceState(formationID, deviceName, s.info.Key, value)
+}
+
+// Delete ...
+func (s DeviceSlot[T]) Delete(st State, formationID, deviceName string) {
+	st.DeleteDeviceState(formationID, deviceName, s.info.Key)
+}
+
+// FormationSlot is a typed slot for per-formation state. See DeviceSlot.
+type FormationSlot[T any] struct {
+	info *SlotInfo
+}
+
+// NewFormationSlot declares a formation slot. It panics if key is already declared.
+func NewFormationSlot[T any](owner, key string) FormationSlot[T] {
+	return FormationSlot[T]{declareSlot(owner, key, FormationScope, reflect.TypeOf((*T)(nil)).Elem())}
+}
+
+// Persist marks the slot as persistent (see RegisterStateType). T must be a pointer type.
+func (s FormationSlot[T]) Persist(newValue func() T) FormationSlot[T] {
+	persistSlot(s.info, func() interface{} { return newValue() })
+	return s
+}
+
+// Key ...
+func (s FormationSlot[T]) Key() string {
+	return s.info.Key
+}
+
+// Get returns the value for formationID. ok is false if no value is stored.
+func (s FormationSlot[T]) Get(st State, formationID string) (value T, ok bool) {
+	value, ok = st.GetState(formationID, s.info.Key).(T)
+	return
+}
+
+// Put ...
+func (s FormationSlot[T]) Put(st State, formationID string, value T) {
+	st.PutState(formationID, s.info.Key, value)
+}
+
+// Delete ...
+func (s FormationSlot[T]) Delete(st State, formationID string) {
+	st.DeleteState(formationID, s.info.Key)
+}
+
+// DeviceSlotValues returns the values of all declared device slots of deviceName, for debugging.
+// Values that cannot be encoded as JSON (e.g. functions) are replaced with their type.
+// It locks the formation of the device for reading.
+func (fm *FormationMap) DeviceSlotValues(deviceName string) (res []SlotValue) {
+	fm.ViewDevice(deviceName, func(tx *Tx) error {
+		res = slotValues(DeviceScope, func(key string) interface{} {
+			return tx.GetDeviceState(deviceName, key)
+		})
+		return nil
+	})
+	return
+}
+
+// FormationSlotValues returns the values of all declared formation slots of formationID. See DeviceSlotValues.
+func (fm *FormationMap) FormationSlotValues(formationID string) (res []SlotValue) {
+	fm.View(formationID, func(tx *Tx) error {
+		res = slotValues(FormationScope, func(key string) interface{} {
+			return tx.GetState(formationID, key)
+		})
+		return nil
+	})
+	return
+}
+
+func slotValues(scope SlotScope, get func(key string) interface{}) []SlotValue {
+	res := []SlotValue{}
+
+	for _, info := range Slots() {
+		if info.Scope != scope {
+			continue
+		}
+
+		value := get(info.Key)
+		if value == nil {
+			continue
+		}
+
+		buf, err := json.Marshal(value)
+		if err != nil {
+			buf, _ = json.Marshal(fmt.Sprintf("<%T>", value))
+		}
+		res = append(res, SlotValue{SlotInfo: info, Value: buf})
+	}
+	return res
+}
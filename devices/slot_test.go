@@ -0,0 +1,116 @@
+package devices_test
+
+import (
+	"context"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/devices"
+)
+
+type slotState struct {
+	Count int `json:"count"`
+}
+
+var (
+	countSlot  = devices.NewDeviceSlot[*slotState]("test", "test_count")
+	cancelSlot = devices.NewDeviceSlot[context.CancelFunc]("test", "test_cancel")
+	totalSlot  = devices.NewFormationSlot[int]("test", "test_total")
+)
+
+var _ = Describe("State Slots", func() {
+
+	var formations *devices.FormationMap
+
+	var formationID = "00000000-0000-0000-0000-000000000001"
+	var deviceName = "1.marsara"
+
+	BeforeEach(func() {
+		formations = devices.NewFormationMap()
+	})
+	Describe("with all shards locked", func() {
+		BeforeEach(func() {
+			formations.Lock()
+		})
+		AfterEach(func() {
+			formations.Unlock()
+		})
+		It("stores typed device state", func() {
+			countSlot.Put(formations, formationID, deviceName, &slotState{Count: 23})
+
+			state, ok := countSlot.Get(formations, deviceName)
+			Expect(ok).To(BeTrue())
+			Expect(state.Count).To(Equal(23))
+			Expect(formations.FormationID(deviceName)).To(Equal(formationID))
+		})
+		It("deletes device state", func() {
+			countSlot.Put(formations, formationID, deviceName, &slotState{Count: 23})
+			countSlot.Delete(formations, formationID, deviceName)
+
+			_, ok := countSlot.Get(formations, deviceName)
+			Expect(ok).To(BeFalse())
+		})
+		It("stores typed formation state", func() {
+			totalSlot.Put(formations, formationID, 42)
+
+			total, ok := totalSlot.Get(formations, formationID)
+			Expect(ok).To(BeTrue())
+			Expect(total).To(Equal(42))
+
+			totalSlot.Delete(formations, formationID)
+			_, ok = totalSlot.Get(formations, formationID)
+			Expect(ok).To(BeFalse())
+		})
+		It("does not return values of another type", func() {
+			formations.PutDeviceState(formationID, deviceName, countSlot.Key(), "not a *slotState")
+
+			_, ok := countSlot.Get(formations, deviceName)
+			Expect(ok).To(BeFalse())
+		})
+	})
+	It("rejects keys that are already declared", func() {
+		Expect(func() {
+			devices.NewDeviceSlot[string]("other", "test_count")
+		}).To(Panic())
+	})
+	It("lists declared slots", func() {
+		Expect(devices.Slots()).To(ContainElement(devices.SlotInfo{
+			Owner: "test",
+			Key:   "test_total",
+			Scope: devices.FormationScope,
+			Type:  "int",
+		}))
+	})
+	It("enumerates the state of a device", func() {
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			countSlot.Put(tx, formationID, deviceName, &slotState{Count: 23})
+			cancelSlot.Put(tx, formationID, deviceName, func() {})
+			return nil
+		})
+
+		values := make(map[string]interface{})
+		for _, v := range formations.DeviceSlotValues(deviceName) {
+			var value interface{}
+			Expect(json.Unmarshal(v.Value, &value)).NotTo(HaveOccurred())
+			values[v.Key] = value
+		}
+
+		Expect(values).To(HaveKeyWithValue("test_count", map[string]interface{}{"count": float64(23)}))
+		Expect(values).To(HaveKeyWithValue("test_cancel", "<context.CancelFunc>"))
+		Expect(values).NotTo(HaveKey("test_total"))
+	})
+	It("enumerates the state of a formation", func() {
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			totalSlot.Put(tx, formationID, 42)
+			return nil
+		})
+
+		values := formations.FormationSlotValues(formationID)
+		Expect(values).To(HaveLen(1))
+
+		var total int
+		Expect(json.Unmarshal(values[0].Value, &total)).NotTo(HaveOccurred())
+		Expect(total).To(Equal(42))
+	})
+})
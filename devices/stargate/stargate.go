@@ -1,12 +1,14 @@
 package stargate
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/handlers"
+	"github.com/superscale/spire/logging"
 	"github.com/superscale/spire/mqtt"
 )
 
@@ -120,12 +122,35 @@ func NewSystemImageState(id, vendor, product string) *SystemImageState {
 // SystemImageMap ...
 type SystemImageMap map[string]*SystemImageState
 
+// copy returns a copy of the map that can be published after the formation is unlocked
+func (m PortMap) copy() PortMap {
+	res := make(PortMap, len(m))
+	for port, ps := range m {
+		cp := *ps
+		res[port] = &cp
+	}
+	return res
+}
+
+// copy returns a copy of the map that can be published after the formation is unlocked
+func (m SystemImageMap) copy() SystemImageMap {
+	res := make(SystemImageMap, len(m))
+	for id, img := range m {
+		cp := *img
+		res[id] = &cp
+	}
+	return res
+}
+
 // State ...
 type State struct {
 	Ports        PortMap
 	SystemImages SystemImageMap
 }
 
+// StateSlot holds the port and system image state of a device
+var StateSlot = devices.NewDeviceSlot[*State]("stargate", Key).Persist(NewState)
+
 // NewState ...
 func NewState() *State {
 	return &State{
@@ -138,52 +163,57 @@ func NewState() *State {
 type Handler struct {
 	broker     *mqtt.Broker
 	formations *devices.FormationMap
+	log        *logrus.Entry
+	router     *devices.Router
+}
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name:     "stargate",
+		Register: handlers.Wrap(Register),
+	})
 }
 
 // Register ...
-func Register(broker *mqtt.Broker, formations *devices.FormationMap) interface{} {
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, logger *logrus.Entry) interface{} {
 	h := &Handler{
 		broker:     broker,
 		formations: formations,
+		log:        logger,
+		router:     devices.NewRouter("stargate"),
 	}
 
-	broker.Subscribe("pylon/+/stargate/port", h)
-	broker.Subscribe("pylon/+/stargate/systemimaged", h)
+	devices.Route(h.router, "pylon/+/stargate/port", h.onPortsMessage)
+	devices.Route(h.router, "pylon/+/stargate/systemimaged", h.onSystemImageMessage)
+	h.router.Subscribe(broker, h)
 	return h
 }
 
 // HandleMessage ...
-func (h *Handler) HandleMessage(topic string, message interface{}) error {
-	h.formations.Lock()
-	defer h.formations.Unlock()
-
-	t := devices.ParseTopic(topic)
+func (h *Handler) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	return h.router.HandleMessage(ctx, topic, message)
+}
 
-	switch t.Path {
-	case "stargate/port":
-		msg, err := unmarshalPortsMessage(message)
-		if err != nil {
-			return err
-		}
-		return h.onPortsMessage(t, msg)
-	case "stargate/systemimaged":
-		msg, err := unmarshalSystemImageMessage(message)
-		if err != nil {
-			return err
-		}
-		return h.onSystemImageMessage(t, msg)
-	default:
+func (h *Handler) onPortsMessage(ctx context.Context, t devices.Topic, msg *PortsMessage) error {
+	var ports PortMap
+	err := h.update(t.DeviceName, func(tx *devices.Tx, state *State) error {
+		h.updatePorts(ctx, tx, t.DeviceName, state, msg)
+		ports = state.Ports.copy()
 		return nil
+	})
+	if err != nil {
+		return err
 	}
-}
 
-func (h *Handler) onPortsMessage(t devices.Topic, msg *PortsMessage) error {
-	state := h.getState(t.DeviceName)
+	h.broker.Publish(ctx, fmt.Sprintf("matriarch/%s/stargate/ports", t.DeviceName), ports)
+	return nil
+}
 
+func (h *Handler) updatePorts(ctx context.Context, tx *devices.Tx, deviceName string, state *State, msg *PortsMessage) {
 	if msg.Up != nil || (msg.TFTPD.Listening != nil && *msg.TFTPD.Listening == true) {
-		h.handleUp(t.DeviceName, state, msg.Port)
+		h.handleUp(deviceName, state, msg.Port)
 	} else {
-		ps := h.getPortState(state, t.DeviceName, msg.Port)
+		ps := h.getPortState(ctx, tx, state, deviceName, msg.Port)
 
 		if msg.TFTPD.Request != nil && msg.TFTPD.Total != nil {
 			ps.File = *msg.TFTPD.Request
@@ -208,10 +238,6 @@ func (h *Handler) onPortsMessage(t devices.Topic, msg *PortsMessage) error {
 			ps.State = Assimilator
 		}
 	}
-
-	h.formations.PutDeviceState(h.formations.FormationID(t.DeviceName), t.DeviceName, Key, state)
-	h.broker.Publish(fmt.Sprintf("matriarch/%s/stargate/ports", t.DeviceName), state.Ports)
-	return nil
 }
 
 func (h *Handler) handleUp(deviceName string, state *State, port int) {
@@ -224,18 +250,27 @@ func (h *Handler) handleUp(deviceName string, state *State, port int) {
 	}
 }
 
-func (h *Handler) getState(deviceName string) *State {
-	state, ok := h.formations.GetDeviceState(deviceName, Key).(*State)
-	if !ok {
-		return NewState()
-	}
-	return state
+// update calls fn with the state of the device and stores it afterwards
+func (h *Handler) update(deviceName string, fn func(tx *devices.Tx, state *State) error) error {
+	return h.formations.UpdateDevice(deviceName, func(tx *devices.Tx) error {
+		state, ok := StateSlot.Get(tx, deviceName)
+		if !ok {
+			state = NewState()
+		}
+
+		if err := fn(tx, state); err != nil {
+			return err
+		}
+
+		StateSlot.Put(tx, tx.Formation(), deviceName, state)
+		return nil
+	})
 }
 
-func (h *Handler) getPortState(state *State, deviceName string, port int) *PortState {
+func (h *Handler) getPortState(ctx context.Context, tx *devices.Tx, state *State, deviceName string, port int) *PortState {
 	ps, exists := state.Ports[port]
 	if !exists {
-		log.Printf("[stargate] warning: expected state for port %d on device %s missing", port, deviceName)
+		tx.Logger(logging.WithTrace(h.log, ctx), deviceName).WithField("port", port).Warn("expected port state missing")
 		ps = NewPortState()
 		state.Ports[port] = ps
 	} else {
@@ -244,57 +279,37 @@ func (h *Handler) getPortState(state *State, deviceName string, port int) *PortS
 	return ps
 }
 
-func (h *Handler) onSystemImageMessage(t devices.Topic, msg *SystemImageMessage) error {
-	state := h.getState(t.DeviceName)
-
-	if msg.Download == API {
-		state.SystemImages[msg.ID] = NewSystemImageState(msg.ID, msg.Vendor, msg.Product)
-	} else {
-		imgState, exists := state.SystemImages[msg.ID]
-		if !exists {
-			return fmt.Errorf("missing system image state for image %s on device %s", msg.ID, t.DeviceName)
+func (h *Handler) onSystemImageMessage(ctx context.Context, t devices.Topic, msg *SystemImageMessage) error {
+	var images SystemImageMap
+	err := h.update(t.DeviceName, func(_ *devices.Tx, state *State) error {
+		if msg.Download == API {
+			state.SystemImages[msg.ID] = NewSystemImageState(msg.ID, msg.Vendor, msg.Product)
+		} else {
+			imgState, exists := state.SystemImages[msg.ID]
+			if !exists {
+				return fmt.Errorf("missing system image state for image %s on device %s", msg.ID, t.DeviceName)
+			}
+
+			switch msg.Download {
+			case Start:
+				imgState.Total = msg.Total
+			case Progress:
+				imgState.Progress = int64(devices.Round(float64(msg.Progress)/float64(imgState.Total)*100.0, 0))
+			case Ok:
+				imgState.State = Ok
+				imgState.Progress = 100
+			default:
+				imgState.State = Error
+			}
 		}
 
-		switch msg.Download {
-		case Start:
-			imgState.Total = msg.Total
-		case Progress:
-			imgState.Progress = int64(devices.Round(float64(msg.Progress)/float64(imgState.Total)*100.0, 0))
-		case Ok:
-			imgState.State = Ok
-			imgState.Progress = 100
-		default:
-			imgState.State = Error
-		}
+		images = state.SystemImages.copy()
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	h.formations.PutDeviceState(h.formations.FormationID(t.DeviceName), t.DeviceName, Key, state)
-	h.broker.Publish(fmt.Sprintf("matriarch/%s/stargate/system_images", t.DeviceName), state.SystemImages)
+	h.broker.Publish(ctx, fmt.Sprintf("matriarch/%s/stargate/system_images", t.DeviceName), images)
 	return nil
 }
-
-func unmarshalPortsMessage(message interface{}) (*PortsMessage, error) {
-	buf, ok := message.([]byte)
-	if !ok {
-		return nil, fmt.Errorf("[stargate] expected byte buffer, got this instead: %v", message)
-	}
-
-	msg := new(PortsMessage)
-	if err := json.Unmarshal(buf, msg); err != nil {
-		return nil, err
-	}
-	return msg, nil
-}
-
-func unmarshalSystemImageMessage(message interface{}) (*SystemImageMessage, error) {
-	buf, ok := message.([]byte)
-	if !ok {
-		return nil, fmt.Errorf("[stargate] expected byte buffer, got this instead: %v", message)
-	}
-
-	msg := new(SystemImageMessage)
-	if err := json.Unmarshal(buf, msg); err != nil {
-		return nil, err
-	}
-	return msg, nil
-}
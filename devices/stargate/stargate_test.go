@@ -1,6 +1,7 @@
 package stargate_test
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -8,6 +9,7 @@ import (
 	. "github.com/onsi/gomega"
 	"github.com/superscale/spire/devices"
 	"github.com/superscale/spire/devices/stargate"
+	"github.com/superscale/spire/logging"
 	"github.com/superscale/spire/mqtt"
 	"github.com/superscale/spire/testutils"
 )
@@ -26,11 +28,11 @@ var _ = Describe("Stargate Message Handler", func() {
 	var deviceName = "1.marsara"
 
 	BeforeEach(func() {
-		broker = mqtt.NewBroker(false)
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
 		formations = devices.NewFormationMap()
 		recorder = testutils.NewPubSubRecorder()
 
-		stargate.Register(broker, formations)
+		stargate.Register(broker, formations, logging.New("test"))
 		broker.Subscribe(controlTopicPorts, recorder)
 		broker.Subscribe(controlTopicSystemImages, recorder)
 	})
@@ -50,7 +52,7 @@ var _ = Describe("Stargate Message Handler", func() {
 			formations.PutDeviceState(formationID, deviceName, stargate.Key, state)
 			formations.Unlock()
 
-			broker.Publish(deviceTopicPorts, payload)
+			broker.Publish(context.Background(), deviceTopicPorts, payload)
 
 			formations.RLock()
 			rawState := formations.GetDeviceState(deviceName, stargate.Key)
@@ -220,7 +222,7 @@ var _ = Describe("Stargate Message Handler", func() {
 			formations.PutDeviceState(formationID, deviceName, stargate.Key, state)
 			formations.Unlock()
 
-			broker.Publish(deviceTopicSystemImages, payload)
+			broker.Publish(context.Background(), deviceTopicSystemImages, payload)
 			Expect(recorder.Count()).To(BeNumerically("==", 1))
 
 			topic, payload := recorder.First()
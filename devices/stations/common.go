@@ -4,11 +4,19 @@ import (
 	"bufio"
 	"os"
 	"strings"
+	"sync"
 )
 
 var ouiDB map[string]string
+var ouiOnce sync.Once
 
-func init() {
+// loadOUIDB reads oui.txt from the working directory once. It panics if the file cannot be read.
+// It is called by Register, so that spire fails on startup, and not by importing the package.
+func loadOUIDB() {
+	ouiOnce.Do(readOUIDB)
+}
+
+func readOUIDB() {
 	ouiDB = make(map[string]string)
 
 	if f, err := os.Open("oui.txt"); err == nil {
@@ -94,5 +102,6 @@ func parseInterfaceName(iface string) (mode string, radio string) {
 }
 
 func vendorFromMAC(mac string) string {
+	loadOUIDB()
 	return ouiDB[mac[:8]]
 }
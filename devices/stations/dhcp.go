@@ -3,8 +3,9 @@ package stations
 import (
 	"bufio"
 	"encoding/json"
-	"log"
 	"strings"
+
+	"github.com/sirupsen/logrus"
 )
 
 // DHCPClient ...
@@ -24,17 +25,17 @@ func (s DHCPState) Get(iface string) []DHCPClient {
 }
 
 // ParseDHCP ...
-func ParseDHCP(text []byte) (DHCPState, error) {
+func ParseDHCP(text []byte, logger *logrus.Entry) (DHCPState, error) {
 	var state DHCPState
 
 	if err := json.Unmarshal(text, &state); err != nil {
-		return parseLegacyDHCPMessage(string(text))
+		return parseLegacyDHCPMessage(string(text), logger)
 	}
 
 	return state, nil
 }
 
-func parseLegacyDHCPMessage(text string) (DHCPState, error) {
+func parseLegacyDHCPMessage(text string, logger *logrus.Entry) (DHCPState, error) {
 	res := make(DHCPState)
 	scanner := bufio.NewScanner(strings.NewReader(text))
 	var iface string
@@ -55,7 +56,7 @@ func parseLegacyDHCPMessage(text string) (DHCPState, error) {
 			}
 			res[iface] = append(res[iface], c)
 		} else {
-			log.Println("[dhcp] ignoring invalid line in legacy message:", line)
+			logger.WithField("line", line).Warn("ignoring invalid line in legacy DHCP message")
 		}
 	}
 
@@ -6,6 +6,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/superscale/spire/devices/stations"
+	"github.com/superscale/spire/logging"
 )
 
 var _ = Describe("DHCP Parser", func() {
@@ -15,7 +16,7 @@ var _ = Describe("DHCP Parser", func() {
 	var parseError error
 
 	JustBeforeEach(func() {
-		dhcpState, parseError = stations.ParseDHCP([]byte(dhcpInput))
+		dhcpState, parseError = stations.ParseDHCP([]byte(dhcpInput), logging.New("test"))
 		Expect(parseError).NotTo(HaveOccurred())
 	})
 	Describe("parses json messages", func() {
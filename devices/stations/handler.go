@@ -1,14 +1,16 @@
 package stations
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
 	"math"
 	"strconv"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/handlers"
+	"github.com/superscale/spire/logging"
 	"github.com/superscale/spire/mqtt"
 )
 
@@ -50,14 +52,44 @@ type State struct {
 	WifiStations map[string]WifiStation // MAC -> WifiStation
 	LanStations  map[string]*LanStation // MAC -> LanStation
 	Things       map[string]*Thing      // IP -> Thing
+	Owners       map[string]string      // MAC of stations or IP of things -> name of the device that reported it
 }
 
+// setOwner records that deviceName reported the station or thing with key
+func (s *State) setOwner(key, deviceName string) {
+	if s.Owners == nil {
+		s.Owners = make(map[string]string)
+	}
+	s.Owners[key] = deviceName
+}
+
+// removeDevice removes the stations and things that deviceName reported
+func (s *State) removeDevice(deviceName string) {
+	for key, owner := range s.Owners {
+		if owner != deviceName {
+			continue
+		}
+
+		delete(s.WifiStations, key)
+		delete(s.LanStations, key)
+		delete(s.Things, key)
+		delete(s.Owners, key)
+	}
+}
+
+// StateSlot holds the stations of a formation
+var StateSlot = devices.NewFormationSlot[*State]("stations", Key).Persist(NewState)
+
+// cpuPortsSlot holds the switch ports of a device that are connected to the CPU
+var cpuPortsSlot = devices.NewDeviceSlot[[]string]("stations", "cpu_ports")
+
 // NewState ...
 func NewState() *State {
 	return &State{
 		WifiStations: make(map[string]WifiStation),
 		LanStations:  make(map[string]*LanStation),
 		Things:       make(map[string]*Thing),
+		Owners:       make(map[string]string),
 	}
 }
 
@@ -69,106 +101,101 @@ type Message struct {
 	Thing   []*Thing      `json:"thing"`
 }
 
+// Config holds the thresholds of the stations handler. It can be reloaded at runtime.
+type Config struct {
+	LanStationTimeout time.Duration `env:"SPIRE_STATIONS_LAN_STATION_TIMEOUT"  envDefault:"10m"  yaml:"lan_station_timeout"`
+	ThingTimeout      time.Duration `env:"SPIRE_STATIONS_THING_TIMEOUT"  envDefault:"5m"  yaml:"thing_timeout"`
+}
+
+// DefaultConfig ...
+func DefaultConfig() *Config {
+	return &Config{LanStationTimeout: time.Minute * 10, ThingTimeout: time.Minute * 5}
+}
+
 // Handler ...
 type Handler struct {
 	broker     *mqtt.Broker
 	formations *devices.FormationMap
+	log        *logrus.Entry
+	config     *Config // written with all shards of formations locked
+	router     *devices.Router
+}
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name: "stations",
+		Register: func(deps handlers.Deps) (interface{}, error) {
+			h := Register(deps.Broker, deps.Formations, deps.Logger).(*Handler)
+			return h, h.Reconfigure(deps.Config)
+		},
+		Config: func() interface{} { return new(Config) },
+	})
 }
 
 // Register ...
-func Register(broker *mqtt.Broker, formations *devices.FormationMap) interface{} {
-	h := &Handler{broker: broker, formations: formations}
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, logger *logrus.Entry) interface{} {
+	loadOUIDB()
+
+	h := &Handler{broker: broker, formations: formations, log: logger, config: DefaultConfig()}
 
-	broker.Subscribe("pylon/+/wifi/poll", h)
-	broker.Subscribe("pylon/+/wifi/event", h)
-	broker.Subscribe("pylon/+/things/discovery", h)
-	broker.Subscribe("pylon/+/net", h)
-	broker.Subscribe("pylon/+/sys/facts", h)
-	broker.Subscribe("pylon/+/odhcpd", h)
+	h.router = devices.NewRouter("stations")
+	devices.Route(h.router, "pylon/+/wifi/poll", h.onWifiPollMessage)
+	devices.Route(h.router, "pylon/+/wifi/event", h.onWifiEventMessage)
+	devices.Route(h.router, "pylon/+/things/discovery", h.onThingsMessage)
+	devices.Route(h.router, "pylon/+/net", h.onNetMessage)
+	devices.Route(h.router, "pylon/+/sys/facts", h.onSysMessage)
+	devices.Route(h.router, "pylon/+/odhcpd", h.onDHCPMessage)
+	devices.Route(h.router, devices.FormationChangedTopic.String(), h.onFormationChanged)
+	h.router.Subscribe(broker, h)
 
 	return h
 }
 
 // HandleMessage ...
-func (h *Handler) HandleMessage(topic string, message interface{}) error {
-	h.formations.Lock()
-	defer h.formations.Unlock()
-
-	t := devices.ParseTopic(topic)
+func (h *Handler) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	return h.router.HandleMessage(ctx, topic, message)
+}
 
-	switch t.Path {
-	case "wifi/poll":
-		msg, err := unmarshalWifiPollMessage(message)
-		if err != nil {
-			return err
-		}
-		return h.onWifiPollMessage(t, msg)
-	case "wifi/event":
-		msg, err := unmarshalWifiEventMessage(message)
-		if err != nil {
-			return err
-		}
-		return h.onWifiEventMessage(t, msg)
-	case "things/discovery":
-		msg, err := unmarshalThingsMessage(message)
-		if err != nil {
-			return err
-		}
-		return h.onThingsMessage(t, msg)
-	case "net":
-		msg, err := unmarshalNetMessage(message)
-		if err != nil {
-			return err
-		}
-		return h.onNetMessage(t, msg)
-	case "sys/facts":
-		msg, err := unmarshalSysMessage(message)
-		if err != nil {
-			return err
-		}
-		return h.onSysMessage(t, msg)
-	case "odhcpd":
-		buf, ok := message.([]byte)
-		if !ok {
-			return fmt.Errorf("[stations] expected byte buffer, got this instead: %v", message)
-		}
-		return h.onDHCPMessage(t, buf)
-	default:
+func (h *Handler) onWifiPollMessage(ctx context.Context, t devices.Topic, msg *WifiPollMessage) error {
+	out, err := h.update(t.DeviceName, func(tx *devices.Tx, state *State) error {
+		h.updateWifiStations(ctx, tx, msg, state, t.DeviceName)
 		return nil
+	})
+	if err != nil {
+		return err
 	}
-}
-
-func (h *Handler) onWifiPollMessage(t devices.Topic, msg *WifiPollMessage) error {
-	state, formationID := h.getState(t.DeviceName)
-	h.updateWifiStations(msg, state, t.DeviceName)
-	h.formations.PutState(formationID, Key, state)
 
 	if surveyMsg, err := compileWifiSurveyMessage(msg); err != nil {
 		return err
 	} else if len(surveyMsg) > 0 {
 		surveyTopic := fmt.Sprintf("matriarch/%s/wifi/survey", t.DeviceName)
-		h.broker.Publish(surveyTopic, surveyMsg)
+		h.broker.Publish(ctx, surveyTopic, surveyMsg)
 	}
 
-	h.publish(t.DeviceName, state)
+	h.publish(ctx, t.DeviceName, out)
 	return nil
 }
 
-func (h *Handler) onWifiEventMessage(t devices.Topic, msg *WifiEventMessage) error {
-	state, formationID := h.getState(t.DeviceName)
-
-	if msg.Action == "assoc" {
-		state.WifiStations[msg.MAC] = WifiStation{"mac": msg.MAC}
-	} else if msg.Action == "disassoc" {
-		delete(state.WifiStations, msg.MAC)
+func (h *Handler) onWifiEventMessage(ctx context.Context, t devices.Topic, msg *WifiEventMessage) error {
+	out, err := h.update(t.DeviceName, func(_ *devices.Tx, state *State) error {
+		if msg.Action == "assoc" {
+			state.WifiStations[msg.MAC] = WifiStation{"mac": msg.MAC}
+			state.setOwner(msg.MAC, t.DeviceName)
+		} else if msg.Action == "disassoc" {
+			delete(state.WifiStations, msg.MAC)
+			delete(state.Owners, msg.MAC)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	h.formations.PutState(formationID, Key, state)
-	h.publish(t.DeviceName, state)
+	h.publish(ctx, t.DeviceName, out)
 	return nil
 }
 
-func (h *Handler) updateWifiStations(msg *WifiPollMessage, state *State, deviceName string) {
+func (h *Handler) updateWifiStations(ctx context.Context, tx *devices.Tx, msg *WifiPollMessage, state *State, deviceName string) {
 
 	for ifaceName, iface := range msg.Interfaces {
 
@@ -176,48 +203,66 @@ func (h *Handler) updateWifiStations(msg *WifiPollMessage, state *State, deviceN
 
 		if err == nil {
 			state.WifiStations = merge(state.WifiStations, stations)
+			for mac := range stations {
+				state.setOwner(mac, deviceName)
+			}
 		} else {
-			log.Printf("[stations] error while parsing wifi station info for interface %s on device %s: %v", ifaceName, deviceName, err)
+			tx.Logger(logging.WithTrace(h.log, ctx), deviceName).WithField("interface", ifaceName).WithError(err).Warn("error while parsing wifi station info")
 		}
 	}
 }
 
-func (h *Handler) getState(deviceName string) (*State, string) {
-	formationID := h.formations.FormationID(deviceName)
-	state, ok := h.formations.GetState(formationID, Key).(*State)
-	if !ok {
-		return NewState(), formationID
-	}
+// update calls fn with the stations of the device's formation and stores them afterwards. It returns
+// the message to publish, compiled while the formation is locked.
+func (h *Handler) update(deviceName string, fn func(tx *devices.Tx, state *State) error) (out *Message, err error) {
+	err = h.formations.UpdateDevice(deviceName, func(tx *devices.Tx) error {
+		state, ok := StateSlot.Get(tx, tx.Formation())
+		if !ok {
+			state = NewState()
+		}
+
+		if err := fn(tx, state); err != nil {
+			return err
+		}
 
-	return state, formationID
+		StateSlot.Put(tx, tx.Formation(), state)
+		out = compileMessage(state)
+		return nil
+	})
+	return
 }
 
-func (h *Handler) onThingsMessage(t devices.Topic, msg map[string]interface{}) error {
+func (h *Handler) onThingsMessage(ctx context.Context, t devices.Topic, msg map[string]interface{}) error {
 	ip, ipOk := msg["address"].(string)
 	thingData, tOk := msg["thing"].(map[string]interface{})
 	if !ipOk || !tOk {
 		return fmt.Errorf("[stations] got invalid things discovery message: %v", msg)
 	}
 
-	state, formationID := h.getState(t.DeviceName)
+	out, err := h.update(t.DeviceName, func(_ *devices.Tx, state *State) error {
+		thing, exists := state.Things[ip]
+		if exists {
+			thing.Thing = thingData
+			thing.LastUpdatedAt = time.Now().UTC()
+		} else {
+			thing := &Thing{
+				IP:            ip,
+				LastUpdatedAt: time.Now().UTC(),
+				Thing:         thingData,
+				Mode:          "thing",
+			}
 
-	thing, exists := state.Things[ip]
-	if exists {
-		thing.Thing = thingData
-		thing.LastUpdatedAt = time.Now().UTC()
-	} else {
-		thing := &Thing{
-			IP:            ip,
-			LastUpdatedAt: time.Now().UTC(),
-			Thing:         thingData,
-			Mode:          "thing",
+			state.Things[ip] = thing
 		}
 
-		state.Things[ip] = thing
+		state.setOwner(ip, t.DeviceName)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	h.formations.PutState(formationID, Key, state)
-	h.publish(t.DeviceName, state)
+	h.publish(ctx, t.DeviceName, out)
 	return nil
 }
 
@@ -237,69 +282,103 @@ type netMessage struct {
 	Switch string `json:"switch"`
 }
 
-func (h *Handler) onNetMessage(t devices.Topic, msg *netMessage) error {
-	state, formationID := h.getState(t.DeviceName)
-	now := time.Now().UTC()
+func (h *Handler) onNetMessage(ctx context.Context, t devices.Topic, msg *netMessage) error {
+	out, err := h.update(t.DeviceName, func(tx *devices.Tx, state *State) error {
+		now := time.Now().UTC()
 
-	for _, e := range msg.MAC {
-		if thing := state.Things[e.IP]; thing != nil {
-			thing.MAC = e.MAC
-			thing.Vendor = vendorFromMAC(e.MAC)
-			thing.LastUpdatedAt = now
-		} else {
-			if station, exists := state.WifiStations[e.MAC]; exists {
-				station["ip"] = e.IP
+		for _, e := range msg.MAC {
+			if thing := state.Things[e.IP]; thing != nil {
+				thing.MAC = e.MAC
+				thing.Vendor = vendorFromMAC(e.MAC)
+				thing.LastUpdatedAt = now
 			} else {
-				state.LanStations[e.MAC] = &LanStation{
-					Vendor:        vendorFromMAC(e.MAC),
-					MAC:           e.MAC,
-					IP:            e.IP,
-					Mode:          "other",
-					LastUpdatedAt: now,
+				if station, exists := state.WifiStations[e.MAC]; exists {
+					station["ip"] = e.IP
+				} else {
+					state.LanStations[e.MAC] = &LanStation{
+						Vendor:        vendorFromMAC(e.MAC),
+						MAC:           e.MAC,
+						IP:            e.IP,
+						Mode:          "other",
+						LastUpdatedAt: now,
+					}
+					state.setOwner(e.MAC, t.DeviceName)
 				}
 			}
 		}
+
+		if err := h.assignPorts(tx, msg, t.DeviceName, state); err != nil {
+			tx.Logger(logging.WithTrace(h.log, ctx), t.DeviceName).WithError(err).Warn("error while assigning ports from switch info")
+		}
+
+		if err := h.assignBridgeInfo(msg, t.DeviceName, state); err != nil {
+			tx.Logger(logging.WithTrace(h.log, ctx), t.DeviceName).WithError(err).Warn("error while assigning bridge info")
+		}
+
+		h.removeTimedOutStations(state)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	if err := h.assignPorts(msg, t.DeviceName, state); err != nil {
-		log.Printf("[stations] error while assigning ports from switch info for device %s: %v", t.DeviceName, err)
+	h.publish(ctx, t.DeviceName, out)
+	return nil
+}
+
+// onFormationChanged removes the stations of a device that moved to another formation from the old formation
+func (h *Handler) onFormationChanged(_ context.Context, _ devices.Topic, fc devices.FormationChangedMessage) error {
+	return h.formations.Update(fc.OldFormationID, func(tx *devices.Tx) error {
+		if state, ok := StateSlot.Get(tx, fc.OldFormationID); ok {
+			state.removeDevice(fc.DeviceName)
+			StateSlot.Put(tx, fc.OldFormationID, state)
+		}
+		return nil
+	})
+}
+
+// Reconfigure applies new thresholds. It implements handlers.Reconfigurer.
+func (h *Handler) Reconfigure(section interface{}) error {
+	cfg, ok := section.(*Config)
+	if !ok {
+		return fmt.Errorf("expected *stations.Config, got %T", section)
 	}
 
-	if err := h.assignBridgeInfo(msg, t.DeviceName, state); err != nil {
-		log.Printf("[stations] error while assigning bridge info for device %s: %v", t.DeviceName, err)
+	if cfg.LanStationTimeout <= 0 || cfg.ThingTimeout <= 0 {
+		return fmt.Errorf("timeouts must be positive")
 	}
 
-	h.removeTimedOutStations(state)
-	h.formations.PutState(formationID, Key, state)
-	h.publish(t.DeviceName, state)
+	h.formations.Lock()
+	defer h.formations.Unlock()
+
+	h.config = cfg
 	return nil
 }
 
-const lanStationTimeout = time.Minute * 10
-const thingTimeout = time.Minute * 5
-
 func (h *Handler) removeTimedOutStations(state *State) {
 	now := time.Now().UTC()
 
 	for mac, ls := range state.LanStations {
 		ls.InactiveTime = now.Sub(ls.LastUpdatedAt)
-		if ls.InactiveTime > lanStationTimeout {
+		if ls.InactiveTime > h.config.LanStationTimeout {
 			delete(state.LanStations, mac)
+			delete(state.Owners, mac)
 		}
 	}
 
 	for ip, thing := range state.Things {
 		thing.InactiveTime = now.Sub(thing.LastUpdatedAt)
-		if thing.InactiveTime > thingTimeout {
+		if thing.InactiveTime > h.config.ThingTimeout {
 			delete(state.Things, ip)
+			delete(state.Owners, ip)
 		}
 	}
 }
 
-func (h *Handler) assignPorts(msg *netMessage, deviceName string, state *State) error {
+func (h *Handler) assignPorts(tx *devices.Tx, msg *netMessage, deviceName string, state *State) error {
 	var mac2port map[string]string
 	var err error
-	cpuPorts, ok := h.formations.GetDeviceState(deviceName, "cpu_ports").([]string)
+	cpuPorts, ok := cpuPortsSlot.Get(tx, deviceName)
 	if ok {
 		_, mac2port, err = ParseSwitch(msg.Switch, cpuPorts...)
 	} else {
@@ -394,7 +473,7 @@ type sysMessage struct {
 	} `json:"board"`
 }
 
-func (h *Handler) onSysMessage(t devices.Topic, msg *sysMessage) error {
+func (h *Handler) onSysMessage(_ context.Context, t devices.Topic, msg *sysMessage) error {
 	cpuPorts := []string{}
 	for _, port := range msg.Board.Switch.Switch0.Ports {
 		if port.Device != nil {
@@ -402,17 +481,25 @@ func (h *Handler) onSysMessage(t devices.Topic, msg *sysMessage) error {
 		}
 	}
 
-	h.formations.PutDeviceState(h.formations.FormationID(t.DeviceName), t.DeviceName, "cpu_ports", cpuPorts)
-	return nil
+	return h.formations.UpdateDevice(t.DeviceName, func(tx *devices.Tx) error {
+		cpuPortsSlot.Put(tx, tx.Formation(), t.DeviceName, cpuPorts)
+		return nil
+	})
 }
 
-func (h *Handler) onDHCPMessage(t devices.Topic, msg []byte) error {
-	dhcpState, err := ParseDHCP(msg)
+func (h *Handler) onDHCPMessage(ctx context.Context, t devices.Topic, msg []byte) error {
+	var logger *logrus.Entry
+	h.formations.ViewDevice(t.DeviceName, func(tx *devices.Tx) error {
+		logger = tx.Logger(logging.WithTrace(h.log, ctx), t.DeviceName)
+		return nil
+	})
+
+	dhcpState, err := ParseDHCP(msg, logger)
 	if err != nil {
 		return err
 	}
 
-	h.broker.Publish(fmt.Sprintf("matriarch/%s/dhcp/leases", t.DeviceName), dhcpState)
+	h.broker.Publish(ctx, fmt.Sprintf("matriarch/%s/dhcp/leases", t.DeviceName), dhcpState)
 	return nil
 }
 
@@ -420,7 +507,13 @@ func round(f float64) int64 {
 	return int64(math.Floor(f + 0.5))
 }
 
-func (h *Handler) publish(deviceName string, state *State) {
+func (h *Handler) publish(ctx context.Context, deviceName string, msg *Message) {
+	h.broker.Publish(ctx, fmt.Sprintf("matriarch/%s/stations", deviceName), msg)
+}
+
+// compileMessage copies the stations of state into a Message, so that it can be published
+// after the formation is unlocked
+func compileMessage(state *State) *Message {
 	now := time.Now().UTC().Unix()
 
 	msg := &Message{
@@ -435,96 +528,33 @@ func (h *Handler) publish(deviceName string, state *State) {
 			station["seen"] = now - round(age)
 		}
 
+		cp := make(WifiStation, len(station))
+		for k, v := range station {
+			cp[k] = v
+		}
+
 		if station["mode"] == "public" {
-			msg.Public = append(msg.Public, station)
+			msg.Public = append(msg.Public, cp)
 		} else {
-			msg.Private = append(msg.Private, station)
+			msg.Private = append(msg.Private, cp)
 		}
 	}
 
 	for _, thing := range state.Things {
 		if len(thing.MAC) > 0 {
 			thing.Seen = now - round(thing.Age)
-			msg.Thing = append(msg.Thing, thing)
+			cp := *thing
+			msg.Thing = append(msg.Thing, &cp)
 		}
 	}
 
 	i := 0
 	for _, station := range state.LanStations {
 		station.Seen = now - round(station.Age)
-		msg.Other[i] = station
+		cp := *station
+		msg.Other[i] = &cp
 		i++
 	}
 
-	h.broker.Publish(fmt.Sprintf("matriarch/%s/stations", deviceName), msg)
-}
-
-func unmarshalWifiPollMessage(payload interface{}) (*WifiPollMessage, error) {
-	buf, ok := payload.([]byte)
-	if !ok {
-		return nil, fmt.Errorf("[stations] expected byte buffer, got this instead: %v", payload)
-	}
-
-	msg := new(WifiPollMessage)
-	if err := json.Unmarshal(buf, msg); err != nil {
-		return nil, err
-	}
-
-	return msg, nil
-}
-
-func unmarshalWifiEventMessage(payload interface{}) (*WifiEventMessage, error) {
-	buf, ok := payload.([]byte)
-	if !ok {
-		return nil, fmt.Errorf("[stations] expected byte buffer, got this instead: %v", payload)
-	}
-
-	msg := new(WifiEventMessage)
-	if err := json.Unmarshal(buf, msg); err != nil {
-		return nil, err
-	}
-
-	return msg, nil
-}
-
-func unmarshalThingsMessage(payload interface{}) (map[string]interface{}, error) {
-	buf, ok := payload.([]byte)
-	if !ok {
-		return nil, fmt.Errorf("[stations] expected byte buffer, got this instead: %v", payload)
-	}
-
-	var msg map[string]interface{}
-	if err := json.Unmarshal(buf, &msg); err != nil {
-		return nil, err
-	}
-
-	return msg, nil
-}
-
-func unmarshalNetMessage(payload interface{}) (*netMessage, error) {
-	buf, ok := payload.([]byte)
-	if !ok {
-		return nil, fmt.Errorf("[stations] expected byte buffer, got this instead: %v", payload)
-	}
-
-	msg := new(netMessage)
-	if err := json.Unmarshal(buf, msg); err != nil {
-		return nil, err
-	}
-
-	return msg, nil
-}
-
-func unmarshalSysMessage(payload interface{}) (*sysMessage, error) {
-	buf, ok := payload.([]byte)
-	if !ok {
-		return nil, fmt.Errorf("[stations] expected byte buffer, got this instead: %v", payload)
-	}
-
-	msg := new(sysMessage)
-	if err := json.Unmarshal(buf, msg); err != nil {
-		return nil, err
-	}
-
-	return msg, nil
+	return msg
 }
@@ -0,0 +1,71 @@
+package stations_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/stations"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/mqtt"
+)
+
+var benchWifiPollMsg = []byte(`{
+	"dev": {
+		"wlan0-private-a": {
+			"stations": "Station 4C:7C:5F:FF:FF:FF (on wlan0-private-a)\n inactive time:  370 ms\n rx bytes:       55456\n rx packets:     814\n tx bytes:       36043\n tx packets:     260\n tx retries:     0\n tx failed:      2\n signal:         -45 dBm\n signal avg:     -46 dBm\n tx bitrate:     6.0 MBit/s\n rx bitrate:     24.0 MBit/s\n authorized:     yes\n authenticated:  yes\n preamble:       long\n WMM/WME:        yes\n MFP:            no\n TDLS peer:      no\n connected time: 162 seconds"
+		}
+	}
+}`)
+
+var benchNetMsg = []byte(`{
+	"mac": [
+		{"mac": "4C:7C:5F:FF:FF:FF", "ip": "1.2.3.4"},
+		{"mac": "bb:bb:bb:bb:bb:bb", "ip": "2.3.4.5"}
+	],
+	"bridge": {
+		"macs": {
+			"public": "port no\tmac addr\t\tis local?\tageing timer\n  4\tbb:bb:bb:bb:bb:bb\tno\t\t   1.5\n",
+			"private": "port no\tmac addr\t\tis local?\tageing timer\n  4\t4C:7C:5F:FF:FF:FF\tno\t\t   1.02\n"
+		}
+	}
+}`)
+
+// BenchmarkStations publishes alternating wifi poll and net messages of devices in 1000 formations.
+// Run with -cpu 1,2,4,8 to see how throughput scales with cores.
+func BenchmarkStations(b *testing.B) {
+	const numDevices = 1000
+
+	broker := mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("bench"))
+	formations := devices.NewFormationMap()
+	stations.Register(broker, formations, logging.New("bench"))
+
+	deviceNames := make([]string, numDevices)
+	for i := range deviceNames {
+		deviceName := fmt.Sprintf("%d.marsara", i)
+		deviceNames[i] = deviceName
+
+		formations.Update(fmt.Sprintf("00000000-0000-0000-0000-%012d", i), func(tx *devices.Tx) error {
+			tx.AddDevice(deviceName)
+			return nil
+		})
+	}
+
+	var next uint64
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddUint64(&next, 1)
+			deviceName := deviceNames[n%numDevices]
+
+			if n%2 == 0 {
+				broker.Publish(context.Background(), fmt.Sprintf("pylon/%s/wifi/poll", deviceName), benchWifiPollMsg)
+			} else {
+				broker.Publish(context.Background(), fmt.Sprintf("pylon/%s/net", deviceName), benchNetMsg)
+			}
+		}
+	})
+}
@@ -1,12 +1,14 @@
 package stations_test
 
 import (
+	"context"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/superscale/spire/devices"
 	"github.com/superscale/spire/devices/stations"
+	"github.com/superscale/spire/logging"
 	"github.com/superscale/spire/mqtt"
 	"github.com/superscale/spire/testutils"
 )
@@ -24,16 +26,16 @@ var _ = Describe("Stations Handler", func() {
 	var formationID = "00000000-0000-0000-0000-000000000001"
 
 	BeforeEach(func() {
-		broker = mqtt.NewBroker(false)
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
 		formations = devices.NewFormationMap()
 		recorder = testutils.NewPubSubRecorder()
 
 		broker.Subscribe("matriarch/1.marsara/stations", recorder)
 		formations.AddDevice(deviceName, formationID)
-		stations.Register(broker, formations)
+		stations.Register(broker, formations, logging.New("test"))
 	})
 	JustBeforeEach(func() {
-		broker.Publish(topic, payload)
+		broker.Publish(context.Background(), topic, payload)
 
 		if _, m := recorder.First(); m != nil {
 			var ok bool
@@ -146,6 +148,30 @@ var _ = Describe("Stations Handler", func() {
 			Expect(station["mac"]).To(Equal("4C:7C:5F:FF:FF:FF"))
 		})
 	})
+	Describe("formation changes", func() {
+		var newFormationID = "00000000-0000-0000-0000-000000000002"
+
+		BeforeEach(func() {
+			formations.AddDevice("2.marsara", formationID)
+			for device, mac := range map[string]string{"1.marsara": "4C:7C:5F:FF:FF:FF", "2.marsara": "4C:7C:5F:FE:FE:FE"} {
+				broker.Publish(context.Background(), "pylon/"+device+"/wifi/event", []byte(`{"station": "`+mac+`", "action": "assoc"}`))
+			}
+
+			oldFormationID, moved := formations.MoveDevice(deviceName, newFormationID)
+			Expect(moved).To(BeTrue())
+
+			topic = devices.FormationChangedTopic.String()
+			payload = devices.FormationChangedMessage{DeviceName: deviceName, OldFormationID: oldFormationID, FormationID: newFormationID}
+		})
+		It("removes the stations of the device from the old formation", func() {
+			formations.RLock()
+			defer formations.RUnlock()
+			stationsState := formations.GetState(formationID, stations.Key).(*stations.State)
+
+			Expect(stationsState.WifiStations).To(HaveLen(1))
+			Expect(stationsState.WifiStations).To(HaveKey("4C:7C:5F:FE:FE:FE"))
+		})
+	})
 	Describe("disassoc event messages", func() {
 		var assocMsg = []byte(`{
 			"station": "4C:7C:5F:FF:FF:FF",
@@ -209,7 +235,7 @@ var _ = Describe("Stations Handler", func() {
 		})
 		Describe("subsequent 'net' messages", func() {
 			JustBeforeEach(func() {
-				broker.Publish("pylon/1.marsara/net", []byte(`{
+				broker.Publish(context.Background(), "pylon/1.marsara/net", []byte(`{
 					"mac": [
 						{"ip": "1.2.3.4", "mac": "12:12:12:12:12:12"}
 					]
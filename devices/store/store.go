@@ -0,0 +1,301 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/metrics"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	snapshotBucket = []byte("snapshot")
+	walBucket      = []byte("wal")
+	metaBucket     = []byte("meta")
+	snapshotSeqKey = []byte("snapshot_seq")
+)
+
+// walCapacity is the number of changes that are buffered before they are written to the write-ahead log.
+// Changes are dropped if the buffer is full, which leaves a gap in the log. Run takes a snapshot as soon
+// as possible then, since the snapshot includes them.
+const walCapacity = 10000
+
+// maxBatch is the maximum number of changes written to the write-ahead log in one transaction
+const maxBatch = 1000
+
+// record is a change with its position in the write-ahead log
+type record struct {
+	Seq    uint64
+	Change devices.StateChange
+}
+
+// Store persists the state of a FormationMap in a BoltDB file. Changes are appended to a write-ahead log,
+// which is compacted into a snapshot periodically.
+type Store struct {
+	db         *bolt.DB
+	formations *devices.FormationMap
+	changes    chan record
+	overflow   chan struct{} // signals Run that changes were dropped
+	l          sync.Mutex    // serializes Record, which is called concurrently for formations in different shards
+	seq        uint64        // sequence number of the last recorded change. guarded by l, or all shards of formations locked
+	dropped    int           // number of dropped changes that Run has not logged yet. guarded by l
+	done       chan struct{}
+	stopped    chan struct{}
+	log        *logrus.Entry
+}
+
+// Open opens the store at path, restores the persisted state into formations and
+// starts recording changes. Call Run to write them.
+func Open(path string, formations *devices.FormationMap, logger *logrus.Entry) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{snapshotBucket, walBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &Store{
+		db:         db,
+		formations: formations,
+		changes:    make(chan record, walCapacity),
+		overflow:   make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		log:        logger.WithField("path", path),
+	}
+
+	formations.Lock()
+	defer formations.Unlock()
+
+	if err := s.restore(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	formations.SetJournal(s)
+	return s, nil
+}
+
+// Record implements devices.StateJournal
+func (s *Store) Record(change devices.StateChange) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.seq++
+
+	select {
+	case s.changes <- record{s.seq, change}:
+	default:
+		metrics.PersistenceErrors.WithLabelValues("journal").Inc()
+		s.dropped++
+
+		select {
+		case s.overflow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run writes recorded changes to the write-ahead log and takes a snapshot every interval until Close is called.
+// If changes were dropped because the buffer was full, it takes a snapshot right away.
+func (s *Store) Run(interval time.Duration) {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case r := <-s.changes:
+			s.writeWAL(r)
+		case <-ticker.C:
+			s.snapshot()
+		case <-s.overflow:
+			s.l.Lock()
+			dropped := s.dropped
+			s.dropped = 0
+			s.l.Unlock()
+
+			s.log.WithField("dropped", dropped).Warn("write-ahead log buffer is full, taking a snapshot early")
+			s.snapshot()
+		case <-s.done:
+			s.snapshot()
+			return
+		}
+	}
+}
+
+// Close stops recording changes, takes a final snapshot and closes the store. Run must have been started.
+func (s *Store) Close() error {
+	s.formations.Lock()
+	s.formations.SetJournal(nil)
+	s.formations.Unlock()
+
+	close(s.done)
+	<-s.stopped
+	return s.db.Close()
+}
+
+// restore applies the snapshot and all later changes from the write-ahead log. Callers must hold the write lock.
+func (s *Store) restore() error {
+	var restored, failed int
+
+	apply := func(v []byte) {
+		if err := s.apply(v); err != nil {
+			s.log.WithError(err).Warn("skipping persisted state")
+			failed++
+			return
+		}
+		restored++
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(metaBucket).Get(snapshotSeqKey); v != nil {
+			s.seq = binary.BigEndian.Uint64(v)
+		}
+
+		tx.Bucket(snapshotBucket).ForEach(func(_, v []byte) error {
+			apply(v)
+			return nil
+		})
+
+		c := tx.Bucket(walBucket).Cursor()
+		for k, v := c.Seek(seqKey(s.seq + 1)); k != nil; k, v = c.Next() {
+			apply(v)
+			s.seq = binary.BigEndian.Uint64(k)
+		}
+		return nil
+	})
+
+	s.log.WithFields(logrus.Fields{"restored": restored, "failed": failed}).Info("restored formation state")
+	return err
+}
+
+func (s *Store) apply(v []byte) error {
+	var change devices.StateChange
+	if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&change); err != nil {
+		return err
+	}
+	return s.formations.Apply(change)
+}
+
+// writeWAL writes r and all other buffered changes to the write-ahead log in one transaction
+func (s *Store) writeWAL(r record) {
+	batch := []record{r}
+
+collect:
+	for len(batch) < maxBatch {
+		select {
+		case r := <-s.changes:
+			batch = append(batch, r)
+		default:
+			break collect
+		}
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(walBucket)
+		for _, r := range batch {
+			v, err := encode(r.Change)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(seqKey(r.Seq), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		metrics.PersistenceErrors.WithLabelValues("wal").Inc()
+		s.log.WithError(err).Error("failed to write changes to the write-ahead log")
+	}
+}
+
+// snapshot replaces the snapshot with the current state and removes the changes it includes from the write-ahead log
+func (s *Store) snapshot() {
+	start := time.Now()
+
+	s.formations.RLock()
+	changes := s.formations.Export()
+	seq := s.seq
+	s.formations.RUnlock()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(snapshotBucket); err != nil {
+			return err
+		}
+
+		b, err := tx.CreateBucket(snapshotBucket)
+		if err != nil {
+			return err
+		}
+
+		for i, c := range changes {
+			v, err := encode(c)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(seqKey(uint64(i)), v); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Bucket(metaBucket).Put(snapshotSeqKey, seqKey(seq)); err != nil {
+			return err
+		}
+
+		// collect keys first. deleting while iterating makes the cursor skip keys
+		var included [][]byte
+		wal := tx.Bucket(walBucket)
+		c := wal.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= seq; k, _ = c.Next() {
+			included = append(included, append([]byte(nil), k...))
+		}
+
+		for _, k := range included {
+			if err := wal.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		metrics.PersistenceErrors.WithLabelValues("snapshot").Inc()
+		s.log.WithError(err).Error("failed to write snapshot")
+		return
+	}
+
+	metrics.SnapshotDuration.Observe(time.Since(start).Seconds())
+	s.log.WithField("entries", len(changes)).Debug("wrote snapshot")
+}
+
+func encode(c devices.StateChange) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(c)
+	return buf.Bytes(), err
+}
+
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
@@ -0,0 +1,133 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/store"
+	"github.com/superscale/spire/logging"
+)
+
+type testState struct {
+	Count    int
+	Internal int `json:"-"`
+	Seen     map[string]time.Time
+}
+
+func init() {
+	devices.RegisterStateType("test", func() interface{} {
+		return &testState{Seen: make(map[string]time.Time)}
+	})
+}
+
+var _ = Describe("State Store", func() {
+
+	var dir, path string
+	var formations *devices.FormationMap
+	var st *store.Store
+
+	var formationID = "00000000-0000-0000-0000-000000000001"
+	var deviceName = "1.marsara"
+	var seen = time.Date(2017, 8, 23, 12, 0, 0, 0, time.UTC)
+
+	open := func() {
+		var err error
+		formations = devices.NewFormationMap()
+		st, err = store.Open(path, formations, logging.New("test"))
+		Expect(err).NotTo(HaveOccurred())
+		go st.Run(time.Hour)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "spire-store")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "state.db")
+
+		open()
+
+		formations.Lock()
+		formations.PutState(formationID, "test", &testState{Count: 1, Internal: 2, Seen: map[string]time.Time{"a": seen}})
+		formations.PutDeviceState(formationID, deviceName, "test", &testState{Count: 3})
+		formations.PutDeviceState(formationID, deviceName, "volatile", "not persisted")
+		formations.Unlock()
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+	Describe("after a restart", func() {
+		JustBeforeEach(func() {
+			Expect(st.Close()).NotTo(HaveOccurred())
+			open()
+		})
+		AfterEach(func() {
+			Expect(st.Close()).NotTo(HaveOccurred())
+		})
+		It("restores formation state", func() {
+			formations.RLock()
+			defer formations.RUnlock()
+
+			state, ok := formations.GetState(formationID, "test").(*testState)
+			Expect(ok).To(BeTrue())
+			Expect(state.Count).To(Equal(1))
+			Expect(state.Internal).To(Equal(2))
+			Expect(state.Seen["a"]).To(BeTemporally("==", seen))
+		})
+		It("restores device state", func() {
+			formations.RLock()
+			defer formations.RUnlock()
+
+			Expect(formations.FormationID(deviceName)).To(Equal(formationID))
+			state, ok := formations.GetDeviceState(deviceName, "test").(*testState)
+			Expect(ok).To(BeTrue())
+			Expect(state.Count).To(Equal(3))
+			Expect(state.Seen).NotTo(BeNil())
+		})
+		It("does not restore state that is not registered", func() {
+			formations.RLock()
+			defer formations.RUnlock()
+
+			Expect(formations.GetDeviceState(deviceName, "volatile")).To(BeNil())
+		})
+		Context("with changes after the first restart", func() {
+			BeforeEach(func() {
+				Expect(st.Close()).NotTo(HaveOccurred())
+				open()
+
+				formations.Lock()
+				formations.PutDeviceState(formationID, deviceName, "test", &testState{Count: 4})
+				formations.Unlock()
+			})
+			It("restores the latest state", func() {
+				formations.RLock()
+				defer formations.RUnlock()
+
+				state := formations.GetDeviceState(deviceName, "test").(*testState)
+				Expect(state.Count).To(Equal(4))
+			})
+		})
+		Context("with removed devices", func() {
+			BeforeEach(func() {
+				Expect(formations.RemoveDevice(deviceName)).To(BeTrue())
+			})
+			It("does not restore them", func() {
+				formations.RLock()
+				defer formations.RUnlock()
+
+				Expect(formations.FormationID(deviceName)).To(BeEmpty())
+				Expect(formations.GetDeviceState(deviceName, "test")).To(BeNil())
+				Expect(formations.GetState(formationID, "test")).NotTo(BeNil())
+			})
+		})
+	})
+	It("cannot be opened twice", func() {
+		_, err := store.Open(path, devices.NewFormationMap(), logging.New("test"))
+		Expect(err).To(HaveOccurred())
+		Expect(st.Close()).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,241 @@
+package summary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/deviceInfo"
+	"github.com/superscale/spire/devices/handlers"
+	"github.com/superscale/spire/devices/ota"
+	"github.com/superscale/spire/devices/ping"
+	"github.com/superscale/spire/devices/stations"
+	"github.com/superscale/spire/mqtt"
+)
+
+// Summary is published on matriarch/formation/<formationID>/summary
+type Summary struct {
+	FormationID   string         `json:"formation_id"`
+	Devices       []Device       `json:"devices"`
+	WorstPingLoss float64        `json:"worst_ping_loss"` // highest internet ping loss of the connected devices
+	OTA           map[string]int `json:"ota"`             // number of devices by OTA state
+	Stations      StationCounts  `json:"stations"`
+}
+
+// Device is the summary of a single device
+type Device struct {
+	Name      string  `json:"name"`
+	State     string  `json:"state"` // "up" or "down"
+	OSVersion string  `json:"os_version,omitempty"`
+	PingLoss  float64 `json:"ping_loss"`
+	Stations  int     `json:"stations"` // number of stations and things the device reported
+}
+
+// StationCounts ...
+type StationCounts struct {
+	Wifi   int `json:"wifi"`
+	Lan    int `json:"lan"`
+	Things int `json:"things"`
+}
+
+// Config ...
+type Config struct {
+	Delay time.Duration `env:"SPIRE_SUMMARY_DELAY"  envDefault:"1s"  yaml:"delay"` // changes within the delay are published at once
+}
+
+// Handler ...
+type Handler struct {
+	broker     *mqtt.Broker
+	formations *devices.FormationMap
+	config     *Config
+	log        *logrus.Entry
+	router     *devices.Router
+
+	l         sync.Mutex
+	pending   map[string]*time.Timer // formation ID -> scheduled refresh
+	published map[string]*Summary    // formation ID -> last published summary
+}
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name: "summary",
+		Register: func(deps handlers.Deps) (interface{}, error) {
+			return Register(deps.Broker, deps.Formations, deps.Logger, deps.Config.(*Config))
+		},
+		Config: func() interface{} { return new(Config) },
+	})
+}
+
+// Register ...
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, logger *logrus.Entry, cfg *Config) (interface{}, error) {
+	if cfg.Delay < 0 {
+		return nil, errors.New("delay must not be negative")
+	}
+
+	h := &Handler{
+		broker:     broker,
+		formations: formations,
+		config:     cfg,
+		log:        logger,
+		router:     devices.NewRouter("summary"),
+		pending:    make(map[string]*time.Timer),
+		published:  make(map[string]*Summary),
+	}
+
+	devices.Route(h.router, devices.ConnectTopic.String(), h.onConnect)
+	devices.Route(h.router, devices.DisconnectTopic.String(), h.onDisconnect)
+	devices.Route(h.router, devices.FormationChangedTopic.String(), h.onFormationChanged)
+	devices.Route(h.router, devices.DeviceEvictedTopic.String(), h.onEviction)
+	devices.Route(h.router, devices.FormationEvictedTopic.String(), h.onFormationEvicted)
+	devices.Route(h.router, mqtt.SubscribeEventTopic, h.onSubscribeEvent)
+
+	// the handlers that own the state publish these after they have updated it
+	for _, path := range []string{"wan/ping", "ota/state", "stations"} {
+		devices.Route(h.router, "matriarch/+/"+path, h.onDeviceUpdate)
+	}
+
+	h.router.Subscribe(broker, h)
+	return h, nil
+}
+
+// HandleMessage implements mqtt.Subscriber
+func (h *Handler) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	return h.router.HandleMessage(ctx, topic, message)
+}
+
+func (h *Handler) onConnect(_ context.Context, _ devices.Topic, cm devices.ConnectMessage) error {
+	h.schedule(cm.FormationID)
+	return nil
+}
+
+func (h *Handler) onDisconnect(_ context.Context, _ devices.Topic, dm devices.DisconnectMessage) error {
+	h.schedule(dm.FormationID)
+	return nil
+}
+
+func (h *Handler) onFormationChanged(_ context.Context, _ devices.Topic, fc devices.FormationChangedMessage) error {
+	h.schedule(fc.OldFormationID)
+	return nil
+}
+
+func (h *Handler) onEviction(_ context.Context, _ devices.Topic, em devices.EvictionMessage) error {
+	h.schedule(em.FormationID)
+	return nil
+}
+
+func (h *Handler) onFormationEvicted(_ context.Context, _ devices.Topic, em devices.EvictionMessage) error {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	if t, exists := h.pending[em.FormationID]; exists {
+		t.Stop()
+		delete(h.pending, em.FormationID)
+	}
+	delete(h.published, em.FormationID)
+	return nil
+}
+
+func (h *Handler) onDeviceUpdate(_ context.Context, t devices.Topic, _ interface{}) error {
+	if formationID := h.formations.FormationID(t.DeviceName); len(formationID) > 0 {
+		h.schedule(formationID)
+	}
+	return nil
+}
+
+// onSubscribeEvent publishes the summary for subscriptions to matriarch/formation/<formationID>/summary
+func (h *Handler) onSubscribeEvent(ctx context.Context, _ devices.Topic, sm mqtt.SubscribeMessage) error {
+	for _, topic := range sm.Topics {
+		t := devices.ParseTopic(topic)
+		if t.Prefix != "matriarch" || t.DeviceName != "formation" {
+			continue
+		}
+
+		formationID, path, _ := strings.Cut(t.Path, "/")
+		if formationID != "+" && formationID != "#" && len(formationID) > 0 && (path == "summary" || path == "#") {
+			h.broker.Publish(ctx, summaryTopic(formationID), h.compile(formationID))
+		}
+	}
+	return nil
+}
+
+// schedule refreshes the summary of formationID after the configured delay, unless a refresh is pending already
+func (h *Handler) schedule(formationID string) {
+	if len(formationID) == 0 {
+		return
+	}
+
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	if _, exists := h.pending[formationID]; exists {
+		return
+	}
+	h.pending[formationID] = time.AfterFunc(h.config.Delay, func() { h.refresh(formationID) })
+}
+
+// refresh publishes the summary of formationID if it changed
+func (h *Handler) refresh(formationID string) {
+	s := h.compile(formationID)
+
+	h.l.Lock()
+	delete(h.pending, formationID)
+	changed := !reflect.DeepEqual(h.published[formationID], s)
+	if changed {
+		h.published[formationID] = s
+	}
+	h.l.Unlock()
+
+	if changed {
+		h.broker.Publish(context.Background(), summaryTopic(formationID), s)
+	}
+}
+
+func (h *Handler) compile(formationID string) *Summary {
+	s := &Summary{FormationID: formationID, Devices: []Device{}, OTA: make(map[string]int)}
+
+	h.formations.View(formationID, func(tx *devices.Tx) error {
+		state, _ := stations.StateSlot.Get(tx, formationID)
+		owned := make(map[string]int)
+
+		if state != nil {
+			s.Stations = StationCounts{Wifi: len(state.WifiStations), Lan: len(state.LanStations), Things: len(state.Things)}
+			for _, owner := range state.Owners {
+				owned[owner]++
+			}
+		}
+
+		for _, deviceName := range tx.Devices() {
+			d := Device{Name: deviceName, State: "down", Stations: owned[deviceName]}
+
+			if lc, ok := devices.LifecycleSlot.Get(tx, deviceName); ok && lc.Connected() {
+				d.State = "up"
+			}
+			if info, ok := deviceInfo.Slot.Get(tx, deviceName); ok && info["device_os"] != nil {
+				d.OSVersion = fmt.Sprint(info["device_os"])
+			}
+			if p, ok := ping.StateSlot.Get(tx, deviceName); ok {
+				d.PingLoss = p.Internet.Ping.LossNow
+			}
+			if o, ok := ota.StateSlot.Get(tx, deviceName); ok {
+				s.OTA[o.State.String()]++
+			}
+
+			if d.State == "up" && d.PingLoss > s.WorstPingLoss {
+				s.WorstPingLoss = d.PingLoss
+			}
+			s.Devices = append(s.Devices, d)
+		}
+		return nil
+	})
+	return s
+}
+
+func summaryTopic(formationID string) string {
+	return fmt.Sprintf("matriarch/formation/%s/summary", formationID)
+}
@@ -0,0 +1,115 @@
+package summary_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/deviceInfo"
+	"github.com/superscale/spire/devices/ota"
+	"github.com/superscale/spire/devices/ping"
+	"github.com/superscale/spire/devices/stations"
+	"github.com/superscale/spire/devices/summary"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/testutils"
+)
+
+var _ = Describe("Summary Handler", func() {
+
+	var broker *mqtt.Broker
+	var formations *devices.FormationMap
+	var recorder *testutils.PubSubRecorder
+
+	var formationID = "00000000-0000-0000-0000-000000000001"
+	var summaryTopic = "matriarch/formation/" + formationID + "/summary"
+
+	lastSummary := func() *summary.Summary {
+		_, raw := recorder.Last()
+		return raw.(*summary.Summary)
+	}
+	connect := func(deviceName string) {
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			devices.LifecycleSlot.Put(tx, formationID, deviceName, &devices.Lifecycle{ConnectedAt: time.Now()})
+			return nil
+		})
+		broker.Publish(context.Background(), devices.ConnectTopic.String(), devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName})
+	}
+
+	BeforeEach(func() {
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
+		formations = devices.NewFormationMap()
+		recorder = testutils.NewPubSubRecorder()
+
+		broker.Subscribe(summaryTopic, recorder)
+		_, err := summary.Register(broker, formations, logging.New("test"), &summary.Config{Delay: 10 * time.Millisecond})
+		Expect(err).NotTo(HaveOccurred())
+
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			deviceInfo.Slot.Put(tx, formationID, "1.marsara", map[string]interface{}{"device_os": "2.1.0"})
+			ota.StateSlot.Put(tx, formationID, "1.marsara", &ota.Message{State: ota.Downloading})
+
+			p := new(ping.Message)
+			p.Internet.Ping.LossNow = 0.25
+			ping.StateSlot.Put(tx, formationID, "1.marsara", p)
+
+			state := stations.NewState()
+			state.WifiStations["00:00:00:00:00:01"] = stations.WifiStation{}
+			state.LanStations["00:00:00:00:00:02"] = &stations.LanStation{}
+			state.Owners = map[string]string{"00:00:00:00:00:01": "1.marsara", "00:00:00:00:00:02": "1.marsara"}
+			stations.StateSlot.Put(tx, formationID, state)
+
+			devices.LifecycleSlot.Put(tx, formationID, "2.marsara", &devices.Lifecycle{DisconnectedAt: time.Now()})
+			return nil
+		})
+	})
+	It("publishes the summary when a device connects", func() {
+		connect("1.marsara")
+		Eventually(recorder.Count).Should(Equal(1))
+
+		s := lastSummary()
+		Expect(s.Devices).To(Equal([]summary.Device{
+			{Name: "1.marsara", State: "up", OSVersion: "2.1.0", PingLoss: 0.25, Stations: 2},
+			{Name: "2.marsara", State: "down"},
+		}))
+		Expect(s.WorstPingLoss).To(Equal(0.25))
+		Expect(s.OTA).To(Equal(map[string]int{"downloading": 1}))
+		Expect(s.Stations).To(Equal(summary.StationCounts{Wifi: 1, Lan: 1}))
+	})
+	It("publishes changes within the delay at once", func() {
+		connect("1.marsara")
+		connect("2.marsara")
+		Eventually(recorder.Count).Should(Equal(1))
+		Consistently(recorder.Count, "50ms").Should(Equal(1))
+
+		Expect(lastSummary().Devices[1].State).To(Equal("up"))
+	})
+	It("does not publish unchanged summaries", func() {
+		connect("1.marsara")
+		Eventually(recorder.Count).Should(Equal(1))
+
+		broker.Publish(context.Background(), "matriarch/1.marsara/wan/ping", &ping.Message{})
+		Consistently(recorder.Count, "50ms").Should(Equal(1))
+	})
+	It("refreshes the summary on device updates", func() {
+		connect("1.marsara")
+		Eventually(recorder.Count).Should(Equal(1))
+
+		formations.Update(formationID, func(tx *devices.Tx) error {
+			ota.StateSlot.Put(tx, formationID, "1.marsara", &ota.Message{State: ota.Upgrading})
+			return nil
+		})
+		broker.Publish(context.Background(), "matriarch/1.marsara/ota/state", &ota.Message{State: ota.Upgrading})
+
+		Eventually(recorder.Count).Should(Equal(2))
+		Expect(lastSummary().OTA).To(Equal(map[string]int{"upgrading": 1}))
+	})
+	It("publishes the summary on subscribe", func() {
+		broker.Publish(context.Background(), mqtt.SubscribeEventTopic, mqtt.SubscribeMessage{Topics: []string{"matriarch/formation/" + formationID + "/#"}})
+
+		Expect(recorder.Count()).To(Equal(1))
+		Expect(lastSummary().Devices).To(HaveLen(2))
+	})
+})
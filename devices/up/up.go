@@ -3,108 +3,260 @@ package up
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/superscale/spire/devices"
+	"github.com/superscale/spire/devices/handlers"
 	"github.com/superscale/spire/mqtt"
 )
 
+// Config ...
+type Config struct {
+	Interval time.Duration `env:"SPIRE_UP_INTERVAL"  envDefault:"30s"  yaml:"interval"` // between "up" heartbeats of a device
+	// GracePeriod delays "down" after a disconnect. It is not published if the device reconnects within it.
+	GracePeriod time.Duration `env:"SPIRE_UP_GRACE_PERIOD"  envDefault:"0s"  yaml:"grace_period"`
+	// Reconnecting publishes the state "reconnecting" during the grace period instead of keeping "up"
+	Reconnecting bool `env:"SPIRE_UP_RECONNECTING"  envDefault:"false"  yaml:"reconnecting"`
+}
+
+// DefaultConfig ...
+func DefaultConfig() *Config {
+	return &Config{Interval: 30 * time.Second}
+}
+
 // Handler ...
 type Handler struct {
 	broker     *mqtt.Broker
 	formations *devices.FormationMap
+	log        *logrus.Entry
+	router     *devices.Router
+	wheel      *wheel
+
+	l       sync.Mutex
+	config  *Config
+	pending map[string]*pendingDown
+}
+
+// pendingDown is a "down" message that is published after the grace period of a disconnect
+type pendingDown struct {
+	timer *time.Timer
+}
+
+func init() {
+	handlers.Add(handlers.Definition{
+		Name: "up",
+		Register: func(deps handlers.Deps) (interface{}, error) {
+			h := Register(deps.Broker, deps.Formations, deps.Logger).(*Handler)
+			return h, h.Reconfigure(deps.Config)
+		},
+		Config: func() interface{} { return new(Config) },
+	})
 }
 
 // Register ...
-func Register(broker *mqtt.Broker, formations *devices.FormationMap) interface{} {
-	h := &Handler{broker, formations}
+func Register(broker *mqtt.Broker, formations *devices.FormationMap, logger *logrus.Entry) interface{} {
+	h := &Handler{
+		broker:     broker,
+		formations: formations,
+		log:        logger,
+		router:     devices.NewRouter("up"),
+		config:     DefaultConfig(),
+		pending:    make(map[string]*pendingDown),
+	}
+
+	h.wheel = newWheel(h.publishHeartbeats)
+	h.wheel.setInterval(h.config.Interval)
+	go h.wheel.run()
 
-	broker.Subscribe(devices.ConnectTopic.String(), h)
-	broker.Subscribe(devices.DisconnectTopic.String(), h)
-	broker.Subscribe(mqtt.SubscribeEventTopic, h)
+	devices.Route(h.router, devices.ConnectTopic.String(), h.onConnect)
+	devices.Route(h.router, devices.DisconnectTopic.String(), h.onDisconnect)
+	devices.Route(h.router, mqtt.SubscribeEventTopic, h.onSubscribeEvent)
+	h.router.Subscribe(broker, h)
 	return h
 }
 
 // HandleMessage ...
-func (h *Handler) HandleMessage(topic string, message interface{}) error {
-	h.formations.Lock()
-	defer h.formations.Unlock()
+func (h *Handler) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	return h.router.HandleMessage(ctx, topic, message)
+}
 
-	t := devices.ParseTopic(topic)
+// Reconfigure applies a new heartbeat interval and grace period. It implements handlers.Reconfigurer.
+// Pending disconnects keep the grace period they were started with.
+func (h *Handler) Reconfigure(section interface{}) error {
+	cfg, ok := section.(*Config)
+	if !ok {
+		return fmt.Errorf("expected *up.Config, got %T", section)
+	}
+
+	if cfg.Interval < minInterval {
+		return fmt.Errorf("interval must be at least %v", minInterval)
+	}
 
-	if t.Path == devices.ConnectTopic.Path {
-		return h.onConnect(message.(devices.ConnectMessage))
-	} else if t.Path == devices.DisconnectTopic.Path {
-		return h.onDisconnect(message.(devices.DisconnectMessage))
-	} else if topic == mqtt.SubscribeEventTopic {
-		return h.onSubscribeEvent(message.(mqtt.SubscribeMessage))
+	if cfg.GracePeriod < 0 {
+		return fmt.Errorf("grace period must not be negative")
 	}
 
+	h.l.Lock()
+	h.config = cfg
+	h.l.Unlock()
+
+	h.wheel.setInterval(cfg.Interval)
 	return nil
 }
 
-func (h *Handler) onConnect(cm devices.ConnectMessage) error {
-	ctx, cancelFn := context.WithCancel(context.Background())
-	h.formations.PutDeviceState(cm.FormationID, cm.DeviceName, "cancelUpFn", cancelFn)
+// Stop stops the heartbeats of all devices and drops pending disconnects
+func (h *Handler) Stop() {
+	h.wheel.stop()
+
+	h.l.Lock()
+	defer h.l.Unlock()
 
-	go h.publishUpState(ctx, cm.DeviceName)
+	for deviceName, p := range h.pending {
+		p.timer.Stop()
+		delete(h.pending, deviceName)
+	}
+}
+
+func (h *Handler) onConnect(ctx context.Context, _ devices.Topic, cm devices.ConnectMessage) error {
+	h.wheel.add(cm.DeviceName)
+
+	// the device reconnected within the grace period
+	h.l.Lock()
+	if p, exists := h.pending[cm.DeviceName]; exists {
+		p.timer.Stop()
+		delete(h.pending, cm.DeviceName)
+	}
+	h.l.Unlock()
+
+	lc := h.lifecycle(cm.DeviceName)
+	if lc == nil || !lc.Connected() {
+		lc = &devices.Lifecycle{ConnectedAt: time.Now().UTC()}
+	}
+
+	h.publishUpMsg(ctx, cm.DeviceName, lc)
 	return nil
 }
 
-func (h *Handler) onDisconnect(dm devices.DisconnectMessage) error {
-	r := h.formations.GetDeviceState(dm.DeviceName, "cancelUpFn")
-	cancelFn, ok := r.(context.CancelFunc)
-	if !ok {
-		return fmt.Errorf("cannot cancel goroutine that publishes 'up' state for device %s", dm.DeviceName)
+func (h *Handler) onDisconnect(ctx context.Context, _ devices.Topic, dm devices.DisconnectMessage) error {
+	if !h.wheel.remove(dm.DeviceName) {
+		return fmt.Errorf("no 'up' heartbeats scheduled for device %s", dm.DeviceName)
 	}
 
-	cancelFn()
+	lc := h.lifecycle(dm.DeviceName)
+	if lc == nil || lc.Connected() {
+		lc = &devices.Lifecycle{DisconnectedAt: time.Now().UTC()}
+	}
 
-	h.formations.DeleteDeviceState(dm.FormationID, dm.DeviceName, "cancelUpFn")
+	h.l.Lock()
+	gracePeriod, reconnecting := h.config.GracePeriod, h.config.Reconnecting
+	if gracePeriod > 0 {
+		p := new(pendingDown)
+		p.timer = time.AfterFunc(gracePeriod, func() { h.gracePeriodExpired(dm.DeviceName, p, lc) })
+		h.pending[dm.DeviceName] = p
+	}
+	h.l.Unlock()
+
+	// without "reconnecting", the state stays "up" until the grace period expires
+	if gracePeriod == 0 || reconnecting {
+		h.publishUpMsg(ctx, dm.DeviceName, lc)
+	}
 	return nil
 }
 
-func (h *Handler) onSubscribeEvent(sm mqtt.SubscribeMessage) error {
+// gracePeriodExpired publishes "down" unless the device reconnected in the meantime
+func (h *Handler) gracePeriodExpired(deviceName string, p *pendingDown, lc *devices.Lifecycle) {
+	h.l.Lock()
+	current := h.pending[deviceName] == p
+	if current {
+		delete(h.pending, deviceName)
+	}
+	h.l.Unlock()
+
+	if current {
+		h.publishUpMsg(context.Background(), deviceName, lc)
+	}
+}
+
+func (h *Handler) onSubscribeEvent(ctx context.Context, _ devices.Topic, sm mqtt.SubscribeMessage) error {
 
 	for _, topic := range sm.Topics {
 		t := devices.ParseTopic(topic)
 
 		if t.DeviceName != "+" && (t.Path == "up" || t.Path == "#") {
-
-			if h.formations.GetDeviceState(t.DeviceName, "cancelUpFn") != nil {
-				h.publishUpMsg(t.DeviceName, upState)
-			} else {
-				h.publishUpMsg(t.DeviceName, downState)
-			}
+			h.publishUpMsg(ctx, t.DeviceName, h.lifecycle(t.DeviceName))
 		}
 	}
 	return nil
 }
 
-func (h *Handler) publishUpState(ctx context.Context, deviceName string) {
-	h.publishUpMsg(deviceName, upState)
+// publishHeartbeats publishes an "up" message for every device. It is called by the wheel
+// for the devices of one slot at a time.
+func (h *Handler) publishHeartbeats(deviceNames []string) {
+	for _, deviceName := range deviceNames {
+		lc := h.lifecycle(deviceName)
 
-	for {
-		select {
-		case <-ctx.Done():
-			h.publishUpMsg(deviceName, downState)
-			return
-		case <-time.After(30 * time.Second):
-			h.publishUpMsg(deviceName, upState)
+		// the device disconnected while the wheel was turning
+		if lc == nil || !lc.Connected() || !h.wheel.contains(deviceName) {
+			continue
 		}
+
+		h.publishUpMsg(context.Background(), deviceName, lc)
 	}
 }
 
+func (h *Handler) lifecycle(deviceName string) (lc *devices.Lifecycle) {
+	h.formations.ViewDevice(deviceName, func(tx *devices.Tx) error {
+		lc, _ = devices.LifecycleSlot.Get(tx, deviceName)
+		return nil
+	})
+	return
+}
+
 const upState = "up"
 const downState = "down"
 
-func (h *Handler) publishUpMsg(deviceName, state string) {
+const reconnectingState = "reconnecting"
+
+// publishUpMsg publishes the state of a device. "since" is the time of the last connect or disconnect,
+// "last_seen" is now for connected devices and the time of the disconnect otherwise. Both are omitted
+// for unknown devices. Devices within the grace period of a disconnect are "reconnecting" or still
+// "up", depending on the configuration.
+func (h *Handler) publishUpMsg(ctx context.Context, deviceName string, lc *devices.Lifecycle) {
 	topic := fmt.Sprintf("matriarch/%s/up", deviceName)
+	now := time.Now().UTC()
 
 	msg := map[string]interface{}{
-		"state":     state,
-		"timestamp": time.Now().UTC().Unix(),
+		"state":     downState,
+		"timestamp": now.Unix(),
+	}
+
+	h.l.Lock()
+	_, pending := h.pending[deviceName]
+	reconnecting := h.config.Reconnecting
+	h.l.Unlock()
+
+	switch {
+	case lc == nil:
+	case lc.Connected():
+		msg["state"] = upState
+		msg["since"] = lc.ConnectedAt.Unix()
+		msg["last_seen"] = now.Unix()
+	case pending && reconnecting:
+		msg["state"] = reconnectingState
+		msg["since"] = lc.DisconnectedAt.Unix()
+		msg["last_seen"] = lc.DisconnectedAt.Unix()
+	case pending:
+		msg["state"] = upState
+		if !lc.ConnectedAt.IsZero() {
+			msg["since"] = lc.ConnectedAt.Unix()
+		}
+		msg["last_seen"] = lc.DisconnectedAt.Unix()
+	default:
+		msg["since"] = lc.DisconnectedAt.Unix()
+		msg["last_seen"] = lc.DisconnectedAt.Unix()
 	}
 
-	h.broker.Publish(topic, msg)
+	h.broker.Publish(ctx, topic, msg)
 }
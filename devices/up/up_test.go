@@ -1,13 +1,16 @@
 package up_test
 
 import (
+	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/superscale/spire/devices"
 	"github.com/superscale/spire/devices/up"
+	"github.com/superscale/spire/logging"
 	"github.com/superscale/spire/mqtt"
 	"github.com/superscale/spire/testutils"
 )
@@ -17,23 +20,27 @@ var _ = Describe("Up Message Handler", func() {
 	var broker *mqtt.Broker
 	var formations *devices.FormationMap
 	var recorder *testutils.PubSubRecorder
+	var handler *up.Handler
 
 	var formationID = "00000000-0000-0000-0000-000000000001"
 	var deviceName = "1.marsara"
 	var upTopic = "matriarch/1.marsara/up"
 
 	BeforeEach(func() {
-		broker = mqtt.NewBroker(false)
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
 		formations = devices.NewFormationMap()
 		recorder = testutils.NewPubSubRecorder()
 
 		broker.Subscribe(upTopic, recorder)
-		up.Register(broker, formations)
+		handler = up.Register(broker, formations, logging.New("test")).(*up.Handler)
+	})
+	AfterEach(func() {
+		handler.Stop()
 	})
 	Describe("connect", func() {
 		BeforeEach(func() {
 			m := devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName, DeviceInfo: nil}
-			broker.Publish(devices.ConnectTopic.String(), m)
+			broker.Publish(context.Background(), devices.ConnectTopic.String(), m)
 		})
 		It("publishes an 'up' message for the device with state = \"up\"", func() {
 			Eventually(func() int {
@@ -56,7 +63,7 @@ var _ = Describe("Up Message Handler", func() {
 		Describe("disconnect", func() {
 			BeforeEach(func() {
 				m := devices.DisconnectMessage{FormationID: formationID, DeviceName: deviceName}
-				broker.Publish(devices.DisconnectTopic.String(), m)
+				broker.Publish(context.Background(), devices.DisconnectTopic.String(), m)
 			})
 			It("publishes an 'up' message for the device with state = \"down\"", func() {
 				Eventually(func() int {
@@ -75,6 +82,95 @@ var _ = Describe("Up Message Handler", func() {
 				_, ok = timestamp.(int64)
 				Expect(ok).To(BeTrue())
 			})
+			It("stops the heartbeats", func() {
+				Expect(handler.Reconfigure(&up.Config{Interval: 64 * time.Millisecond})).To(Succeed())
+				Consistently(recorder.Count, 200*time.Millisecond).Should(Equal(2))
+			})
+		})
+		Context("with a short interval", func() {
+			BeforeEach(func() {
+				formations.Update(formationID, func(tx *devices.Tx) error {
+					devices.LifecycleSlot.Put(tx, formationID, deviceName, &devices.Lifecycle{ConnectedAt: time.Now().UTC().Add(-time.Hour)})
+					return nil
+				})
+				Expect(handler.Reconfigure(&up.Config{Interval: 64 * time.Millisecond})).To(Succeed())
+			})
+			It("publishes heartbeats with the time of the connect", func() {
+				Eventually(recorder.Count).Should(BeNumerically(">=", 3))
+
+				_, raw := recorder.Last()
+				msg := raw.(map[string]interface{})
+				Expect(msg["state"]).To(Equal("up"))
+				Expect(msg["since"]).To(BeNumerically("~", time.Now().Add(-time.Hour).Unix(), 1))
+				Expect(msg["last_seen"]).To(BeNumerically("~", time.Now().Unix(), 1))
+			})
+		})
+	})
+	Describe("grace period", func() {
+		var reconnecting bool
+
+		connect := func() {
+			m := devices.ConnectMessage{FormationID: formationID, DeviceName: deviceName}
+			broker.Publish(context.Background(), devices.ConnectTopic.String(), m)
+		}
+		disconnect := func() {
+			m := devices.DisconnectMessage{FormationID: formationID, DeviceName: deviceName, Reason: devices.DisconnectEOF}
+			broker.Publish(context.Background(), devices.DisconnectTopic.String(), m)
+		}
+		state := func(i int) interface{} {
+			_, raw := recorder.Get(i)
+			return raw.(map[string]interface{})["state"]
+		}
+
+		JustBeforeEach(func() {
+			cfg := &up.Config{Interval: time.Hour, GracePeriod: 100 * time.Millisecond, Reconnecting: reconnecting}
+			Expect(handler.Reconfigure(cfg)).To(Succeed())
+
+			connect()
+			disconnect()
+		})
+		Context("without the reconnecting state", func() {
+			BeforeEach(func() {
+				reconnecting = false
+			})
+			It("publishes \"down\" after the grace period", func() {
+				Expect(recorder.Count()).To(Equal(1))
+				Eventually(recorder.Count).Should(Equal(2))
+				Expect(state(1)).To(Equal("down"))
+			})
+			It("does not publish \"down\" if the device reconnects", func() {
+				connect()
+				Consistently(recorder.Count, 200*time.Millisecond).Should(Equal(2))
+				Expect(state(0)).To(Equal("up"))
+				Expect(state(1)).To(Equal("up"))
+			})
+		})
+		Context("with the reconnecting state", func() {
+			BeforeEach(func() {
+				reconnecting = true
+			})
+			It("publishes \"reconnecting\" and then \"down\"", func() {
+				Expect(recorder.Count()).To(Equal(2))
+				Expect(state(1)).To(Equal("reconnecting"))
+
+				Eventually(recorder.Count).Should(Equal(3))
+				Expect(state(2)).To(Equal("down"))
+			})
+			It("publishes \"up\" if the device reconnects", func() {
+				connect()
+				Consistently(recorder.Count, 200*time.Millisecond).Should(Equal(3))
+				Expect(state(2)).To(Equal("up"))
+			})
+		})
+	})
+	Describe("reconfigure", func() {
+		It("rejects intervals that are too short", func() {
+			Expect(handler.Reconfigure(&up.Config{})).To(MatchError("interval must be at least 64ms"))
+			Expect(handler.Reconfigure(&up.Config{Interval: 63})).To(MatchError("interval must be at least 64ms"))
+		})
+		It("rejects negative grace periods", func() {
+			cfg := &up.Config{Interval: time.Second, GracePeriod: -time.Second}
+			Expect(handler.Reconfigure(cfg)).To(MatchError("grace period must not be negative"))
 		})
 	})
 	Describe("sends current state on subscribe", func() {
@@ -116,10 +212,11 @@ var _ = Describe("Up Message Handler", func() {
 			BeforeEach(func() {
 				formations.Lock()
 				defer formations.Unlock()
-				formations.PutDeviceState(formationID, deviceName, "cancelUpFn", func() {})
+				devices.LifecycleSlot.Put(formations, formationID, deviceName, &devices.Lifecycle{ConnectedAt: time.Unix(1500000000, 0)})
 			})
 			It("publishes an 'up' message for the device with state = \"up\"", func() {
 				Expect(payload["state"]).To(Equal("up"))
+				Expect(payload["since"]).To(BeNumerically("==", 1500000000))
 			})
 		})
 	})
@@ -0,0 +1,113 @@
+package up
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// numSlots is the number of slots of the heartbeat wheel. Every slot is due once per interval.
+const numSlots = 64
+
+// minInterval makes the wheel advance at most once per millisecond
+const minInterval = numSlots * time.Millisecond
+
+// wheel is a timing wheel that calls tick for the devices of one slot at a time, so that the
+// heartbeats of all devices are spread evenly over the interval. Devices are assigned to slots by
+// the hash of their name, so that devices that connect at the same time do not share a slot.
+type wheel struct {
+	l      sync.Mutex
+	slots  [numSlots]map[string]struct{}
+	cursor int
+
+	tick     func(deviceNames []string)
+	interval chan time.Duration
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newWheel(tick func(deviceNames []string)) *wheel {
+	w := &wheel{tick: tick, interval: make(chan time.Duration, 1), done: make(chan struct{})}
+	for i := range w.slots {
+		w.slots[i] = make(map[string]struct{})
+	}
+	return w
+}
+
+func slotOf(deviceName string) int {
+	h := fnv.New32a()
+	h.Write([]byte(deviceName))
+	return int(h.Sum32() % numSlots)
+}
+
+// add schedules heartbeats for deviceName. Adding a device twice has no effect.
+func (w *wheel) add(deviceName string) {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	w.slots[slotOf(deviceName)][deviceName] = struct{}{}
+}
+
+// remove stops the heartbeats for deviceName. It returns false if none were scheduled.
+func (w *wheel) remove(deviceName string) bool {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	slot := w.slots[slotOf(deviceName)]
+	_, exists := slot[deviceName]
+	delete(slot, deviceName)
+	return exists
+}
+
+// contains returns true if heartbeats are scheduled for deviceName
+func (w *wheel) contains(deviceName string) bool {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	_, exists := w.slots[slotOf(deviceName)][deviceName]
+	return exists
+}
+
+// setInterval changes the time it takes the wheel to turn once. It can be called while the wheel runs.
+func (w *wheel) setInterval(interval time.Duration) {
+	select {
+	case <-w.interval:
+	default:
+	}
+	w.interval <- interval
+}
+
+// run turns the wheel until stop is called. The interval must be set before.
+func (w *wheel) run() {
+	ticker := time.NewTicker(<-w.interval / numSlots)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case interval := <-w.interval:
+			ticker.Reset(interval / numSlots)
+		case <-ticker.C:
+			w.tick(w.advance())
+		}
+	}
+}
+
+// advance moves the cursor to the next slot and returns its devices
+func (w *wheel) advance() []string {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	w.cursor = (w.cursor + 1) % numSlots
+
+	deviceNames := make([]string, 0, len(w.slots[w.cursor]))
+	for deviceName := range w.slots[w.cursor] {
+		deviceNames = append(deviceNames, deviceName)
+	}
+	return deviceNames
+}
+
+func (w *wheel) stop() {
+	w.stopOnce.Do(func() { close(w.done) })
+}
@@ -0,0 +1,64 @@
+package liberator
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker is a circuit breaker that opens after a number of consecutive failures and
+// lets a single trial request through once the cooldown has passed
+type breaker struct {
+	l         sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	trial     bool // a trial request is in flight while half-open
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a request may be sent
+func (b *breaker) allow() bool {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true
+	}
+
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+
+	b.trial = true
+	return true
+}
+
+func (b *breaker) success() {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	b.failures = 0
+	b.trial = false
+}
+
+func (b *breaker) failure() {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *breaker) open() bool {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	return b.threshold > 0 && b.failures >= b.threshold
+}
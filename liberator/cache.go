@@ -0,0 +1,68 @@
+package liberator
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	deviceName string
+	info       map[string]interface{}
+	fetchedAt  time.Time
+}
+
+// cache is an LRU cache of device info. Expired entries are kept until they are evicted
+// so that they can be served while liberator is unavailable.
+type cache struct {
+	l        sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List // front is most recently used
+}
+
+func newCache(capacity int) *cache {
+	return &cache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (c *cache) get(deviceName string) (*cacheEntry, bool) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	el, exists := c.entries[deviceName]
+	if !exists {
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry), true
+}
+
+func (c *cache) put(deviceName string, info map[string]interface{}) {
+	if c.capacity <= 0 {
+		return
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	entry := &cacheEntry{deviceName: deviceName, info: info, fetchedAt: time.Now()}
+
+	if el, exists := c.entries[deviceName]; exists {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[deviceName] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).deviceName)
+	}
+}
@@ -0,0 +1,215 @@
+package liberator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/metrics"
+)
+
+// ErrCircuitOpen is returned when requests to liberator are suspended after repeated failures
+var ErrCircuitOpen = errors.New("liberator circuit breaker is open")
+
+// StatusError is returned when liberator responds with an unexpected status code
+type StatusError struct {
+	DeviceName string
+	StatusCode int
+	Status     string
+	Message    interface{}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected response from liberator for device %s. status: %d %s. error: %v",
+		e.DeviceName, e.StatusCode, e.Status, e.Message)
+}
+
+// Options configure a Client
+type Options struct {
+	BaseURL          string
+	Token            string
+	Timeout          time.Duration // per request
+	Retries          int           // additional attempts after a failed request
+	RetryBackoff     time.Duration // base delay before the first retry. doubled for every further retry
+	BreakerThreshold int           // consecutive failed lookups that open the circuit breaker. 0 disables the breaker
+	BreakerCooldown  time.Duration // time until a trial request is let through an open breaker
+	CacheSize        int           // number of devices to cache. 0 disables the cache
+	CacheTTL         time.Duration // age after which cached device info is fetched again
+}
+
+// OptionsFromConfig returns the options configured via the SPIRE_LIBERATOR_* and SPIRE_DEVICE_INFO_* params
+func OptionsFromConfig(params *config.Params) Options {
+	return Options{
+		BaseURL:          params.LiberatorBaseURL,
+		Token:            params.LiberatorJWTToken,
+		Timeout:          params.LiberatorTimeout,
+		Retries:          params.LiberatorRetries,
+		RetryBackoff:     params.LiberatorRetryBackoff,
+		BreakerThreshold: params.LiberatorBreakerThreshold,
+		BreakerCooldown:  params.LiberatorBreakerCooldown,
+		CacheSize:        params.DeviceInfoCacheSize,
+		CacheTTL:         params.DeviceInfoCacheTTL,
+	}
+}
+
+// Client fetches device info from liberator
+type Client struct {
+	opts    Options
+	http    *http.Client
+	breaker *breaker
+	cache   *cache
+	log     *logrus.Entry
+}
+
+// NewClient ...
+func NewClient(opts Options, logger *logrus.Entry) *Client {
+	return &Client{
+		opts:    opts,
+		http:    &http.Client{Timeout: opts.Timeout},
+		breaker: newBreaker(opts.BreakerThreshold, opts.BreakerCooldown),
+		cache:   newCache(opts.CacheSize),
+		log:     logger,
+	}
+}
+
+// DeviceInfo returns the device info for deviceName. Device info is served from the cache until it
+// expires. If it cannot be fetched from liberator, expired device info is returned with stale set to
+// true, unless liberator does not know the device.
+func (c *Client) DeviceInfo(ctx context.Context, deviceName string) (info map[string]interface{}, stale bool, err error) {
+	entry, cached := c.cache.get(deviceName)
+	if cached && time.Since(entry.fetchedAt) < c.opts.CacheTTL {
+		metrics.DeviceInfoLookups.WithLabelValues("cached").Inc()
+		return entry.info, false, nil
+	}
+
+	info, err = c.fetch(ctx, deviceName)
+	if err == nil {
+		c.cache.put(deviceName, info)
+		metrics.DeviceInfoLookups.WithLabelValues("fetched").Inc()
+		return info, false, nil
+	}
+
+	if statusErr, ok := err.(*StatusError); cached && !(ok && statusErr.StatusCode == http.StatusNotFound) {
+		c.log.WithError(err).WithField("fetched_at", entry.fetchedAt).Warn("using stale device info for " + deviceName)
+		metrics.DeviceInfoLookups.WithLabelValues("stale").Inc()
+		return entry.info, true, nil
+	}
+
+	metrics.DeviceInfoLookups.WithLabelValues("failed").Inc()
+	return nil, false, err
+}
+
+// fetch requests device info from liberator, retrying on network errors and 5xx responses
+func (c *Client) fetch(ctx context.Context, deviceName string) (map[string]interface{}, error) {
+	if !c.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	defer c.updateBreakerMetric()
+
+	var info map[string]interface{}
+	var err error
+
+	for attempt := 0; attempt <= c.opts.Retries; attempt++ {
+		if attempt > 0 {
+			if err := c.sleep(ctx, attempt); err != nil {
+				break
+			}
+			c.log.WithError(err).WithField("attempt", attempt).Debug("retrying device info request for " + deviceName)
+		}
+
+		info, err = c.request(ctx, deviceName)
+		if err == nil {
+			c.breaker.success()
+			return info, nil
+		}
+
+		if !retryable(err) {
+			// liberator is up and answered. this is not a reason to open the breaker
+			c.breaker.success()
+			return nil, err
+		}
+	}
+
+	c.breaker.failure()
+	return nil, err
+}
+
+func (c *Client) updateBreakerMetric() {
+	if c.breaker.open() {
+		metrics.LiberatorBreakerOpen.Set(1)
+	} else {
+		metrics.LiberatorBreakerOpen.Set(0)
+	}
+}
+
+func (c *Client) request(ctx context.Context, deviceName string) (map[string]interface{}, error) {
+	url := fmt.Sprintf("%s/v2/devices/%s", c.opts.BaseURL, deviceName)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Add("Authorization", "Bearer "+c.opts.Token)
+
+	start := time.Now()
+	resp, err := c.http.Do(req)
+	metrics.DeviceInfoDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	info := make(map[string]interface{})
+	decodeErr := json.Unmarshal(buf, &info)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{
+			DeviceName: deviceName,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Message:    info["error"],
+		}
+	}
+
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	return info, nil
+}
+
+// sleep waits for the exponential backoff of the given attempt with jitter of +/- 50%
+func (c *Client) sleep(ctx context.Context, attempt int) error {
+	backoff := c.opts.RetryBackoff << uint(attempt-1)
+	if backoff > 0 {
+		backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+	}
+
+	select {
+	case <-time.After(backoff):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func retryable(err error) bool {
+	if statusErr, ok := err.(*StatusError); ok {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
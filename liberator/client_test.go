@@ -0,0 +1,198 @@
+package liberator_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/liberator"
+	"github.com/superscale/spire/logging"
+)
+
+// mockLiberator answers device info requests with the configured status
+type mockLiberator struct {
+	l        sync.Mutex
+	status   int
+	delay    time.Duration
+	requests map[string]int // path -> count
+}
+
+func (m *mockLiberator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.l.Lock()
+	m.requests[r.URL.Path]++
+	status, delay := m.status, m.delay
+	m.l.Unlock()
+
+	time.Sleep(delay)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if status == http.StatusOK {
+		w.Write([]byte(`{"data": {"name": "` + r.URL.Path + `"}}`))
+	} else {
+		w.Write([]byte(`{"error": "nope"}`))
+	}
+}
+
+func (m *mockLiberator) set(status int) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.status = status
+}
+
+func (m *mockLiberator) count(deviceName string) int {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return m.requests["/v2/devices/"+deviceName]
+}
+
+var _ = Describe("Liberator Client", func() {
+
+	var mock *mockLiberator
+	var server *httptest.Server
+	var opts liberator.Options
+	var client *liberator.Client
+
+	var deviceName = "1.marsara"
+
+	BeforeEach(func() {
+		mock = &mockLiberator{status: http.StatusOK, requests: make(map[string]int)}
+		server = httptest.NewServer(mock)
+
+		opts = liberator.Options{
+			BaseURL:          server.URL,
+			Token:            "token",
+			Timeout:          time.Second,
+			Retries:          2,
+			RetryBackoff:     time.Millisecond,
+			BreakerThreshold: 2,
+			BreakerCooldown:  time.Hour,
+			CacheSize:        10,
+			CacheTTL:         time.Hour,
+		}
+	})
+	JustBeforeEach(func() {
+		client = liberator.NewClient(opts, logging.New("test"))
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+	It("fetches device info", func() {
+		info, stale, err := client.DeviceInfo(context.Background(), deviceName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stale).To(BeFalse())
+		Expect(info["data"]).To(HaveKeyWithValue("name", "/v2/devices/"+deviceName))
+	})
+	It("caches device info", func() {
+		for i := 0; i < 3; i++ {
+			_, _, err := client.DeviceInfo(context.Background(), deviceName)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(mock.count(deviceName)).To(Equal(1))
+	})
+	Context("with a short cache TTL", func() {
+		BeforeEach(func() {
+			opts.CacheTTL = time.Millisecond
+		})
+		It("fetches expired device info again", func() {
+			client.DeviceInfo(context.Background(), deviceName)
+			time.Sleep(5 * time.Millisecond)
+			client.DeviceInfo(context.Background(), deviceName)
+
+			Expect(mock.count(deviceName)).To(Equal(2))
+		})
+	})
+	Context("with a full cache", func() {
+		BeforeEach(func() {
+			opts.CacheSize = 1
+		})
+		It("evicts the least recently used device", func() {
+			client.DeviceInfo(context.Background(), deviceName)
+			client.DeviceInfo(context.Background(), "2.marsara")
+			client.DeviceInfo(context.Background(), deviceName)
+
+			Expect(mock.count(deviceName)).To(Equal(2))
+		})
+	})
+	Context("when liberator fails", func() {
+		BeforeEach(func() {
+			mock.status = http.StatusBadGateway
+		})
+		It("retries the request", func() {
+			_, _, err := client.DeviceInfo(context.Background(), deviceName)
+			Expect(err).To(HaveOccurred())
+			Expect(mock.count(deviceName)).To(Equal(3))
+		})
+		It("opens the circuit breaker after repeated failures", func() {
+			client.DeviceInfo(context.Background(), deviceName)
+			client.DeviceInfo(context.Background(), deviceName)
+
+			_, _, err := client.DeviceInfo(context.Background(), deviceName)
+			Expect(err).To(Equal(liberator.ErrCircuitOpen))
+			Expect(mock.count(deviceName)).To(Equal(6))
+		})
+		Context("after the cooldown", func() {
+			BeforeEach(func() {
+				opts.BreakerCooldown = 10 * time.Millisecond
+			})
+			It("closes the breaker if a trial request succeeds", func() {
+				client.DeviceInfo(context.Background(), deviceName)
+				client.DeviceInfo(context.Background(), deviceName)
+
+				mock.set(http.StatusOK)
+				time.Sleep(20 * time.Millisecond)
+
+				_, _, err := client.DeviceInfo(context.Background(), deviceName)
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+		Context("with cached device info", func() {
+			BeforeEach(func() {
+				opts.CacheTTL = time.Millisecond
+			})
+			It("returns stale device info", func() {
+				mock.set(http.StatusOK)
+				_, _, err := client.DeviceInfo(context.Background(), deviceName)
+				Expect(err).NotTo(HaveOccurred())
+
+				mock.set(http.StatusBadGateway)
+				time.Sleep(5 * time.Millisecond)
+
+				info, stale, err := client.DeviceInfo(context.Background(), deviceName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(stale).To(BeTrue())
+				Expect(info["data"]).NotTo(BeNil())
+			})
+		})
+	})
+	Context("when liberator does not know the device", func() {
+		BeforeEach(func() {
+			mock.status = http.StatusNotFound
+		})
+		It("does not retry", func() {
+			_, _, err := client.DeviceInfo(context.Background(), deviceName)
+
+			statusErr, ok := err.(*liberator.StatusError)
+			Expect(ok).To(BeTrue())
+			Expect(statusErr.StatusCode).To(Equal(http.StatusNotFound))
+			Expect(mock.count(deviceName)).To(Equal(1))
+		})
+	})
+	Context("when liberator is slow", func() {
+		BeforeEach(func() {
+			mock.delay = 100 * time.Millisecond
+			opts.Timeout = 10 * time.Millisecond
+			opts.Retries = 0
+		})
+		It("times out", func() {
+			start := time.Now()
+			_, _, err := client.DeviceInfo(context.Background(), deviceName)
+			Expect(err).To(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically("<", 100*time.Millisecond))
+		})
+	})
+})
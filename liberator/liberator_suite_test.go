@@ -0,0 +1,14 @@
+package liberator_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// TestLiberator ...
+func TestLiberator(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Spire Liberator Client Suite")
+}
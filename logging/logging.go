@@ -0,0 +1,155 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/tracing"
+)
+
+// Keys for the fields attached to log entries
+const (
+	SubsystemKey  = "subsystem"
+	HandlerKey    = "handler"
+	DeviceKey     = "device"
+	FormationKey  = "formation"
+	RemoteAddrKey = "remote_addr"
+	TraceIDKey    = "trace_id"
+	SpanIDKey     = "span_id"
+)
+
+var (
+	l       sync.Mutex
+	loggers = make(map[string]*logrus.Logger) // subsystem -> logger
+	current *config.Params                    // params passed to the last successful call to Configure
+)
+
+func init() {
+	config.AddValidator(func(params *config.Params) error {
+		if _, err := parseLevels(params); err != nil {
+			return fmt.Errorf("SPIRE_LOG_LEVEL/SPIRE_LOG_LEVELS: %v", err)
+		}
+		return nil
+	})
+}
+
+// New returns a logger for the given subsystem (e.g. "mqtt", "devices" or a handler name).
+// Loggers for the same subsystem share their level, which can be set per subsystem
+// via SPIRE_LOG_LEVELS.
+func New(subsystem string) *logrus.Entry {
+	l.Lock()
+	defer l.Unlock()
+
+	logger, exists := loggers[subsystem]
+	if !exists {
+		params := current
+		if params == nil {
+			params = config.Config
+		}
+
+		logger = logrus.New()
+		logger.Out = os.Stderr
+		logger.SetFormatter(formatter(params.LogFormat))
+
+		if level, err := levelFor(subsystem, params); err == nil {
+			logger.SetLevel(level)
+		}
+
+		loggers[subsystem] = logger
+	}
+
+	return logger.WithField(SubsystemKey, subsystem)
+}
+
+// ForHandler returns a logger for a message handler. Entries carry the handler name.
+func ForHandler(name string) *logrus.Entry {
+	return New(name).WithField(HandlerKey, name)
+}
+
+// WithTrace adds the trace and span ID carried by ctx (if any) to the entries of logger
+func WithTrace(logger *logrus.Entry, ctx context.Context) *logrus.Entry {
+	span := tracing.FromContext(ctx)
+	if span == nil {
+		return logger
+	}
+
+	return logger.WithFields(logrus.Fields{
+		TraceIDKey: span.TraceID,
+		SpanIDKey:  span.SpanID,
+	})
+}
+
+// Configure validates the logging params and applies format and levels to all existing loggers
+func Configure(params *config.Params) error {
+	if _, err := parseLevels(params); err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	current = params
+	for subsystem, logger := range loggers {
+		level, _ := levelFor(subsystem, params)
+		logger.SetLevel(level)
+		logger.SetFormatter(formatter(params.LogFormat))
+	}
+	return nil
+}
+
+func formatter(format string) logrus.Formatter {
+	if format == "logfmt" {
+		return &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+	}
+	return &logrus.JSONFormatter{}
+}
+
+func levelFor(subsystem string, params *config.Params) (logrus.Level, error) {
+	levels, err := parseLevels(params)
+	if err != nil {
+		return logrus.InfoLevel, err
+	}
+
+	if level, exists := levels[subsystem]; exists {
+		return level, nil
+	}
+	return levels[""], nil
+}
+
+// parseLevels returns the levels configured in SPIRE_LOG_LEVELS ("stations=debug,mqtt=warn")
+// with the default level from SPIRE_LOG_LEVEL stored under the empty string.
+func parseLevels(params *config.Params) (map[string]logrus.Level, error) {
+	levels := map[string]logrus.Level{"": logrus.InfoLevel}
+
+	if len(params.LogLevel) > 0 {
+		level, err := logrus.ParseLevel(params.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+		levels[""] = level
+	}
+
+	for _, pair := range strings.Split(params.LogLevels, ",") {
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid log level setting '%s'. expected <subsystem>=<level>", pair)
+		}
+
+		level, err := logrus.ParseLevel(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		levels[strings.TrimSpace(parts[0])] = level
+	}
+
+	return levels, nil
+}
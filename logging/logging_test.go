@@ -0,0 +1,61 @@
+package logging_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/logging"
+)
+
+var _ = Describe("Logging", func() {
+
+	var params *config.Params
+	var err error
+
+	BeforeEach(func() {
+		params = &config.Params{LogFormat: "json", LogLevel: "info"}
+	})
+	JustBeforeEach(func() {
+		err = logging.Configure(params)
+	})
+	AfterEach(func() {
+		Expect(logging.Configure(&config.Params{})).NotTo(HaveOccurred())
+	})
+	Context("with per-subsystem levels", func() {
+		BeforeEach(func() {
+			params.LogLevels = "stations=debug, mqtt=warn"
+		})
+		It("applies the level of the subsystem", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logging.New("stations").Logger.Level).To(Equal(logrus.DebugLevel))
+			Expect(logging.New("mqtt").Logger.Level).To(Equal(logrus.WarnLevel))
+		})
+		It("applies the default level to other subsystems", func() {
+			Expect(logging.New("ota").Logger.Level).To(Equal(logrus.InfoLevel))
+		})
+	})
+	Context("with a handler logger", func() {
+		It("adds the handler name to entries", func() {
+			entry := logging.ForHandler("ping")
+			Expect(entry.Data[logging.HandlerKey]).To(Equal("ping"))
+			Expect(entry.Data[logging.SubsystemKey]).To(Equal("ping"))
+		})
+	})
+	Context("with an invalid level", func() {
+		BeforeEach(func() {
+			params.LogLevels = "stations=chatty"
+		})
+		It("returns an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context("with a malformed setting", func() {
+		BeforeEach(func() {
+			params.LogLevels = "stations"
+		})
+		It("returns an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -1,21 +1,54 @@
 package main
 
 import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/bugsnag/bugsnag-go"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/superscale/spire/admin"
 	"github.com/superscale/spire/config"
 	"github.com/superscale/spire/devices"
-	"github.com/superscale/spire/devices/deviceInfo"
-	"github.com/superscale/spire/devices/exception"
-	"github.com/superscale/spire/devices/ota"
-	"github.com/superscale/spire/devices/ping"
-	"github.com/superscale/spire/devices/sentry"
-	"github.com/superscale/spire/devices/stations"
-	"github.com/superscale/spire/devices/up"
+	"github.com/superscale/spire/devices/availability"
+	"github.com/superscale/spire/devices/handlers"
+	"github.com/superscale/spire/devices/inventory"
+	"github.com/superscale/spire/devices/presence"
+	"github.com/superscale/spire/devices/registry"
+	"github.com/superscale/spire/devices/store"
+	"github.com/superscale/spire/logging"
 	"github.com/superscale/spire/mqtt"
+	"github.com/superscale/spire/tracing"
+
+	// message handlers register themselves with the handlers package
+	_ "github.com/superscale/spire/devices/broadcast"
+	_ "github.com/superscale/spire/devices/commands"
+	_ "github.com/superscale/spire/devices/deviceInfo"
+	_ "github.com/superscale/spire/devices/exception"
+	_ "github.com/superscale/spire/devices/ota"
+	_ "github.com/superscale/spire/devices/ping"
+	_ "github.com/superscale/spire/devices/rpc"
+	_ "github.com/superscale/spire/devices/sentry"
+	_ "github.com/superscale/spire/devices/shadow"
+	_ "github.com/superscale/spire/devices/stargate"
+	_ "github.com/superscale/spire/devices/stations"
+	_ "github.com/superscale/spire/devices/summary"
+	_ "github.com/superscale/spire/devices/up"
 )
 
 func main() {
-	config.Parse()
+	if err := config.Parse(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := logging.Configure(config.Config); err != nil {
+		log.Fatal(err)
+	}
 
 	if len(config.Config.BugsnagKey) > 0 {
 		bugsnag.Configure(bugsnag.Configuration{
@@ -24,33 +57,182 @@ func main() {
 		})
 	}
 
-	broker := mqtt.NewBroker(config.Config.SlashPrefixTopics)
+	if len(config.Config.OTLPEndpoint) > 0 {
+		exporter := tracing.NewOTLPExporter(config.Config.OTLPEndpoint, logging.New("tracing"))
+		tracing.SetExporter(exporter)
+		go exporter.Run()
+	}
+
+	mqttLogger := logging.New("mqtt")
+	broker := mqtt.NewBroker(config.Config.SlashPrefixTopics, config.Config.DeadLetterCapacity, mqttLogger)
 	formations := devices.NewFormationMap()
-	loadMessageHandlers(broker, formations)
+	if len(config.Config.StatePath) > 0 {
+		openStore(formations)
+	}
+	loaded := loadMessageHandlers(broker, formations)
+
+	collector := devices.NewCollector(formations, broker, func() time.Duration {
+		return config.Current().StateRetention
+	}, logging.New("collector"))
+	go collector.Run(config.Config.StateGCInterval)
+
+	deviceRegistry, err := registry.FromConfig(config.Config, logging.New("registry"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	go reloadOnSignal(loaded, deviceRegistry)
+
+	adminServer := admin.NewServer(config.Config.AdminBind, logging.New("admin"))
+	adminServer.Handle("/metrics", promhttp.Handler())
+	adminServer.Handle("/deadletters", admin.JSON(func(*http.Request) (interface{}, error) {
+		return broker.DeadLetters(), nil
+	}))
+	handleStateEndpoints(adminServer, formations)
+	handleAvailabilityEndpoints(adminServer, formations)
+	handleInventoryEndpoints(adminServer, formations)
+	go adminServer.Run()
 
-	devHandler := devices.NewHandler(formations, broker)
-	devicesServer := mqtt.NewServer(config.Config.DevicesBind, devHandler.HandleConnection)
+	devHandler := devices.NewHandler(formations, broker, deviceRegistry, logging.New("devices"))
+	devicesServer := mqtt.NewServer(config.Config.DevicesBind, devHandler.HandleConnection, mqttLogger)
 	go devicesServer.Run()
 
-	controlServer := mqtt.NewServer(config.Config.ControlBind, broker.HandleConnection)
+	controlServer := mqtt.NewServer(config.Config.ControlBind, broker.HandleConnection, mqttLogger)
 	controlServer.Run()
 }
 
-type registerFn func(*mqtt.Broker, *devices.FormationMap) interface{}
+func loadMessageHandlers(broker *mqtt.Broker, formations *devices.FormationMap) map[string]interface{} {
+	loaded, err := handlers.Load(broker, formations, handlers.SelectionFromConfig(config.Config))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	names := make([]string, 0, len(loaded))
+	for name := range loaded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	logging.New("main").WithField("handlers", names).Info("loaded message handlers")
+	return loaded
+}
+
+// handleStateEndpoints adds endpoints for inspecting the state slots of formations and devices, and the presence history of devices
+func handleStateEndpoints(adminServer *admin.Server, formations *devices.FormationMap) {
+	adminServer.Handle("/state/slots", admin.JSON(func(*http.Request) (interface{}, error) {
+		return devices.Slots(), nil
+	}))
+
+	adminServer.Handle("/state/devices/", admin.JSON(func(r *http.Request) (interface{}, error) {
+		deviceName := strings.TrimPrefix(r.URL.Path, "/state/devices/")
+
+		if len(formations.FormationID(deviceName)) == 0 {
+			return nil, admin.NotFound("unknown device " + deviceName)
+		}
+		return formations.DeviceSlotValues(deviceName), nil
+	}))
+
+	adminServer.Handle("/presence/devices/", admin.JSON(func(r *http.Request) (interface{}, error) {
+		deviceName := strings.TrimPrefix(r.URL.Path, "/presence/devices/")
+
+		history, ok := presence.DeviceHistory(formations, deviceName)
+		if !ok {
+			return nil, admin.NotFound("unknown device " + deviceName)
+		}
+		return history, nil
+	}))
+
+	adminServer.Handle("/state/formations/", admin.JSON(func(r *http.Request) (interface{}, error) {
+		formationID := strings.TrimPrefix(r.URL.Path, "/state/formations/")
+
+		return formations.FormationSlotValues(formationID), nil
+	}))
+}
+
+// handleAvailabilityEndpoints adds endpoints for the availability of devices and formations
+func handleAvailabilityEndpoints(adminServer *admin.Server, formations *devices.FormationMap) {
+	adminServer.Handle("/availability/devices/", admin.JSON(func(r *http.Request) (interface{}, error) {
+		deviceName := strings.TrimPrefix(r.URL.Path, "/availability/devices/")
+
+		report, ok := availability.DeviceAvailability(formations, deviceName, time.Now().UTC())
+		if !ok {
+			return nil, admin.NotFound("no availability for device " + deviceName)
+		}
+		return report, nil
+	}))
+
+	adminServer.Handle("/availability/formations/", admin.JSON(func(r *http.Request) (interface{}, error) {
+		formationID := strings.TrimPrefix(r.URL.Path, "/availability/formations/")
+
+		return availability.FormationAvailability(formations, formationID, time.Now().UTC()), nil
+	}))
+}
+
+// handleInventoryEndpoints adds an endpoint for querying the inventory, e.g. "/inventory?formation_id=<id>&version_lt=42"
+func handleInventoryEndpoints(adminServer *admin.Server, formations *devices.FormationMap) {
+	adminServer.Handle("/inventory", admin.JSON(func(r *http.Request) (interface{}, error) {
+		q, err := inventory.ParseQuery(r.URL.Query())
+		if err != nil {
+			return nil, admin.BadRequest(err.Error())
+		}
+		return inventory.Find(formations, q), nil
+	}))
+}
 
-func loadMessageHandlers(broker *mqtt.Broker, formations *devices.FormationMap) {
+// openStore restores the formation state and persists it until spire is terminated
+func openStore(formations *devices.FormationMap) {
+	logger := logging.New("store")
 
-	regFns := []registerFn{
-		deviceInfo.Register,
-		exception.Register,
-		ota.Register,
-		ping.Register,
-		up.Register,
-		sentry.Register,
-		stations.Register,
+	st, err := store.Open(config.Config.StatePath, formations, logger)
+	if err != nil {
+		log.Fatal(err)
 	}
+	// restored devices are not connected until they reconnect
+	formations.DisconnectAll(time.Now().UTC())
+	go st.Run(config.Config.StateSnapshotInterval)
+
+	go func() {
+		term := make(chan os.Signal, 1)
+		signal.Notify(term, syscall.SIGINT, syscall.SIGTERM)
+		<-term
+
+		if err := st.Close(); err != nil {
+			logger.WithError(err).Error("failed to close store")
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
+}
+
+// reloadOnSignal applies reloadable settings on SIGHUP. Device connections are not affected.
+func reloadOnSignal(loaded map[string]interface{}, deviceRegistry devices.DeviceRegistry) {
+	logger := logging.New("main")
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		params, ignored, err := config.Reload()
+		if err != nil {
+			logger.WithError(err).Error("failed to reload config. keeping current settings")
+			continue
+		}
+
+		if len(ignored) > 0 {
+			logger.WithField("settings", ignored).Warn("changed settings require a restart and were not applied")
+		}
+
+		if err := logging.Configure(params); err != nil {
+			logger.WithError(err).Error("failed to apply logging settings")
+		}
+
+		if err := handlers.Reload(loaded); err != nil {
+			logger.WithError(err).Error("failed to reconfigure message handlers")
+		}
+
+		if r, ok := deviceRegistry.(registry.Reloader); ok {
+			if err := r.Reload(); err != nil {
+				logger.WithError(err).Error("failed to reload device registry. keeping current devices")
+			}
+		}
 
-	for _, register := range regFns {
-		register(broker, formations)
+		logger.Info("reloaded config")
 	}
 }
@@ -0,0 +1,175 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "spire"
+
+var (
+	// ConnectionsAccepted counts MQTT connections that completed the handshake, by server ("devices" or "control")
+	ConnectionsAccepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_accepted_total",
+		Help:      "Number of MQTT connections that completed the handshake.",
+	}, []string{"server"})
+
+	// ConnectionsRejected counts MQTT connections that were closed during the handshake, by server and reason
+	ConnectionsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_rejected_total",
+		Help:      "Number of MQTT connections that were closed during the handshake.",
+	}, []string{"server", "reason"})
+
+	// HandshakeDuration measures the time from accepting a device connection until CONNACK is sent,
+	// including the device info lookup.
+	HandshakeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handshake_duration_seconds",
+		Help:      "Time spent establishing a device session, including the device info lookup.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// DeviceInfoDuration measures the round trip for fetching device info from liberator
+	DeviceInfoDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "device_info_fetch_duration_seconds",
+		Help:      "Round trip time for fetching device info from liberator.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// DeviceInfoLookups counts device info lookups by result ("cached", "fetched", "stale" or "failed")
+	DeviceInfoLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "device_info_lookups_total",
+		Help:      "Number of device info lookups by result.",
+	}, []string{"result"})
+
+	// LiberatorBreakerOpen is 1 while requests to liberator are suspended by the circuit breaker
+	LiberatorBreakerOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "liberator_breaker_open",
+		Help:      "Whether requests to liberator are suspended by the circuit breaker.",
+	})
+
+	// Publishes counts messages published on the broker, by topic pattern. The device name
+	// segment of a topic is replaced with "+" to keep the number of label values bounded.
+	Publishes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "publishes_total",
+		Help:      "Number of messages published on the broker.",
+	}, []string{"pattern"})
+
+	// FanOut measures the number of subscribers a published message is delivered to
+	FanOut = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "broker_fanout_subscribers",
+		Help:      "Number of subscribers a published message is delivered to.",
+		Buckets:   []float64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256},
+	})
+
+	// HandlerDuration measures Subscriber.HandleMessage latency, by handler
+	HandlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handler_duration_seconds",
+		Help:      "Time spent in HandleMessage.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler"})
+
+	// HandlerErrors counts errors returned from Subscriber.HandleMessage, by handler
+	HandlerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "handler_errors_total",
+		Help:      "Number of errors returned from HandleMessage.",
+	}, []string{"handler"})
+
+	// HandlerPanics counts panics recovered from Subscriber.HandleMessage, by handler
+	HandlerPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "handler_panics_total",
+		Help:      "Number of panics recovered from HandleMessage.",
+	}, []string{"handler"})
+
+	// DecodeErrors counts messages that a handler's router could not decode, by handler
+	DecodeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decode_errors_total",
+		Help:      "Number of messages that could not be decoded for a handler.",
+	}, []string{"handler"})
+
+	// FormationLockWait measures how long callers wait for the FormationMap lock, by mode ("read" or "write")
+	FormationLockWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "formation_lock_wait_seconds",
+		Help:      "Time spent waiting for the FormationMap lock.",
+		Buckets:   []float64{.00001, .0001, .001, .005, .01, .05, .1, .5, 1},
+	}, []string{"mode"})
+
+	// PersistenceErrors counts failures to persist formation state, by operation ("encode", "journal", "wal" or "snapshot")
+	PersistenceErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "persistence_errors_total",
+		Help:      "Number of failures to persist formation state.",
+	}, []string{"op"})
+
+	// StateEvictions counts evicted device and formation state, by scope ("device" or "formation") and reason ("expired" or "removed")
+	StateEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "state_evictions_total",
+		Help:      "Number of devices and formations whose state was evicted.",
+	}, []string{"scope", "reason"})
+
+	// PresenceFlaps counts devices that started flapping, i.e. reconnected too often within the flap window
+	PresenceFlaps = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "presence_flaps_total",
+		Help:      "Number of times devices started flapping.",
+	})
+
+	// RPCRequests counts RPC requests by result ("ok", "error", "timeout", "offline", "rejected" or "invalid")
+	RPCRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_requests_total",
+		Help:      "Number of RPC requests to devices by result.",
+	}, []string{"result"})
+
+	// RPCDuration measures the time until a device replies to an RPC request, by method
+	RPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Time until a device replies to an RPC request.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	// SnapshotDuration measures the time to write a snapshot of the formation state
+	SnapshotDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "snapshot_duration_seconds",
+		Help:      "Time spent writing a snapshot of the formation state.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		ConnectionsAccepted,
+		ConnectionsRejected,
+		HandshakeDuration,
+		DeviceInfoDuration,
+		DeviceInfoLookups,
+		LiberatorBreakerOpen,
+		Publishes,
+		FanOut,
+		HandlerDuration,
+		HandlerErrors,
+		HandlerPanics,
+		DecodeErrors,
+		FormationLockWait,
+		PersistenceErrors,
+		PresenceFlaps,
+		RPCDuration,
+		RPCRequests,
+		SnapshotDuration,
+		StateEvictions,
+	)
+}
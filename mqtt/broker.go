@@ -1,13 +1,23 @@
 package mqtt
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"path"
+	"reflect"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/bugsnag/bugsnag-go"
 	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/sirupsen/logrus"
+	"github.com/superscale/spire/config"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/metrics"
+	"github.com/superscale/spire/tracing"
 )
 
 // InternalTopicPrefix Topics with this prefix are reserved for internal use.
@@ -17,7 +27,9 @@ const InternalTopicPrefix = "$SYS"
 // Subscriber ...
 type Subscriber interface {
 	// HandleMessage ...
-	HandleMessage(topic string, message interface{}) error
+	// The context carries the trace of the message and should be passed on to Broker.Publish()
+	// for messages published as a consequence.
+	HandleMessage(ctx context.Context, topic string, message interface{}) error
 }
 
 type subscriberMap map[string][]Subscriber
@@ -36,32 +48,41 @@ type Broker struct {
 	l           sync.RWMutex
 	subscribers subscriberMap
 	topicPrefix bool
+	log         *logrus.Entry
+	deadLetters *deadLetterRing
 }
 
 // NewBroker ...
 // If topicPrefix is true, Subscribe() and Publish() will add a leading slash to topics that
-// don't have one.
-func NewBroker(topicPrefix bool) *Broker {
+// don't have one. The broker keeps the last deadLetterCapacity dead letters in memory, or
+// DefaultDeadLetterCapacity if it is not positive.
+func NewBroker(topicPrefix bool, deadLetterCapacity int, logger *logrus.Entry) *Broker {
 	return &Broker{
 		subscribers: make(subscriberMap),
 		topicPrefix: topicPrefix,
+		log:         logger,
+		deadLetters: newDeadLetterRing(deadLetterCapacity),
 	}
 }
 
 // HandleConnection ...
 func (b *Broker) HandleConnection(session *Session) {
+	logger := b.log.WithField(logging.RemoteAddrKey, session.RemoteAddr().String())
+
 	if _, err := session.Handshake(); err != nil {
+		metrics.ConnectionsRejected.WithLabelValues("control", "handshake").Inc()
 		if err != io.EOF {
-			log.Println(err)
+			logger.WithError(err).Warn("handshake failed")
 		}
 		return
 	}
+	metrics.ConnectionsAccepted.WithLabelValues("control").Inc()
 
 	for {
 		pkg, err := session.Read()
 		if err != nil {
 			if err != io.EOF {
-				log.Println(err)
+				logger.WithError(err).Warn("error while reading packet. closing connection")
 				session.Close()
 			}
 			b.Remove(session)
@@ -73,7 +94,7 @@ func (b *Broker) HandleConnection(session *Session) {
 			err = session.SendPingresp()
 		case *packets.PublishPacket:
 			if !strings.HasPrefix(p.TopicName, InternalTopicPrefix+"/") {
-				b.Publish(p.TopicName, p.Payload)
+				b.Publish(context.Background(), p.TopicName, p.Payload)
 			}
 		case *packets.SubscribePacket:
 			err = b.HandleSubscribePacket(p, session, true)
@@ -83,13 +104,13 @@ func (b *Broker) HandleConnection(session *Session) {
 		default:
 			b.Remove(session)
 			if err = session.Close(); err != nil {
-				log.Println(err)
+				logger.WithError(err).Warn("error while closing connection")
 			}
 			return
 		}
 
 		if err != nil {
-			log.Printf("error while handling packet in broker. peer %v: %v", session.RemoteAddr(), err)
+			logger.WithError(err).Error("error while handling packet in broker")
 		}
 	}
 }
@@ -141,7 +162,7 @@ func (b *Broker) HandleSubscribePacket(pkg *packets.SubscribePacket, session *Se
 	if sendSubscribeMessage {
 		subscribeMessage := SubscribeMessage{Topics: make([]string, len(pkg.Topics))}
 		copy(subscribeMessage.Topics, pkg.Topics)
-		b.Publish(SubscribeEventTopic, subscribeMessage)
+		b.Publish(context.Background(), SubscribeEventTopic, subscribeMessage)
 	}
 	return nil
 }
@@ -192,19 +213,40 @@ func (b *Broker) UnsubscribeAll(pkg *packets.UnsubscribePacket, s Subscriber) {
 	}
 }
 
-// Publish ...
-func (b *Broker) Publish(topic string, message interface{}) {
+// Publish delivers message to all subscribers of topic. A new trace is started
+// unless ctx already carries one. Messages that a subscriber other than a session fails to process
+// are published as DeadLetter on DeadLetterTopicPrefix + subscriber name.
+func (b *Broker) Publish(ctx context.Context, topic string, message interface{}) {
 	if len(topic) == 0 {
 		return
 	}
 	topic = b.normalizeTopic(topic)
+	metrics.Publishes.WithLabelValues(topicPattern(topic)).Inc()
+
+	ctx, span := tracing.StartSpan(ctx, "publish")
+	span.SetAttribute("topic", topic)
+	defer span.Finish(nil)
+
+	deadLetters := b.publish(ctx, topic, message)
+
+	if isDeadLetterTopic(topic) {
+		return
+	}
 
+	for _, dl := range deadLetters {
+		b.deadLetters.add(dl)
+		b.Publish(ctx, DeadLetterTopicPrefix+dl.Handler, dl)
+	}
+}
+
+func (b *Broker) publish(ctx context.Context, topic string, message interface{}) []DeadLetter {
 	b.l.RLock()
 	defer b.l.RUnlock()
 
 	topics := MatchTopics(topic, b.topics())
 	if len(topics) == 0 {
-		return
+		metrics.FanOut.Observe(0)
+		return nil
 	}
 
 	subs := []Subscriber{}
@@ -212,15 +254,111 @@ func (b *Broker) Publish(topic string, message interface{}) {
 	for _, t := range topics {
 		subs = append(subs, b.get(t)...)
 	}
+	metrics.FanOut.Observe(float64(len(subs)))
+
+	var deadLetters []DeadLetter
 
 	for _, s := range subs {
-		err := s.HandleMessage(topic, message)
+		name := SubscriberName(s)
+		hctx, hspan := tracing.StartSpan(ctx, "handle")
+		hspan.SetAttribute("handler", name)
+		hspan.SetAttribute("topic", topic)
+
+		start := time.Now()
+		err := b.deliver(hctx, s, name, topic, message)
+		metrics.HandlerDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		hspan.Finish(err)
+
 		if err != nil {
-			log.Println(err)
+			metrics.HandlerErrors.WithLabelValues(name).Inc()
+
+			fields := logrus.Fields{logging.HandlerKey: name, "topic": topic}
+			if d := deviceName(topic); len(d) > 0 {
+				fields[logging.DeviceKey] = d
+			}
+			logging.WithTrace(b.log, hctx).WithFields(fields).WithError(err).Error("error while handling message")
+
+			if _, isSession := s.(*Session); !isSession {
+				deadLetters = append(deadLetters, NewDeadLetter(name, topic, message, err, tracing.ID(ctx)))
+			}
+		}
+	}
+
+	return deadLetters
+}
+
+// DeadLetters returns the most recent messages that handlers failed to process, oldest first
+func (b *Broker) DeadLetters() []DeadLetter {
+	return b.deadLetters.all()
+}
+
+// deliver passes the message to the subscriber and recovers from panics in HandleMessage,
+// so a single bad payload cannot take down the connection goroutine or other handlers.
+func (b *Broker) deliver(ctx context.Context, s Subscriber, name, topic string, message interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			metrics.HandlerPanics.WithLabelValues(name).Inc()
+			err = fmt.Errorf("recovered from panic in handler %s: %v", name, r)
+			b.reportPanic(ctx, err, name, topic, message, debug.Stack())
 		}
+	}()
+
+	return s.HandleMessage(ctx, topic, message)
+}
+
+// maxReportedPayload limits the size of payloads attached to panic reports
+const maxReportedPayload = 4096
+
+func (b *Broker) reportPanic(ctx context.Context, err error, name, topic string, message interface{}, stack []byte) {
+	payload, ok := message.([]byte)
+	if !ok {
+		payload = []byte(fmt.Sprintf("%#v", message))
+	}
+	if len(payload) > maxReportedPayload {
+		payload = payload[:maxReportedPayload]
+	}
+
+	logging.WithTrace(b.log, ctx).WithFields(logrus.Fields{
+		logging.HandlerKey: name,
+		"topic":            topic,
+		"payload":          string(payload),
+		"stack":            string(stack),
+	}).Error(err)
+
+	if len(config.Config.BugsnagKey) == 0 {
+		return
+	}
+
+	metadata := bugsnag.MetaData{}
+	metadata.Add("message", "handler", name)
+	metadata.Add("message", "topic", topic)
+	metadata.Add("message", "payload", string(payload))
+	metadata.Add("message", "stack", string(stack))
+	metadata.Add("trace", "id", tracing.ID(ctx))
+
+	if err := bugsnag.Notify(err, bugsnag.SeverityError, bugsnag.Context{String: topic}, metadata); err != nil {
+		b.log.WithError(err).Warn("failed to report panic")
 	}
 }
 
+// SubscriberName returns a short name for s that is suitable for use in metrics and logs.
+// Handlers are named after their package, e.g. "ping" or "stations". Sessions are named "session".
+func SubscriberName(s Subscriber) string {
+	if _, ok := s.(*Session); ok {
+		return "session"
+	}
+
+	t := reflect.TypeOf(s)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if len(t.PkgPath()) == 0 {
+		return t.String()
+	}
+	return path.Base(t.PkgPath())
+}
+
 // Remove ...
 func (b *Broker) Remove(s Subscriber) {
 	b.l.Lock()
@@ -299,6 +437,41 @@ func topicsMatch(t1, t2 []string) bool {
 	return true
 }
 
+// topicPattern replaces the device name in topics like "pylon/1.marsara/wan/ping", and the formation ID
+// in topics like "matriarch/formation/<formationID>/summary", with a single-level wildcard. Query strings
+// like in "$SYS/spire/query/inventory?version_lt=42" are removed. Internal topics are returned otherwise unchanged.
+func topicPattern(topic string) string {
+	topic, _, _ = strings.Cut(topic, "?")
+	parts := strings.Split(topic, "/")
+
+	i := 0
+	if len(parts[0]) == 0 {
+		i = 1
+	}
+
+	if len(parts) < i+3 || parts[i] == InternalTopicPrefix {
+		return topic
+	}
+
+	if parts[i+1] == "formation" && len(parts) > i+3 {
+		i++
+	}
+
+	parts[i+1] = singleLevelWildcard
+	return strings.Join(parts, "/")
+}
+
+// deviceName returns the device name segment of topics like "pylon/1.marsara/wan/ping"
+// or an empty string for internal topics.
+func deviceName(topic string) string {
+	parts := strings.SplitN(strings.TrimPrefix(topic, "/"), "/", 3)
+
+	if len(parts) < 3 || parts[0] == InternalTopicPrefix {
+		return ""
+	}
+	return parts[1]
+}
+
 func (b *Broker) normalizeTopic(topic string) string {
 	if b.topicPrefix && topic[0] != '/' {
 		return fmt.Sprintf("/%s", topic)
@@ -1,16 +1,44 @@
 package mqtt_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/logging"
 	"github.com/superscale/spire/mqtt"
 	"github.com/superscale/spire/testutils"
+	"github.com/superscale/spire/tracing"
 )
 
+type republisher struct {
+	broker *mqtt.Broker
+	topic  string
+}
+
+func (r *republisher) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	r.broker.Publish(ctx, r.topic, message)
+	return nil
+}
+
+type panicker struct{}
+
+func (p *panicker) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	var m map[string]string
+	m["boom"] = message.(string)
+	return nil
+}
+
+type failer struct{}
+
+func (f *failer) HandleMessage(ctx context.Context, topic string, message interface{}) error {
+	return errors.New("malformed payload")
+}
+
 var _ = Describe("Broker", func() {
 
 	var brokerSession, subscriberSession *mqtt.Session
@@ -18,7 +46,7 @@ var _ = Describe("Broker", func() {
 
 	BeforeEach(func() {
 		brokerSession, subscriberSession = testutils.Pipe()
-		broker = mqtt.NewBroker(false)
+		broker = mqtt.NewBroker(false, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
 	})
 	Context("pingreq", func() {
 		var response packets.ControlPacket
@@ -86,7 +114,7 @@ var _ = Describe("Broker", func() {
 			var pkg packets.ControlPacket
 
 			JustBeforeEach(func() {
-				go broker.Publish("pylon/1.marsara/up", map[string]string{"foo": "bar"})
+				go broker.Publish(context.Background(), "pylon/1.marsara/up", map[string]string{"foo": "bar"})
 
 				var err error
 				pkg, err = subscriberSession.Read()
@@ -106,7 +134,7 @@ var _ = Describe("Broker", func() {
 		})
 		Context("publish to a non-matching topic", func() {
 			JustBeforeEach(func() {
-				broker.Publish("pylon/2.korhal/up", map[string]string{"foo": "bar"})
+				broker.Publish(context.Background(), "pylon/2.korhal/up", map[string]string{"foo": "bar"})
 
 				go func() {
 					time.Sleep(time.Millisecond * 1)
@@ -125,7 +153,7 @@ var _ = Describe("Broker", func() {
 			JustBeforeEach(func() {
 				recorder = testutils.NewPubSubRecorder()
 				broker.Subscribe("", recorder)
-				broker.Publish("", map[string]string{"foo": "bar"})
+				broker.Publish(context.Background(), "", map[string]string{"foo": "bar"})
 			})
 			It("does not forward the message", func() {
 				Expect(recorder.Count()).To(BeZero())
@@ -139,7 +167,7 @@ var _ = Describe("Broker", func() {
 
 				broker.UnsubscribeAll(unsubPkg, brokerSession)
 
-				broker.Publish("pylon/2.marsara/up", map[string]string{"foo": "bar"})
+				broker.Publish(context.Background(), "pylon/2.marsara/up", map[string]string{"foo": "bar"})
 
 				go func() {
 					time.Sleep(time.Millisecond * 1)
@@ -158,10 +186,10 @@ var _ = Describe("Broker", func() {
 		var recorder *testutils.PubSubRecorder
 
 		JustBeforeEach(func() {
-			broker = mqtt.NewBroker(true)
+			broker = mqtt.NewBroker(true, mqtt.DefaultDeadLetterCapacity, logging.New("test"))
 			recorder = testutils.NewPubSubRecorder()
 			broker.Subscribe(subTopic, recorder)
-			broker.Publish(pubTopic, map[string]string{"foo": "bar"})
+			broker.Publish(context.Background(), pubTopic, map[string]string{"foo": "bar"})
 		})
 		Context("subscribe without leading slash", func() {
 			BeforeEach(func() {
@@ -278,7 +306,7 @@ var _ = Describe("Broker", func() {
 			broker.Subscribe(topic, sub1)
 			broker.Subscribe(topic, sub2)
 
-			broker.Publish(topic, payload)
+			broker.Publish(context.Background(), topic, payload)
 		})
 		It("publishes the message to all subscribers", func() {
 			Eventually(func() int {
@@ -298,6 +326,117 @@ var _ = Describe("Broker", func() {
 			Expect(msg).To(Equal(payload))
 		})
 	})
+	Describe("tracing", func() {
+		var recorder *testutils.PubSubRecorder
+		var ctx context.Context
+
+		BeforeEach(func() {
+			recorder = testutils.NewPubSubRecorder()
+			broker.Subscribe("matriarch/+/up", recorder)
+			broker.Subscribe("pylon/+/up", &republisher{broker, "matriarch/1.marsara/up"})
+			broker.Subscribe("pylon/+/up", recorder)
+
+			ctx, _ = tracing.StartSpan(context.Background(), "test")
+			broker.Publish(ctx, "pylon/1.marsara/up", "hi")
+		})
+		It("passes the trace on to subscribers", func() {
+			Expect(recorder.Count()).To(Equal(2))
+			Expect(tracing.ID(recorder.Context(1))).To(Equal(tracing.ID(ctx)))
+		})
+		It("passes the trace on to messages published by subscribers", func() {
+			topic, _ := recorder.First()
+			Expect(topic).To(Equal("matriarch/1.marsara/up"))
+			Expect(tracing.ID(recorder.Context(0))).To(Equal(tracing.ID(ctx)))
+		})
+		It("starts a new trace if the context does not carry one", func() {
+			broker.Publish(context.Background(), "pylon/1.marsara/up", "hi")
+			Expect(recorder.Count()).To(Equal(4))
+			Expect(tracing.ID(recorder.Context(3))).NotTo(BeEmpty())
+			Expect(tracing.ID(recorder.Context(3))).NotTo(Equal(tracing.ID(ctx)))
+		})
+	})
+	Describe("panicking subscribers", func() {
+		var recorder *testutils.PubSubRecorder
+
+		BeforeEach(func() {
+			recorder = testutils.NewPubSubRecorder()
+			broker.Subscribe("pylon/+/up", &panicker{})
+			broker.Subscribe("pylon/+/up", recorder)
+		})
+		It("do not affect the publisher or other subscribers", func() {
+			Expect(func() {
+				broker.Publish(context.Background(), "pylon/1.marsara/up", "hi")
+			}).NotTo(Panic())
+
+			Expect(recorder.Count()).To(Equal(1))
+		})
+	})
+	Describe("dead letters", func() {
+		var recorder *testutils.PubSubRecorder
+
+		BeforeEach(func() {
+			recorder = testutils.NewPubSubRecorder()
+			broker.Subscribe(mqtt.DeadLetterTopicPrefix+"#", recorder)
+			broker.Subscribe("pylon/+/wifi/poll", &failer{})
+			broker.Subscribe("pylon/+/wifi/event", &panicker{})
+
+			broker.Publish(context.Background(), "pylon/1.marsara/wifi/poll", []byte(`{"dev":`))
+			broker.Publish(context.Background(), "pylon/1.marsara/wifi/event", "hi")
+		})
+		It("publishes messages that a handler failed to process", func() {
+			Expect(recorder.Count()).To(Equal(2))
+
+			topic, raw := recorder.First()
+			Expect(topic).To(Equal(mqtt.DeadLetterTopicPrefix + "mqtt_test"))
+
+			dl, ok := raw.(mqtt.DeadLetter)
+			Expect(ok).To(BeTrue())
+			Expect(dl.Handler).To(Equal("mqtt_test"))
+			Expect(dl.Topic).To(Equal("pylon/1.marsara/wifi/poll"))
+			Expect(dl.Payload).To(Equal(`{"dev":`))
+			Expect(dl.Error).To(Equal("malformed payload"))
+			Expect(dl.Timestamp).NotTo(BeZero())
+		})
+		It("includes messages that caused a panic", func() {
+			_, raw := recorder.Last()
+			dl := raw.(mqtt.DeadLetter)
+			Expect(dl.Topic).To(Equal("pylon/1.marsara/wifi/event"))
+			Expect(dl.Payload).To(Equal(`"hi"`))
+			Expect(dl.Error).To(ContainSubstring("panic"))
+		})
+		It("keeps the last dead letters in memory", func() {
+			deadLetters := broker.DeadLetters()
+			Expect(deadLetters).To(HaveLen(2))
+			Expect(deadLetters[0].Topic).To(Equal("pylon/1.marsara/wifi/poll"))
+			Expect(deadLetters[1].Topic).To(Equal("pylon/1.marsara/wifi/event"))
+		})
+		It("discards the oldest dead letters when the capacity is reached", func() {
+			for i := 0; i < mqtt.DefaultDeadLetterCapacity; i++ {
+				broker.Publish(context.Background(), "pylon/2.korhal/wifi/poll", []byte(`{}`))
+			}
+
+			deadLetters := broker.DeadLetters()
+			Expect(deadLetters).To(HaveLen(mqtt.DefaultDeadLetterCapacity))
+			Expect(deadLetters[0].Topic).To(Equal("pylon/2.korhal/wifi/poll"))
+		})
+		It("keeps as many dead letters as configured", func() {
+			broker := mqtt.NewBroker(false, 3, logging.New("test"))
+			broker.Subscribe("pylon/+/wifi/poll", &failer{})
+
+			for i := 0; i < 5; i++ {
+				broker.Publish(context.Background(), "pylon/2.korhal/wifi/poll", []byte(`{}`))
+			}
+			Expect(broker.DeadLetters()).To(HaveLen(3))
+		})
+	})
+	Describe("subscriber names", func() {
+		It("names sessions 'session'", func() {
+			Expect(mqtt.SubscriberName(brokerSession)).To(Equal("session"))
+		})
+		It("names other subscribers after their package", func() {
+			Expect(mqtt.SubscriberName(testutils.NewPubSubRecorder())).To(Equal("testutils"))
+		})
+	})
 	Describe("internal topics", func() {
 		var sub *testutils.PubSubRecorder
 		var internalTopic = mqtt.InternalTopicPrefix + "/foo/bar"
@@ -319,8 +458,8 @@ var _ = Describe("Broker", func() {
 				_, err := subscriberSession.Read()
 				Expect(err).NotTo(HaveOccurred())
 
-				subscriberSession.HandleMessage(internalTopic, payload)
-				subscriberSession.HandleMessage(regularTopic, payload)
+				subscriberSession.HandleMessage(context.Background(), internalTopic, payload)
+				subscriberSession.HandleMessage(context.Background(), regularTopic, payload)
 			}()
 		})
 		It("ignores messages published by clients to internal topics", func() {
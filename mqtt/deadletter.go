@@ -0,0 +1,96 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeadLetterTopicPrefix Messages that a handler failed to process are published under this prefix
+// followed by the handler name, e.g. "$SYS/spire/deadletter/stations".
+const DeadLetterTopicPrefix = InternalTopicPrefix + "/spire/deadletter/"
+
+// DefaultDeadLetterCapacity is the number of dead letters kept in memory if not configured otherwise
+const DefaultDeadLetterCapacity = 100
+
+// DeadLetter is published on DeadLetterTopicPrefix + handler when HandleMessage returns an error or panics.
+type DeadLetter struct {
+	Handler   string `json:"handler"`
+	Topic     string `json:"topic"`
+	Payload   string `json:"payload"`
+	Error     string `json:"error"`
+	TraceID   string `json:"trace_id,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// NewDeadLetter ...
+func NewDeadLetter(handler, topic string, message interface{}, err error, traceID string) DeadLetter {
+	return DeadLetter{
+		Handler:   handler,
+		Topic:     topic,
+		Payload:   payloadString(message),
+		Error:     err.Error(),
+		TraceID:   traceID,
+		Timestamp: time.Now().UTC().Unix(),
+	}
+}
+
+// payloadString returns raw payloads as they are and tries to serialize everything else to JSON
+func payloadString(message interface{}) string {
+	if buf, ok := message.([]byte); ok {
+		return string(buf)
+	}
+
+	if buf, err := json.Marshal(message); err == nil {
+		return string(buf)
+	}
+	return fmt.Sprintf("%#v", message)
+}
+
+func isDeadLetterTopic(topic string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(topic, "/"), DeadLetterTopicPrefix)
+}
+
+// deadLetterRing keeps the last n dead letters
+type deadLetterRing struct {
+	l       sync.Mutex
+	letters []DeadLetter
+	next    int
+	full    bool
+}
+
+func newDeadLetterRing(capacity int) *deadLetterRing {
+	if capacity <= 0 {
+		capacity = DefaultDeadLetterCapacity
+	}
+	return &deadLetterRing{letters: make([]DeadLetter, capacity)}
+}
+
+func (r *deadLetterRing) add(dl DeadLetter) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	r.letters[r.next] = dl
+	r.next = (r.next + 1) % len(r.letters)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// all returns the dead letters in the order they were added
+func (r *deadLetterRing) all() []DeadLetter {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if !r.full {
+		res := make([]DeadLetter, r.next)
+		copy(res, r.letters[:r.next])
+		return res
+	}
+
+	res := make([]DeadLetter, 0, len(r.letters))
+	res = append(res, r.letters[r.next:]...)
+	return append(res, r.letters[:r.next]...)
+}
@@ -1,11 +1,11 @@
 package mqtt
 
 import (
-	"log"
+	"io"
 	"net"
 
+	"github.com/sirupsen/logrus"
 	"github.com/superscale/spire/config"
-	"io"
 )
 
 // SessionHandler will be run in a goroutine for each connection the server accepts
@@ -16,10 +16,11 @@ type Server struct {
 	bind        string
 	listener    net.Listener
 	sessHandler SessionHandler
+	log         *logrus.Entry
 }
 
 // NewServer instantiates a new server that listens on the address passed in "bind"
-func NewServer(bind string, sessHandler SessionHandler) *Server {
+func NewServer(bind string, sessHandler SessionHandler, logger *logrus.Entry) *Server {
 	if sessHandler == nil {
 		return nil
 	}
@@ -27,6 +28,7 @@ func NewServer(bind string, sessHandler SessionHandler) *Server {
 	return &Server{
 		bind:        bind,
 		sessHandler: sessHandler,
+		log:         logger.WithField("bind", bind),
 	}
 }
 
@@ -35,21 +37,21 @@ func (s *Server) Run() {
 	var err error
 	if s.listener, err = net.Listen("tcp", s.bind); err != nil {
 		if err != io.EOF {
-			log.Println(err)
+			s.log.Error(err)
 		}
 		return
 	}
 
-	log.Println("listening on", s.bind)
+	s.log.Info("listening")
 	for {
 		conn, err := s.listener.Accept()
 
 		if err != nil {
 			if err != io.EOF {
-				log.Println(err)
+				s.log.WithError(err).Error("failed to accept connection")
 			}
 		} else {
-			go s.sessHandler(NewSession(conn, config.Config.IdleConnectionTimeout))
+			go s.sessHandler(NewSession(conn, config.Current().IdleConnectionTimeout))
 		}
 	}
 }
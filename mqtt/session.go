@@ -1,6 +1,7 @@
 package mqtt
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -89,7 +90,7 @@ func (s *Session) SendPingresp() error {
 
 // HandleMessage serializes the message to JSON (unless it is a []byte)
 // and sends a PUBLISH packet with QoS 0
-func (s *Session) HandleMessage(topic string, message interface{}) error {
+func (s *Session) HandleMessage(_ context.Context, topic string, message interface{}) error {
 	var payload []byte
 	var ok bool
 	var err error
@@ -0,0 +1,24 @@
+package mqtt
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Topic patterns", func() {
+	DescribeTable("topicPattern",
+		func(topic, pattern string) {
+			Expect(topicPattern(topic)).To(Equal(pattern))
+		},
+		Entry("device topic", "pylon/1.marsara/wan/ping", "pylon/+/wan/ping"),
+		Entry("device topic with leading slash", "/matriarch/1.marsara/up", "/matriarch/+/up"),
+		Entry("short topic", "pylon/1.marsara", "pylon/1.marsara"),
+		Entry("formation topic", "matriarch/formation/00000000-0000-0000-0000-000000000001/summary", "matriarch/formation/+/summary"),
+		Entry("formation broadcast", "armada/formation/00000000-0000-0000-0000-000000000001/reboot", "armada/formation/+/reboot"),
+		Entry("device named formation", "matriarch/formation/up", "matriarch/+/up"),
+		Entry("internal topic", "$SYS/spire/devices/connect", "$SYS/spire/devices/connect"),
+		Entry("query", "$SYS/spire/query/inventory?formation_id=1&version_lt=42", "$SYS/spire/query/inventory"),
+		Entry("query with leading slash", "/$SYS/spire/query/inventory?version=42", "/$SYS/spire/query/inventory"),
+	)
+})
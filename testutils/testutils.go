@@ -1,6 +1,7 @@
 package testutils
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"sync"
@@ -21,6 +22,7 @@ func Pipe() (*mqtt.Session, *mqtt.Session) {
 type PubSubRecorder struct {
 	Topics   []string
 	Messages []interface{}
+	Contexts []context.Context
 	l        sync.RWMutex
 }
 
@@ -29,16 +31,18 @@ func NewPubSubRecorder() *PubSubRecorder {
 	return &PubSubRecorder{
 		Topics:   []string{},
 		Messages: []interface{}{},
+		Contexts: []context.Context{},
 	}
 }
 
 // HandleMessage implements mqtt.Subscriber
-func (r *PubSubRecorder) HandleMessage(topic string, payload interface{}) error {
+func (r *PubSubRecorder) HandleMessage(ctx context.Context, topic string, payload interface{}) error {
 	r.l.Lock()
 	defer r.l.Unlock()
 
 	r.Topics = append(r.Topics, topic)
 	r.Messages = append(r.Messages, payload)
+	r.Contexts = append(r.Contexts, ctx)
 	return nil
 }
 
@@ -62,6 +66,18 @@ func (r *PubSubRecorder) Get(i int) (string, interface{}) {
 	return "", nil
 }
 
+// Context returns the context passed along with the i-th message
+func (r *PubSubRecorder) Context(i int) context.Context {
+	r.l.RLock()
+	defer r.l.RUnlock()
+
+	if i < len(r.Contexts) {
+		return r.Contexts[i]
+	}
+
+	return nil
+}
+
 // First ...
 func (r *PubSubRecorder) First() (string, interface{}) {
 	return r.Get(0)
@@ -0,0 +1,119 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type contextKey int
+
+const spanKey contextKey = 0
+
+// Span is a unit of work within a trace, e.g. the delivery of a message to a handler.
+type Span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Err        error
+
+	l sync.Mutex
+}
+
+// Exporter receives finished spans
+type Exporter interface {
+	Export(span *Span)
+}
+
+var (
+	exporterLock sync.RWMutex
+	exporter     Exporter
+)
+
+// SetExporter sets the exporter that receives all finished spans. Pass nil to disable exporting.
+func SetExporter(e Exporter) {
+	exporterLock.Lock()
+	defer exporterLock.Unlock()
+
+	exporter = e
+}
+
+// NewContext returns a copy of parent that carries a new trace
+func NewContext(parent context.Context, name string) (context.Context, *Span) {
+	return StartSpan(context.WithValue(parent, spanKey, nil), name)
+}
+
+// StartSpan starts a span as a child of the span in ctx. If ctx does not carry a span,
+// a new trace is started.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	span := &Span{
+		SpanID:     newID(8),
+		Name:       name,
+		Start:      time.Now().UTC(),
+		Attributes: make(map[string]string),
+	}
+
+	if parent := FromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		span.TraceID = newID(16)
+	}
+
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+// FromContext returns the current span or nil
+func FromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// ID returns the trace ID carried by ctx or an empty string
+func ID(ctx context.Context) string {
+	if span := FromContext(ctx); span != nil {
+		return span.TraceID
+	}
+	return ""
+}
+
+// SetAttribute ...
+func (s *Span) SetAttribute(key, value string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.Attributes[key] = value
+}
+
+// Finish records the end time and error (if any) and hands the span to the exporter
+func (s *Span) Finish(err error) {
+	s.l.Lock()
+	s.End = time.Now().UTC()
+	s.Err = err
+	s.l.Unlock()
+
+	exporterLock.RLock()
+	defer exporterLock.RUnlock()
+
+	if exporter != nil {
+		exporter.Export(s)
+	}
+}
+
+func newID(size int) string {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,112 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/superscale/spire/logging"
+	"github.com/superscale/spire/tracing"
+)
+
+type spanRecorder struct {
+	spans []*tracing.Span
+	l     sync.Mutex
+}
+
+func (r *spanRecorder) Export(span *tracing.Span) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	r.spans = append(r.spans, span)
+}
+
+var _ = Describe("Tracing", func() {
+
+	Describe("spans", func() {
+		var recorder *spanRecorder
+		var rootCtx context.Context
+		var root *tracing.Span
+
+		BeforeEach(func() {
+			recorder = &spanRecorder{}
+			tracing.SetExporter(recorder)
+			rootCtx, root = tracing.StartSpan(context.Background(), "root")
+		})
+		AfterEach(func() {
+			tracing.SetExporter(nil)
+		})
+		It("starts a new trace for contexts without a span", func() {
+			Expect(root.TraceID).To(HaveLen(32))
+			Expect(root.SpanID).To(HaveLen(16))
+			Expect(root.ParentID).To(BeEmpty())
+			Expect(tracing.ID(rootCtx)).To(Equal(root.TraceID))
+		})
+		It("adds child spans to the trace of the parent", func() {
+			_, child := tracing.StartSpan(rootCtx, "child")
+			Expect(child.TraceID).To(Equal(root.TraceID))
+			Expect(child.ParentID).To(Equal(root.SpanID))
+		})
+		It("starts a new trace with NewContext", func() {
+			ctx, span := tracing.NewContext(rootCtx, "other")
+			Expect(span.TraceID).NotTo(Equal(root.TraceID))
+			Expect(span.ParentID).To(BeEmpty())
+			Expect(tracing.ID(ctx)).To(Equal(span.TraceID))
+		})
+		It("exports finished spans", func() {
+			root.Finish(errors.New("oops"))
+			Expect(recorder.spans).To(HaveLen(1))
+			Expect(recorder.spans[0].Err).To(HaveOccurred())
+			Expect(recorder.spans[0].End).NotTo(BeZero())
+		})
+	})
+	Describe("OTLP exporter", func() {
+		var collector *httptest.Server
+		var requests chan map[string]interface{}
+
+		BeforeEach(func() {
+			requests = make(chan map[string]interface{}, 1)
+			collector = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				Expect(r.URL.Path).To(Equal("/v1/traces"))
+
+				buf, err := ioutil.ReadAll(r.Body)
+				Expect(err).NotTo(HaveOccurred())
+
+				var payload map[string]interface{}
+				Expect(json.Unmarshal(buf, &payload)).NotTo(HaveOccurred())
+				requests <- payload
+			}))
+
+			exporter := tracing.NewOTLPExporter(collector.URL, logging.New("test"))
+			tracing.SetExporter(exporter)
+			go exporter.Run()
+
+			_, span := tracing.StartSpan(context.Background(), "handle")
+			span.SetAttribute("handler", "ping")
+			span.Finish(nil)
+		})
+		AfterEach(func() {
+			tracing.SetExporter(nil)
+			collector.Close()
+		})
+		It("sends spans to the collector", func() {
+			var payload map[string]interface{}
+			Eventually(requests, "10s").Should(Receive(&payload))
+
+			resourceSpans := payload["resourceSpans"].([]interface{})
+			Expect(resourceSpans).To(HaveLen(1))
+
+			scopeSpans := resourceSpans[0].(map[string]interface{})["scopeSpans"].([]interface{})
+			spans := scopeSpans[0].(map[string]interface{})["spans"].([]interface{})
+			Expect(spans).To(HaveLen(1))
+			Expect(spans[0].(map[string]interface{})["name"]).To(Equal("handle"))
+		})
+	})
+})